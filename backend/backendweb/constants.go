@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"time"
 )
 
 //constants used in the handlers in place of the strings to avoid typing mistakes
@@ -42,6 +43,67 @@ const (
 	deactivateAgent     = "/admin/deactivateAgent"
 	agentOnline         = "/agent/online"
 	agentOffline        = "/agent/offline"
+	agentPresence       = "/agent/presence"
+	agentHeartbeat      = "/agent/heartbeat"
+	heartbeatInterval   = 30 //seconds, must be well inside the dbmgr -hb window
+	agentCapacity       = "/admin/capacity"
+	capacity            = "capacity"
+	agentDashboard      = "/admin/dashboard"
+	dashboard           = "dashboard"
+	adminDispositions   = "/admin/dispositions"
+	dispositions        = "dispositions"
+	agentClose          = "/agent/close"
+	closeDialog         = "closeDialog"
+	adminSurveys        = "/admin/surveys"
+	surveys             = "surveys"
+	adminReports        = "/admin/reports"
+	reports             = "reports"
+	adminExport         = "/admin/export"
+	export              = "export"
+	adminSearch         = "/admin/search"
+	searchPage          = "search"
+	superAudit          = "/super/audit"
+	auditPage           = "audit"
+	superChgPwd         = "/super/changePassword"
+	superAccounts       = "/super/accounts"
+	adminAccounts       = "/admin/accounts"
+	accounts            = "accounts"
+	account             = "account"
+	adminUsers          = "/admin/users"
+	usersPage           = "users"
+	userPage            = "user"
+	superForgot         = "/super/forgot"
+	superReset          = "/super/reset"
+	adminForgot         = "/admin/forgot"
+	adminReset          = "/admin/reset"
+	agentForgot         = "/agent/forgot"
+	agentReset          = "/agent/reset"
+	forgot              = "forgot"
+	reset               = "reset"
+	superTwoFactor      = "/super/twofactor"
+	superOTP            = "/super/otp"
+	adminTwoFactor      = "/admin/twofactor"
+	adminOTP            = "/admin/otp"
+	agentTwoFactor      = "/agent/twofactor"
+	agentOTP            = "/agent/otp"
+	twoFactor           = "twofactor"
+	otp                 = "otp"
+	superSessions       = "/super/sessions"
+	adminSessions       = "/admin/sessions"
+	agentSessions       = "/agent/sessions"
+	sessionsPage        = "sessions"
+	sessionIDKey        = "sessionID"     //id of the session in the session index
+	totpIssuer          = "Toy Chat"      //name the authenticator apps show
+	pendingUserID       = "pendingUserID" //password checked, code not yet
+	pendingSince        = "pendingSince"  //when the password was checked
+	pendingTries        = "pendingTries"  //wrong codes so far
+	pendingTTL          = 5 * time.Minute //time to enter the code
+	maxCodeTries        = 5               //wrong codes before starting over
+	totpSecretKey       = "totpSecret"    //secret being enrolled
+	lockedMsg           = "Too many failed logins, please try again later"
+	dateLayout          = "2006-01-02" //date inputs of the report filters
+	defaultRangeDays    = 30           //report range when no dates are given
+	defaultCapacity     = 3            //used when role_defaults has no row for the role
 )
 
 var allTmplFiles = tmData{
@@ -75,8 +137,76 @@ var allTmplFiles = tmData{
 		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
 		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/chgpwd.tmpl"),
 	},
+	"capacity": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/capacity.tmpl"),
+	},
+	"dashboard": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/dashboard.tmpl"),
+	},
+	"dispositions": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/dispositions.tmpl"),
+	},
+	"closeDialog": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/close.tmpl"),
+	},
+	"surveys": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/surveys.tmpl"),
+	},
+	"reports": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/reports.tmpl"),
+	},
+	"export": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/export.tmpl"),
+	},
+	"search": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/search.tmpl"),
+	},
+	"audit": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/audit.tmpl"),
+	},
+	"accounts": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/accounts.tmpl"),
+	},
+	"account": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/account.tmpl"),
+	},
+	"users": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/users.tmpl"),
+	},
+	"user": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/user.tmpl"),
+	},
+	"forgot": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/forgot.tmpl"),
+	},
+	"reset": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/reset.tmpl"),
+	},
+	"twofactor": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/twofactor.tmpl"),
+	},
+	"sessions": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/sessions.tmpl"),
+	},
+	"otp": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/backend/backendviews/otp.tmpl"),
+	},
 }
-
-//Self signed keys.  Works on Safari on Mac, Chrome constantly complains
-var serverKey = filepath.Join(os.Getenv("GOPATH"), "src/toychat/certs/https-server.key")
-var serverCrt = filepath.Join(os.Getenv("GOPATH"), "src/toychat/certs/https-server.crt")
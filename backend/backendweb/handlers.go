@@ -5,12 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	//broker pkg contains the code that is used on both sides of the nats connectoin.
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
 	"github.com/saied74/toychat/pkg/forms"
+	"github.com/saied74/toychat/pkg/mailer"
+	"github.com/saied74/toychat/pkg/search"
+	"github.com/saied74/toychat/pkg/secure"
+	"github.com/saied74/toychat/pkg/totp"
+	"github.com/saied74/toychat/pkg/transcript"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -20,7 +28,7 @@ import (
 
 //============================ Home ================================
 func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
@@ -31,7 +39,7 @@ func (app *App) homeHandler(w http.ResponseWriter, r *http.Request) {
 
 //============================ Login ================================
 func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
@@ -48,10 +56,21 @@ func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 			app.clientError(w, http.StatusBadRequest, err)
 		}
 		Form := forms.NewForm(r.PostForm)
-		person, err := broker.AuthenticateXR(app.table, app.role,
-			Form.GetField("email"))
+		email := Form.GetField("email")
+		locked, err := app.loginLocked(r, email)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if locked {
+			app.td.Form.Errors.AddError("generic", lockedMsg)
+			app.render(w, r, login)
+			return
+		}
+		person, err := app.authenticateConsole(email)
 		if err != nil {
 			if errors.Is(err, broker.ErrNoRecord) {
+				app.loginFailed(r, 0, email, "no such account")
 				app.td.Form.Errors.AddError("generic", "No such a record was found")
 				app.render(w, r, login)
 			} else {
@@ -61,6 +80,7 @@ func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		hashedPassword := person.HashedPassword
 		if len(hashedPassword) != 60 {
+			app.loginFailed(r, person.ID, email, "no password")
 			app.td.Form.Errors.AddError("generic", "No such a record was found")
 			app.render(w, r, login)
 			return
@@ -69,6 +89,7 @@ func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 			[]byte(Form.GetField("password")))
 		if err != nil {
 			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				app.loginFailed(r, person.ID, email, "wrong password")
 				app.td.Form.Errors.AddError("generic", "Email or Password is incorrect")
 				app.render(w, r, login)
 			} else {
@@ -76,38 +97,487 @@ func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		app.sessionManager.RenewToken(r.Context())
-		app.sessionManager.Put(r.Context(), authenticatedUserID, person.ID)
-		http.Redirect(w, r, home, http.StatusSeeOther)
+		//with two-factor login the session only remembers that the password
+		//was right until the code is entered on the otp page.
+		if person.TOTPEnabled {
+			app.sessionManager.RenewToken(r.Context())
+			app.sessionManager.Put(r.Context(), pendingUserID, person.ID)
+			app.sessionManager.Put(r.Context(), pendingSince, time.Now())
+			app.sessionManager.Put(r.Context(), pendingTries, 0)
+			http.Redirect(w, r, app.td.OTP, http.StatusSeeOther)
+			return
+		}
+		app.loggedIn(w, r, person, "")
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//authenticateConsole looks the account with the email up among the roles that
+//log in to the console of the request.
+func (app *App) authenticateConsole(email string) (*broker.TableRow, error) {
+	for _, role := range app.perms.inConsole(app.console) {
+		person, err := broker.AuthenticateXR(app.table, role, email)
+		if !errors.Is(err, broker.ErrNoRecord) {
+			return person, err
+		}
+	}
+	return &broker.TableRow{}, broker.ErrNoRecord
+}
+
+//loggedIn finishes a login once the password (and the two-factor code when it
+//is on) is right.  An account of a role that must use two-factor login and has
+//not enrolled yet is sent to enroll first.
+func (app *App) loggedIn(w http.ResponseWriter, r *http.Request,
+	person *broker.TableRow, detail string) {
+	sid, err := broker.StartSessionR(admins, person.ID, clientIP(r),
+		r.UserAgent())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.RenewToken(r.Context())
+	app.sessionManager.Put(r.Context(), authenticatedUserID, person.ID)
+	app.sessionManager.Put(r.Context(), sessionIDKey, sid)
+	app.audit(r, broker.AuditLogin, person.ID, person.Email, detail)
+	err = broker.LoginSucceededR(app.table, person.Email)
+	if err != nil {
+		centerr.ErrorLog.Printf("login failure reset %v", err)
+	}
+	if app.perms.can(person.Role, broker.PermChat) {
+		err = broker.PublishPresence(&broker.PresenceEvent{
+			AgentID: person.ID,
+			Name:    person.Name,
+			Old:     person.Presence,
+			New:     person.Presence,
+			Reason:  broker.ReasonLogin,
+			Time:    time.Now().UTC(),
+		})
+		if err != nil {
+			centerr.ErrorLog.Printf("login presence event %v", err)
+		}
+	}
+	if !person.TOTPEnabled {
+		required, err := broker.Require2FAR(person.Role)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if required {
+			app.sessionManager.Put(r.Context(), "flash",
+				"Two-factor login is required, please set it up")
+			http.Redirect(w, r, app.td.TwoFactor, http.StatusSeeOther)
+			return
+		}
+	}
+	http.Redirect(w, r, home, http.StatusSeeOther)
+}
+
+//============================ Two-Factor Login ===============================
+//otpHandler is the second login step, the code of the authenticator app or a
+//recovery code.  It needs the password to have been checked (pendingUserID)
+//less than pendingTTL ago and starts over after maxCodeTries wrong codes.
+func (app *App) otpHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	id := app.sessionManager.GetInt(r.Context(), pendingUserID)
+	since := app.sessionManager.GetTime(r.Context(), pendingSince)
+	if id == 0 || time.Since(since) > pendingTTL {
+		app.startOver(w, r, "Please log in again")
+		return
+	}
+	switch r.Method {
+	case GET:
+		app.render(w, r, otp)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		person, err := broker.GetXR(app.table, id)
+		if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		if err != nil || app.perms.console(person.Role) != app.console ||
+			!person.Active || person.Deleted || !person.TOTPEnabled {
+			app.startOver(w, r, "Please log in again")
+			return
+		}
+		locked, err := app.loginLocked(r, person.Email)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if locked {
+			app.startOver(w, r, lockedMsg)
+			return
+		}
+		detail, err := app.checkCode(person, app.td.Form.GetField("code"))
+		if errors.Is(err, broker.ErrNoRecord) {
+			app.loginFailed(r, person.ID, person.Email, "wrong two-factor code")
+			tries := app.sessionManager.GetInt(r.Context(), pendingTries) + 1
+			if tries >= maxCodeTries {
+				app.startOver(w, r, "Too many wrong codes, please log in again")
+				return
+			}
+			app.sessionManager.Put(r.Context(), pendingTries, tries)
+			app.td.Form.Errors.AddError("generic", "The code is not correct")
+			app.render(w, r, otp)
+			return
+		}
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Remove(r.Context(), pendingUserID)
+		app.sessionManager.Remove(r.Context(), pendingSince)
+		app.sessionManager.Remove(r.Context(), pendingTries)
+		app.loggedIn(w, r, person, detail)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//startOver forgets a pending two-factor login and goes back to the login page.
+func (app *App) startOver(w http.ResponseWriter, r *http.Request, flash string) {
+	app.sessionManager.Remove(r.Context(), pendingUserID)
+	app.sessionManager.Remove(r.Context(), pendingSince)
+	app.sessionManager.Remove(r.Context(), pendingTries)
+	app.sessionManager.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, app.td.Login, http.StatusSeeOther)
+}
+
+//checkCode checks a code of the authenticator app, or a recovery code, of an
+//enrolled account and uses it up.  ErrNoRecord if it is wrong or was used
+//before, the detail for the audit log if it is right.
+func (app *App) checkCode(person *broker.TableRow, code string) (string, error) {
+	if totp.IsRecovery(code) {
+		left, err := broker.UseRecoveryR(app.table, person.ID,
+			totp.HashRecovery(code))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("recovery code, %d left", left), nil
+	}
+	step, ok := totp.Validate(person.TOTPSecret, code, time.Now(),
+		int64(person.TOTPStep))
+	if !ok {
+		return "", broker.ErrNoRecord
+	}
+	return "two-factor", broker.UseTOTPStepR(app.table, person.ID, int(step))
+}
 
+//rolePolicy is one role of the two-factor policy form of the super admin.
+type rolePolicy struct {
+	Role  string
+	Label string
+	On    bool
+}
+
+//twoFactorHandler enrolls the logged in account in two-factor login (a new
+//secret shown as a QR code, confirmed with a code), makes new recovery codes
+//or turns it off when the role does not require it.  For the super admin it
+//also sets which roles require it.
+func (app *App) twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	person, err := broker.GetXR(app.table,
+		app.sessionManager.GetInt(r.Context(), authenticatedUserID))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.td.Person = person
+	switch r.Method {
+	case GET:
+		app.renderTwoFactor(w, r)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		code := app.td.Form.GetField("code")
+		flash := ""
+		switch r.PostForm.Get("op") {
+		case "enable":
+			secret := app.sessionManager.GetString(r.Context(), totpSecretKey)
+			step, ok := totp.Validate(secret, code, time.Now(), 0)
+			if secret == "" || person.TOTPEnabled || !ok {
+				app.td.Form.Errors.AddError("code", "The code is not correct")
+				app.renderTwoFactor(w, r)
+				return
+			}
+			codes, hashes, err := totp.NewRecoveryCodes()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			err = broker.EnableTOTPR(app.table, person.ID, secret, int(step), hashes)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.sessionManager.Remove(r.Context(), totpSecretKey)
+			app.audit(r, broker.Audit2FAEnable, person.ID, person.Email, "")
+			person.TOTPEnabled = true
+			//rendered so the recovery codes never go into the session.
+			app.td.Recovery = codes
+			app.renderTwoFactor(w, r)
+			return
+		case "recovery", "disable":
+			if !person.TOTPEnabled {
+				http.Redirect(w, r, app.td.TwoFactor, http.StatusSeeOther)
+				return
+			}
+			required, err := broker.Require2FAR(person.Role)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if r.PostForm.Get("op") == "disable" && required {
+				app.td.Form.Errors.AddError("code",
+					"Two-factor login is required for your role")
+				app.renderTwoFactor(w, r)
+				return
+			}
+			_, err = app.checkCode(person, code)
+			if errors.Is(err, broker.ErrNoRecord) {
+				app.td.Form.Errors.AddError("code", "The code is not correct")
+				app.renderTwoFactor(w, r)
+				return
+			}
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if r.PostForm.Get("op") == "recovery" {
+				codes, hashes, err := totp.NewRecoveryCodes()
+				if err != nil {
+					app.serverError(w, err)
+					return
+				}
+				err = broker.NewRecoveryR(app.table, person.ID, hashes)
+				if err != nil {
+					app.serverError(w, err)
+					return
+				}
+				app.audit(r, broker.Audit2FARecovery, person.ID, person.Email, "")
+				app.td.Recovery = codes
+				app.renderTwoFactor(w, r)
+				return
+			}
+			err = broker.ResetTOTPR(app.table, person.ID)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.Audit2FADisable, person.ID, person.Email, "")
+			flash = "Two-factor login is off"
+		case "policy":
+			if !app.perms.can(app.role, broker.PermManageSecurity) {
+				app.clientError(w, http.StatusForbidden,
+					fmt.Errorf("two-factor policy by %s", app.role))
+				return
+			}
+			on := []string{}
+			for _, p := range app.twoFactorPolicies() {
+				value := strconv.FormatBool(r.PostForm.Get(p.Role) != "")
+				err = broker.PutSettingR(broker.SettingRequire2FA(p.Role), value)
+				if err != nil {
+					app.serverError(w, err)
+					return
+				}
+				if r.PostForm.Get(p.Role) != "" {
+					on = append(on, p.Role)
+				}
+			}
+			app.audit(r, broker.Audit2FAPolicy, 0, "",
+				"required for: "+strings.Join(on, ", "))
+			flash = "The two-factor policy was saved"
+		default:
+			app.clientError(w, http.StatusBadRequest,
+				fmt.Errorf("unknown two-factor op %q", r.PostForm.Get("op")))
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, app.td.TwoFactor, http.StatusSeeOther)
 	default:
 		w.WriteHeader(http.StatusNotImplemented)
 		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
 	}
 }
 
+//renderTwoFactor renders the two-factor page of app.td.Person.  Before
+//enrollment it shows a secret, kept in the session until it is confirmed.
+func (app *App) renderTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !app.td.Person.TOTPEnabled {
+		secret := app.sessionManager.GetString(r.Context(), totpSecretKey)
+		if secret == "" {
+			var err error
+			secret, err = totp.NewSecret()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.sessionManager.Put(r.Context(), totpSecretKey, secret)
+		}
+		app.td.TOTPSecret = secret
+		app.td.TOTPURI = totp.URI(totpIssuer, app.td.Person.Email, secret)
+	}
+	if app.perms.can(app.role, broker.PermManageSecurity) {
+		app.td.Policies = app.twoFactorPolicies()
+		for i, p := range app.td.Policies {
+			on, err := broker.Require2FAR(p.Role)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.td.Policies[i].On = on
+		}
+	}
+	app.render(w, r, twoFactor)
+}
+
+//twoFactorPolicies are the roles two-factor login can be required for.
+func (app *App) twoFactorPolicies() []rolePolicy {
+	policies := []rolePolicy{}
+	for _, role := range app.perms.all() {
+		policies = append(policies, rolePolicy{Role: role.Name, Label: role.Label})
+	}
+	return policies
+}
+
 //============================ Logout ================================
 func (app *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
 		return
 	}
+	//agents are moved offline and their dialogs go to other agents.
+	id := app.sessionManager.GetInt(r.Context(), authenticatedUserID)
+	if app.perms.can(app.role, broker.PermChat) && id != 0 {
+		err = broker.PutPresence(app.table, app.role, id, broker.Offline,
+			broker.ReasonLogout)
+		if err != nil {
+			centerr.ErrorLog.Printf("logout presence for %d: %v", id, err)
+		}
+		err = broker.RequeueR(id)
+		if err != nil {
+			centerr.ErrorLog.Printf("logout requeue for %d: %v", id, err)
+		} else {
+			app.audit(r, broker.AuditTransfer, id, "",
+				"logged out, open dialogs requeued")
+		}
+	}
+	if id != 0 {
+		app.audit(r, broker.AuditLogout, id, "", "")
+	}
+	err = broker.EndSessionR(admins, app.sessionManager.GetString(r.Context(),
+		sessionIDKey))
+	if err != nil {
+		centerr.ErrorLog.Printf("logout session index for %d: %v", id, err)
+	}
 	//RenewToken is used for security purpose for each state change.
 	app.sessionManager.RenewToken(r.Context())
 	app.sessionManager.Remove(r.Context(), authenticatedUserID)
+	app.sessionManager.Remove(r.Context(), sessionIDKey)
 	http.Redirect(w, r, app.redirect, http.StatusSeeOther)
 }
 
+//============================== Sessions ====================================
+//sessionsHandler lists the sessions of the logged in account.  The POST op is
+//revoke (the session with the id) or others (all but this one).
+func (app *App) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	id := app.sessionManager.GetInt(r.Context(), authenticatedUserID)
+	sid := app.sessionManager.GetString(r.Context(), sessionIDKey)
+	switch r.Method {
+	case GET:
+		sessions, err := broker.SessionsR(admins, id, sid)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.td.Sessions = &sessions
+		app.render(w, r, sessionsPage)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		flash := ""
+		switch r.PostForm.Get("op") {
+		case "revoke":
+			n, err := strconv.Atoi(r.PostForm.Get("id"))
+			if err != nil {
+				app.clientError(w, http.StatusBadRequest, err)
+				return
+			}
+			err = broker.RevokeSessionR(admins, id, n)
+			if errors.Is(err, broker.ErrNoRecord) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditRevoke, id, "", "session "+strconv.Itoa(n))
+			flash = "The session was logged out"
+		case "others":
+			err = broker.RevokeSessionsR(admins, id, sid)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditRevoke, id, "", "all other sessions")
+			flash = "All your other sessions were logged out"
+		default:
+			app.clientError(w, http.StatusBadRequest,
+				fmt.Errorf("unknown sessions op %q", r.PostForm.Get("op")))
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, app.td.MySessions, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
 //======================== Add (Admin or Agent) ===============================
 func (app *App) addHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
 		return
 	}
+	app.td.Roles = app.perms.managed(app.role)
 	switch r.Method {
 	case GET:
 		app.render(w, r, signup)
@@ -115,13 +585,18 @@ func (app *App) addHandler(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
 			app.clientError(w, http.StatusBadRequest, err)
+			return
 		}
 		app.td.Form = forms.NewForm(r.PostForm)
-		app.td.Form.FieldRequired("name", "email", "password")
+		app.td.Form.FieldRequired("name", "email", "password", "role")
 		app.td.Form.MaxLength("name", 256)
 		app.td.Form.MaxLength("email", 256)
 		app.td.Form.MatchPattern("email", forms.EmailRX)
 		app.td.Form.MinLength("password", 10)
+		role := app.td.Form.GetField("role")
+		if role != "" && !app.perms.manages(app.role, role) {
+			app.td.Form.Errors.AddError("role", "You cannot add this role")
+		}
 		if !app.td.Form.Valid() {
 			app.render(w, r, signup)
 			return
@@ -132,7 +607,7 @@ func (app *App) addHandler(w http.ResponseWriter, r *http.Request) {
 			app.serverError(w, err)
 			return //note we are not returning any words so we can check for the error
 		}
-		err = broker.InsertXR(app.table, app.nextRole, app.td.Form.GetField("name"),
+		err = broker.InsertXR(app.table, role, app.td.Form.GetField("name"),
 			app.td.Form.GetField("email"), string(hashedPassword))
 		if err != nil {
 			if errors.Is(err, broker.ErrDuplicateEmail) {
@@ -143,6 +618,8 @@ func (app *App) addHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		app.audit(r, broker.AuditAdd, 0, app.td.Form.GetField("email"),
+			"role "+role)
 		app.sessionManager.RenewToken(r.Context())
 		app.sessionManager.Put(r.Context(), "flash", "Your signup was successful, pleaselogin")
 		http.Redirect(w, r, app.redirect, http.StatusSeeOther)
@@ -155,7 +632,7 @@ func (app *App) addHandler(w http.ResponseWriter, r *http.Request) {
 
 //======================= Activation (admin or agent) ==========================
 func (app *App) activationHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
@@ -163,29 +640,13 @@ func (app *App) activationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	switch r.Method {
 	case GET:
-		//gwt admins from the admins table with active status as false
-		people, err := broker.GetByStatusR("admins", app.nextRole, !app.td.Active)
-		centerr.InfoLog.Printf("in activation get err %v", err)
+		//get the accounts of the managed roles with the other active status
+		people, err := app.byStatus(app.perms.managed(app.role), !app.td.Active)
 		if err != nil {
-			if errors.Is(err, broker.ErrNoRecord) {
-				app.td.Table = &broker.TableRows{}
-			} else {
-				app.serverError(w, err)
-				return
-			}
-		}
-		// persons := *people
-		if len(people) == 1 { // len(*people) == 1 {
-			// person := *people
-			if len(people[0].HashedPassword) != 60 {
-				app.td.Table = &broker.TableRows{}
-			} else {
-				app.td.setPeople(&people)
-			}
-		} else {
-			app.td.setPeople(&people)
-			// app.td.setTable(people)
+			app.serverError(w, err)
+			return
 		}
+		app.td.setPeople(&people)
 		app.render(w, r, table)
 
 	case POST:
@@ -193,10 +654,10 @@ func (app *App) activationHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			app.clientError(w, http.StatusBadRequest, err)
 		}
-		people, err := broker.GetByStatusR("admins", app.nextRole, !app.td.Active)
+		people, err := app.byStatus(app.perms.managed(app.role), !app.td.Active)
 		if err != nil {
-			centerr.ErrorLog.Printf("Fatal Error %v", err)
 			app.serverError(w, err)
+			return
 		}
 		newPeople := broker.TableRows{}
 		for i, person := range people { //Short because that is how the api responds
@@ -209,10 +670,24 @@ func (app *App) activationHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		err = broker.ActivationR("admins", app.nextRole, &newPeople)
+		err = broker.ActivationR("admins", &newPeople)
 		if err != nil {
 			centerr.InfoLog.Printf("Fatal Error %v", err)
 			app.serverError(w, err)
+			return
+		}
+		event := broker.AuditDeactivate
+		if app.td.Active {
+			event = broker.AuditActivate
+		}
+		for _, person := range newPeople {
+			if !app.td.Active {
+				err = broker.RevokeSessionsR(admins, person.ID, "")
+				if err != nil {
+					centerr.ErrorLog.Printf("revoke sessions of %d: %v", person.ID, err)
+				}
+			}
+			app.audit(r, event, person.ID, person.Email, "role "+person.Role)
 		}
 		// centerr.ErrorLog.Printf("Activation: %v", newPeople)
 		app.sessionManager.RenewToken(r.Context())
@@ -225,7 +700,7 @@ func (app *App) activationHandler(w http.ResponseWriter, r *http.Request) {
 
 //====================== Change Password (Admin or Agent) ======================
 func (app *App) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
@@ -295,6 +770,14 @@ func (app *App) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 			app.render(w, r, home)
 			return
 		}
+		app.audit(r, broker.AuditPassword, person.ID, email, "")
+		//the other sessions of the account may be someone who has the old
+		//password, they are logged out.
+		err = broker.RevokeSessionsR(admins, person.ID,
+			app.sessionManager.GetString(r.Context(), sessionIDKey))
+		if err != nil {
+			centerr.ErrorLog.Printf("revoke sessions of %d: %v", person.ID, err)
+		}
 		//RenewToken is used for security purpose for each state change.
 		app.sessionManager.RenewToken(r.Context())
 		app.sessionManager.Put(r.Context(), "flash", "Your password was changed, pleaselogin")
@@ -310,7 +793,7 @@ func (app *App) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 
 //============================== Agent online ================================
 func (app *App) agentOnlineHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
@@ -337,7 +820,7 @@ func (app *App) agentOnlineHandler(w http.ResponseWriter, r *http.Request) {
 
 //============================== Agent onffline ================================
 func (app *App) agentOfflineHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.pickPath(w, r)
+	app, err := app.pickPath(w, r)
 	if err != nil {
 		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
 		http.NotFound(w, r)
@@ -375,3 +858,1150 @@ func (app *App) agentChatHandler(w http.ResponseWriter, r *http.Request) {
 	centerr.InfoLog.Printf("got answer from the browser %s", value)
 
 }
+
+//============================== Agent presence ================================
+func (app *App) agentPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		presence := r.PostForm.Get("presence")
+		if !broker.ValidPresence(presence) {
+			app.clientError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid presence %q", presence))
+			return
+		}
+		id := app.sessionManager.GetInt(r.Context(), authenticatedUserID)
+		if id == 0 {
+			app.serverError(w, fmt.Errorf("no session id"))
+			return
+		}
+		err = broker.PutPresence(app.table, app.role, id, presence,
+			broker.ReasonChange)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "You are now "+presence)
+		http.Redirect(w, r, app.td.Home, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================== Agent heartbeat ===============================
+//The agent console posts here every heartbeatInterval while the agent is not
+//offline.  See the sweeper in dbmgr.
+func (app *App) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case POST:
+		id := app.sessionManager.GetInt(r.Context(), authenticatedUserID)
+		if id == 0 {
+			app.clientError(w, http.StatusUnauthorized, fmt.Errorf("no session id"))
+			return
+		}
+		err = broker.HeartbeatR(app.table, app.role, id)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================== Agent capacity ================================
+func (app *App) capacityHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	roles := app.perms.agents(app.role)
+	people, err := app.byStatus(roles, true)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.td.Capacities, err = capacities(roles)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.td.setPeople(&people)
+	switch r.Method {
+	case GET:
+		app.render(w, r, capacity)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		for _, c := range app.td.Capacities {
+			app.td.Form.FieldRequired("default-" + c.Role)
+			app.td.Form.IntRange("default-"+c.Role, 1, 50)
+		}
+		for _, person := range people {
+			app.td.Form.IntRange("max"+strconv.Itoa(person.ID), 0, 50)
+		}
+		if !app.td.Form.Valid() {
+			app.render(w, r, capacity)
+			return
+		}
+		newPeople := broker.TableRows{}
+		for _, person := range people {
+			field := app.td.Form.GetField("max" + strconv.Itoa(person.ID))
+			if field == "" {
+				continue
+			}
+			max, _ := strconv.Atoi(field)
+			if max != person.MaxDialogs {
+				person.MaxDialogs = max
+				newPeople = append(newPeople, person)
+			}
+		}
+		if len(newPeople) > 0 {
+			err = broker.CapacityR(app.table, &newPeople)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		for _, c := range app.td.Capacities {
+			def, _ := strconv.Atoi(app.td.Form.GetField("default-" + c.Role))
+			switch {
+			case !c.stored:
+				err = broker.AddRoleCapacityR(c.Role, def)
+			case def != c.Max:
+				err = broker.RoleCapacityR(c.Role, def)
+			}
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		app.sessionManager.Put(r.Context(), "flash", "Agent capacity was updated")
+		http.Redirect(w, r, app.td.Home, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Agent dashboard =================================
+func (app *App) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		roles := app.perms.agents(app.role)
+		people, err := app.byStatus(roles, true)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		caps, err := capacities(roles)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.td.Agents = app.presence.status(people, caps, time.Now().UTC())
+		app.render(w, r, dashboard)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//================= Dispositions and tags (admin) ==============================
+func (app *App) dispositionsHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		err = app.loadCodes(false)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.render(w, r, dispositions)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		switch app.td.Form.GetField("action") {
+		case "addDisposition":
+			app.td.Form.FieldRequired("code", "label")
+			app.td.Form.MaxLength("code", 32)
+			app.td.Form.MaxLength("label", 255)
+			if app.td.Form.Valid() {
+				err = broker.InsertDispositionR(app.td.Form.GetField("code"),
+					app.td.Form.GetField("label"))
+			}
+		case "addTag":
+			app.td.Form.FieldRequired("tag")
+			app.td.Form.MaxLength("tag", 64)
+			if app.td.Form.Valid() {
+				err = broker.InsertTagR(app.td.Form.GetField("tag"))
+			}
+		case "activation":
+			err = app.codeActivation(r)
+		case "require":
+			err = broker.PutSettingR(broker.SettingRequireDisposition,
+				strconv.FormatBool(app.td.Form.GetField("require") != ""))
+		default:
+			app.clientError(w, http.StatusBadRequest, fmt.Errorf("unknown action"))
+			return
+		}
+		if errors.Is(err, broker.ErrDuplicate) {
+			app.td.Form.Errors.AddError("generic", "That code or tag already exists")
+			err = nil
+		}
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		if !app.td.Form.Valid() {
+			err = app.loadCodes(false)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.render(w, r, dispositions)
+			return
+		}
+		http.Redirect(w, r, adminDispositions, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//loadCodes puts the dispositions, tags and the require setting in td.
+func (app *App) loadCodes(activeOnly bool) error {
+	codes, err := broker.GetDispositionsR(activeOnly)
+	if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+		return err
+	}
+	tags, err := broker.GetTagsR(activeOnly)
+	if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+		return err
+	}
+	app.td.Codes = &codes
+	app.td.Tags = &tags
+	app.td.Require, err = broker.GetSettingBoolR(broker.SettingRequireDisposition)
+	return err
+}
+
+//codeActivation flips the active state of the dispositions and tags whose
+//checkboxes (code<id> and tag<id>) were submitted with a different value.
+func (app *App) codeActivation(r *http.Request) error {
+	err := app.loadCodes(false)
+	if err != nil {
+		return err
+	}
+	changed := func(rows *broker.TableRows, prefix string) broker.TableRows {
+		newRows := broker.TableRows{}
+		for _, row := range *rows {
+			active := r.PostForm.Get(prefix+strconv.Itoa(row.ID)) != ""
+			if active != row.Active {
+				row.Active = active
+				newRows = append(newRows, row)
+			}
+		}
+		return newRows
+	}
+	codes := changed(app.td.Codes, "code")
+	if len(codes) > 0 {
+		err = broker.CodeActivationR("dispositions", &codes)
+		if err != nil {
+			return err
+		}
+	}
+	tags := changed(app.td.Tags, "tag")
+	if len(tags) > 0 {
+		return broker.CodeActivationR("tags", &tags)
+	}
+	return nil
+}
+
+//========================== Close dialog (agent) ==============================
+func (app *App) closeDialogHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	id := app.sessionManager.GetInt(r.Context(), authenticatedUserID)
+	if id == 0 {
+		app.serverError(w, fmt.Errorf("no session id"))
+		return
+	}
+	open, err := broker.OpenDialogsR(id)
+	if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+		app.serverError(w, err)
+		return
+	}
+	app.td.setPeople(&open)
+	err = app.loadCodes(true)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	switch r.Method {
+	case GET:
+		app.render(w, r, closeDialog)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		app.td.Form.FieldRequired("dialog")
+		if app.td.Require {
+			app.td.Form.FieldRequired("disposition")
+		}
+		app.td.Form.MaxLength("notes", 1000)
+		if !app.td.Form.Valid() {
+			app.render(w, r, closeDialog)
+			return
+		}
+		dialogID, err := strconv.Atoi(app.td.Form.GetField("dialog"))
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		disposition, _ := strconv.Atoi(app.td.Form.GetField("disposition"))
+		tags := []int{}
+		for _, t := range r.PostForm["tags"] {
+			tag, err := strconv.Atoi(t)
+			if err != nil {
+				app.clientError(w, http.StatusBadRequest, err)
+				return
+			}
+			tags = append(tags, tag)
+		}
+		err = broker.CloseDialogR(dialogID, id, disposition,
+			app.td.Form.GetField("notes"), tags)
+		if err != nil {
+			if errors.Is(err, broker.ErrNoRecord) {
+				app.td.Form.Errors.AddError("generic", "That dialog is not open")
+				app.render(w, r, closeDialog)
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", "The dialog was closed")
+		http.Redirect(w, r, agentClose, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Surveys (admin) =================================
+func (app *App) surveysHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		from, to, err := dateRange(r, time.Now())
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.From = from.Format(dateLayout)
+		app.td.To = to.AddDate(0, 0, -1).Format(dateLayout)
+		app.td.Period = r.URL.Query().Get("period")
+		if app.td.Period == "" {
+			app.td.Period = broker.PeriodWeek
+		}
+		app.td.SurveyOn, err = broker.GetSettingBoolR(broker.SettingSurveyEnabled)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.td.Kind, err = broker.GetSettingR(broker.SettingSurveyKind)
+		if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		app.td.Question, err = broker.GetSettingR(broker.SettingSurveyQuestion)
+		if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		kind := r.URL.Query().Get("kind")
+		if kind == "" {
+			kind = app.td.Kind
+		}
+		stats, err := broker.SurveyStatsR(kind, app.td.Period, from, to)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.td.setPeople(&stats)
+		app.render(w, r, surveys)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		form := forms.NewForm(r.PostForm)
+		form.FieldRequired("kind", "question")
+		form.MaxLength("question", 255)
+		kind := form.GetField("kind")
+		if kind != broker.CSAT && kind != broker.NPS {
+			form.Errors.AddError("kind", "this field is invalid")
+		}
+		if !form.Valid() {
+			app.sessionManager.Put(r.Context(), "flash", "The survey was not saved")
+			http.Redirect(w, r, adminSurveys, http.StatusSeeOther)
+			return
+		}
+		settings := [][]string{
+			{broker.SettingSurveyEnabled, strconv.FormatBool(form.GetField("enabled") != "")},
+			{broker.SettingSurveyKind, kind},
+			{broker.SettingSurveyQuestion, form.GetField("question")},
+		}
+		for _, setting := range settings {
+			err = broker.PutSettingR(setting[0], setting[1])
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		app.sessionManager.Put(r.Context(), "flash", "The survey was saved")
+		http.Redirect(w, r, adminSurveys, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Reports (admin) =================================
+func (app *App) reportsHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		q := r.URL.Query()
+		from, to, err := dateRange(r, time.Now())
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.From = from.Format(dateLayout)
+		app.td.To = to.AddDate(0, 0, -1).Format(dateLayout)
+		app.td.Period = q.Get("period")
+		if app.td.Period == "" {
+			app.td.Period = broker.PeriodDay
+		}
+		volume, err := broker.VolumeReportR(app.td.Period, from, to)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		agents, err := broker.AgentReportR(from, to)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		seconds := func(f float64) string { return strconv.FormatFloat(f, 'f', 0, 64) }
+		percent := func(f float64) string { return strconv.FormatFloat(f, 'f', 1, 64) }
+		switch q.Get("format") {
+		case "volume.csv":
+			rows := [][]string{}
+			for _, v := range volume {
+				rows = append(rows, []string{v.Period, strconv.Itoa(v.Count),
+					seconds(v.Response), seconds(v.Average), percent(v.Score)})
+			}
+			err = writeCSV(w, "volume.csv", []string{"period", "dialogs",
+				"first_response_seconds", "handle_seconds", "abandoned_percent"}, rows)
+		case "agents.csv":
+			rows := [][]string{}
+			for _, a := range agents {
+				rows = append(rows, []string{strconv.Itoa(a.AgentID), a.Name,
+					strconv.Itoa(a.Count), seconds(a.Response), seconds(a.Average),
+					percent(a.Score)})
+			}
+			err = writeCSV(w, "agents.csv", []string{"agent_id", "name", "dialogs",
+				"first_response_seconds", "handle_seconds", "utilisation_percent"}, rows)
+		default:
+			app.td.Volume = &volume
+			app.td.setPeople(&agents)
+			app.render(w, r, reports)
+		}
+		if err != nil {
+			centerr.ErrorLog.Printf("report csv %v", err)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Export (admin) ==================================
+//exportHandler shows the export form, or when the format is given streams the
+//transcripts of a dialog or of a date range as a download (or in the browser
+//with view set, which is how the search page links to a transcript).  The
+//download is still bound by the server's write timeout, exports too large for
+//that are made with "dbmgr export".
+func (app *App) exportHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		q := r.URL.Query()
+		from, to, err := dateRange(r, time.Now())
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		format := q.Get("format")
+		if format == "" {
+			app.td.From = from.Format(dateLayout)
+			app.td.To = to.AddDate(0, 0, -1).Format(dateLayout)
+			app.render(w, r, export)
+			return
+		}
+		f := transcript.Filter{From: from, To: to}
+		if d := q.Get("dialog"); d != "" {
+			f.DialogID, err = strconv.Atoi(d)
+			if err == nil && f.DialogID <= 0 {
+				err = fmt.Errorf("bad dialog %q", d)
+			}
+			if err != nil {
+				app.clientError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		tw, err := transcript.NewWriter(format, w)
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.Header().Set("Content-Type", transcript.ContentType(format))
+		secure.Document(w)
+		if q.Get("view") == "" {
+			w.Header().Set("Content-Disposition",
+				"attachment; filename=transcripts."+format)
+		}
+		app.audit(r, broker.AuditExport, f.DialogID, "", fmt.Sprintf(
+			"format %s, dialog %d, from %s before %s", format, f.DialogID,
+			from.Format(dateLayout), to.Format(dateLayout)))
+		n, err := transcript.Export(transcript.BrokerSource{}, f, tw)
+		if err != nil {
+			//the headers are gone, all that can be done is to log it.
+			centerr.ErrorLog.Printf("export after %d dialogs %v", n, err)
+		}
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Search (admin) ==================================
+func (app *App) searchHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		q, from, to, err := searchQuery(r, time.Now())
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Search = q
+		app.td.From = from.Format(dateLayout)
+		app.td.To = to.AddDate(0, 0, -1).Format(dateLayout)
+		people, err := app.byStatus(app.perms.agents(app.role), true)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.td.setPeople(&people)
+		if q.Text != "" {
+			app.td.Hits, err = search.BrokerSearcher{}.Search(*q, search.MaxHits)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+		}
+		app.render(w, r, searchPage)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Audit (super) ===================================
+func (app *App) auditHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		f, err := auditFilter(r, time.Now())
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Audit, err = broker.AuditLogR(f)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.td.AuditFilter = f
+		app.td.Events = broker.AuditEvents
+		app.td.From = f.From.Format(dateLayout)
+		app.td.To = f.To.AddDate(0, 0, -1).Format(dateLayout)
+		app.render(w, r, auditPage)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//==================== Accounts (admins for super, agents for admin) ===========
+//accountsHandler lists all the accounts of the roles the caller manages (see
+//permissions.manages), or with an id shows one for editing.  The POST op is
+//save (name and email), delete, restore, reset (a temporary password that has
+//to be changed at the next login) or logout (revokes all the sessions of the
+//account).
+func (app *App) accountsHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		if r.URL.Query().Get("id") == "" {
+			people := broker.TableRows{}
+			for _, role := range app.perms.managed(app.role) {
+				accounts, err := broker.GetAllR(app.table, role)
+				if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+					app.serverError(w, err)
+					return
+				}
+				people = append(people, accounts...)
+			}
+			app.td.setPeople(&people)
+			app.render(w, r, accounts)
+			return
+		}
+		person, ok := app.account(w, r, r.URL.Query().Get("id"))
+		if !ok {
+			return
+		}
+		app.td.Form = forms.NewForm(url.Values{"name": {person.Name},
+			"email": {person.Email}})
+		app.render(w, r, account)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		person, ok := app.account(w, r, r.PostForm.Get("id"))
+		if !ok {
+			return
+		}
+		flash := ""
+		switch r.PostForm.Get("op") {
+		case "save":
+			app.td.Form = forms.NewForm(r.PostForm)
+			app.td.Form.FieldRequired("name", "email")
+			app.td.Form.MaxLength("name", 256)
+			app.td.Form.MaxLength("email", 256)
+			app.td.Form.MatchPattern("email", forms.EmailRX)
+			if !app.td.Form.Valid() {
+				app.render(w, r, account)
+				return
+			}
+			name := app.td.Form.GetField("name")
+			email := app.td.Form.GetField("email")
+			err = broker.UpdateAccountR(app.table, person.Role, person.ID, name, email)
+			if errors.Is(err, broker.ErrDuplicateEmail) {
+				app.td.Form.Errors.AddError("email", "Address is already in use")
+				app.render(w, r, account)
+				return
+			}
+			if err == nil {
+				app.audit(r, broker.AuditEdit, person.ID, email,
+					fmt.Sprintf("was %s <%s>", person.Name, person.Email))
+			}
+			flash = "The account was saved"
+		case "delete":
+			err = broker.DeleteAccountR(app.table, person.Role, person.ID, true)
+			if err == nil && app.perms.can(person.Role, broker.PermChat) {
+				err = broker.PutPresence(app.table, person.Role, person.ID, broker.Offline,
+					broker.ReasonDeleted)
+				if err == nil {
+					err = broker.RequeueR(person.ID)
+				}
+			}
+			if err == nil {
+				err = broker.RevokeSessionsR(admins, person.ID, "")
+			}
+			if err == nil {
+				app.audit(r, broker.AuditDelete, person.ID, person.Email, "")
+			}
+			flash = "The account was deleted"
+		case "restore":
+			err = broker.DeleteAccountR(app.table, person.Role, person.ID, false)
+			if err == nil {
+				app.audit(r, broker.AuditRestore, person.ID, person.Email, "")
+			}
+			flash = "The account was restored, activate it to allow logins"
+		case "reset":
+			app.td.TempPass, err = tempPassword()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			hashed, err := bcrypt.GenerateFromPassword([]byte(app.td.TempPass), 12)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			err = broker.ResetPasswordR(app.table, person.Role, person.ID,
+				string(hashed))
+			if err == nil {
+				err = broker.RevokeSessionsR(admins, person.ID, "")
+			}
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditReset, person.ID, person.Email, "")
+			//rendered rather than redirected so the password never goes into
+			//the session.
+			person.MustReset = true
+			app.td.Form = forms.NewForm(url.Values{"name": {person.Name},
+				"email": {person.Email}})
+			app.td.Sessions = &broker.TableRows{}
+			app.render(w, r, account)
+			return
+		case "logout":
+			err = broker.RevokeSessionsR(admins, person.ID, "")
+			if err == nil {
+				app.audit(r, broker.AuditForceLogout, person.ID, person.Email, "")
+			}
+			flash = "All the sessions of the account were logged out"
+		case "unlock":
+			err = broker.UnlockR(app.table, person.Email)
+			if err == nil {
+				app.audit(r, broker.AuditUnlock, person.ID, person.Email, "")
+			}
+			flash = "The account was unlocked"
+		case "resetTOTP":
+			err = broker.ResetTOTPR(app.table, person.ID)
+			if err == nil {
+				app.audit(r, broker.Audit2FAReset, person.ID, person.Email, "")
+			}
+			flash = "Two-factor login was reset, the account has to enroll again"
+		default:
+			app.clientError(w, http.StatusBadRequest,
+				fmt.Errorf("unknown account op %q", r.PostForm.Get("op")))
+			return
+		}
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, r.URL.Path+"?id="+strconv.Itoa(person.ID),
+			http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//account gets the account with the id for the accounts page.  Accounts of
+//roles the caller does not manage are not found, so an admin cannot edit
+//another admin.
+func (app *App) account(w http.ResponseWriter, r *http.Request,
+	id string) (*broker.TableRow, bool) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	person, err := broker.GetXR(app.table, n)
+	if errors.Is(err, broker.ErrNoRecord) || (err == nil && !app.perms.manages(app.role, person.Role)) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return nil, false
+	}
+	app.td.Person = person
+	app.td.LockedUntil, err = broker.LoginCheckR(app.table, person.Email, "")
+	if err != nil {
+		app.serverError(w, err)
+		return nil, false
+	}
+	sessions, err := broker.SessionsR(admins, person.ID, "")
+	if err != nil {
+		app.serverError(w, err)
+		return nil, false
+	}
+	app.td.Sessions = &sessions
+	return person, true
+}
+
+//============================ Users (admin) ===================================
+//usersHandler searches the end users, or with an id shows one with the
+//dialogs.  The POST op is deactivate (which also ends the user's open
+//dialogs and sessions), activate, reset (a temporary password) or logout.
+func (app *App) usersHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		if r.URL.Query().Get("id") == "" {
+			app.td.Find = strings.TrimSpace(r.URL.Query().Get("q"))
+			people, err := broker.FindUsersR(app.td.Find)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.td.setPeople(&people)
+			app.render(w, r, usersPage)
+			return
+		}
+		if app.endUser(w, r, r.URL.Query().Get("id")) == nil {
+			return
+		}
+		app.render(w, r, userPage)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		person := app.endUser(w, r, r.PostForm.Get("id"))
+		if person == nil {
+			return
+		}
+		flash := ""
+		switch r.PostForm.Get("op") {
+		case "deactivate":
+			ended, err := broker.UserActiveR(person.ID, false)
+			if err == nil {
+				err = broker.RevokeSessionsR("users", person.ID, "")
+			}
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditDeactivate, person.ID, person.Email,
+				fmt.Sprintf("end user, %d open dialogs ended", ended))
+			flash = fmt.Sprintf("The user was deactivated, %d open dialogs ended", ended)
+		case "unlock":
+			err = broker.UnlockR("users", person.Email)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditUnlock, person.ID, person.Email, "end user")
+			flash = "The user was unlocked"
+		case "activate":
+			_, err = broker.UserActiveR(person.ID, true)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditActivate, person.ID, person.Email, "end user")
+			flash = "The user was reactivated"
+		case "reset":
+			app.td.TempPass, err = tempPassword()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			hashed, err := bcrypt.GenerateFromPassword([]byte(app.td.TempPass), 12)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			err = broker.ResetUserPasswordR(person.ID, string(hashed))
+			if err == nil {
+				err = broker.RevokeSessionsR("users", person.ID, "")
+			}
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditReset, person.ID, person.Email, "end user")
+			person.MustReset = true
+			app.td.Sessions = &broker.TableRows{}
+			app.render(w, r, userPage)
+			return
+		case "logout":
+			err = broker.RevokeSessionsR("users", person.ID, "")
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditForceLogout, person.ID, person.Email, "end user")
+			flash = "All the sessions of the user were logged out"
+		default:
+			app.clientError(w, http.StatusBadRequest,
+				fmt.Errorf("unknown user op %q", r.PostForm.Get("op")))
+			return
+		}
+		app.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, adminUsers+"?id="+strconv.Itoa(person.ID),
+			http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//endUser gets the end user with the id and the user's dialogs for the users
+//page, nil if the page cannot be shown (the error is already written).
+func (app *App) endUser(w http.ResponseWriter, r *http.Request,
+	id string) *broker.TableRow {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return nil
+	}
+	person, err := broker.GetEUR("users", n)
+	if errors.Is(err, broker.ErrNoRecord) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return nil
+	}
+	dialogs, err := broker.UserDialogsR(n)
+	if err != nil {
+		app.serverError(w, err)
+		return nil
+	}
+	app.td.Person = person
+	app.td.Dialogs = &dialogs
+	app.td.LockedUntil, err = broker.LoginCheckR("users", person.Email, "")
+	if err != nil {
+		app.serverError(w, err)
+		return nil
+	}
+	sessions, err := broker.SessionsR("users", person.ID, "")
+	if err != nil {
+		app.serverError(w, err)
+		return nil
+	}
+	app.td.Sessions = &sessions
+	return person
+}
+
+//=========================== Forgot Password =================================
+//forgotHandler mails a password reset link to an active account of the role.
+//The answer is the same whether or not there is such an account so the page
+//cannot be used to find out the addresses.
+func (app *App) forgotHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		app.render(w, r, forgot)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		app.td.Form.FieldRequired("email")
+		app.td.Form.MaxLength("email", 255)
+		app.td.Form.MatchPattern("email", forms.EmailRX)
+		if !app.td.Form.Valid() {
+			app.render(w, r, forgot)
+			return
+		}
+		email := app.td.Form.GetField("email")
+		person, err := app.authenticateConsole(email)
+		switch {
+		case errors.Is(err, broker.ErrNoRecord):
+			app.audit(r, broker.AuditForgot, 0, email, "no such account")
+		case err != nil:
+			app.serverError(w, err)
+			return
+		case !person.Active:
+			app.audit(r, broker.AuditForgot, person.ID, email, "inactive")
+		default:
+			err = app.mailReset(person, app.td.Reset)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.audit(r, broker.AuditForgot, person.ID, email, "link mailed")
+		}
+		app.sessionManager.Put(r.Context(), "flash",
+			"If the address has an account, a link to reset the password was mailed to it")
+		http.Redirect(w, r, app.td.Login, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//mailReset records a new reset token for the person and mails the link to
+//the reset page at path.  The mail is sent in the background so a slow mail
+//server does not hold up (or time) the answer.
+func (app *App) mailReset(person *broker.TableRow, path string) error {
+	token, hash, err := broker.NewToken()
+	if err != nil {
+		return err
+	}
+	err = broker.CreateResetR(app.table, person.ID, hash,
+		time.Now().Add(broker.ResetTTL))
+	if err != nil {
+		return err
+	}
+	body := mailer.ResetBody(person.Name, app.baseURL+path+"?token="+token,
+		broker.ResetTTL)
+	go func() {
+		err := app.mailer.Send(person.Email, "Password reset", body)
+		if err != nil {
+			centerr.ErrorLog.Printf("reset mail to %s %v", person.Email, err)
+		}
+	}()
+	return nil
+}
+
+//resetHandler sets a new password with the token of a mailed reset link.
+func (app *App) resetHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := app.pickPath(w, r)
+	if err != nil {
+		centerr.ErrorLog.Printf("bad path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case GET:
+		app.td.Token = r.URL.Query().Get("token")
+		if app.td.Token == "" {
+			http.Redirect(w, r, app.td.Forgot, http.StatusSeeOther)
+			return
+		}
+		app.render(w, r, reset)
+	case POST:
+		err := r.ParseForm()
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		app.td.Form = forms.NewForm(r.PostForm)
+		app.td.Token = app.td.Form.GetField("token")
+		app.td.Form.FieldRequired("token", "password")
+		app.td.Form.MinLength("password", 10)
+		if !app.td.Form.Valid() {
+			app.render(w, r, reset)
+			return
+		}
+		hashed, err := bcrypt.GenerateFromPassword(
+			[]byte(app.td.Form.GetField("password")), 12)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		person, err := broker.UseResetR(app.table,
+			broker.HashToken(app.td.Token), string(hashed))
+		if errors.Is(err, broker.ErrNoRecord) {
+			app.td.Form.Errors.AddError("generic",
+				"The link is not valid or has expired, please ask for a new one")
+			app.render(w, r, reset)
+			return
+		}
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		err = broker.RevokeSessionsR(admins, person.ID, "")
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.audit(r, broker.AuditPassword, person.ID, person.Email, "reset link")
+		app.sessionManager.RenewToken(r.Context())
+		app.sessionManager.Put(r.Context(), "flash",
+			"Your password was reset, please log in")
+		http.Redirect(w, r, app.td.Login, http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
@@ -1,5 +1,22 @@
 package main
 
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/saied74/toychat/pkg/broker"
+)
+
 // func TestHomeHanlder(t *testing.T) {
 // 	r := httptest.NewRequest("GET", "/super/home", nil)
 // 	w := httptest.NewRecorder()
@@ -13,3 +30,140 @@ package main
 // 	app.homeHandler(w, r)
 // 	t.Errorf("see what we get %v", w)
 // }
+
+//the test templates are the real ones, read from the source tree.
+func testTemplateCache(t *testing.T) map[string]*template.Template {
+	files := tmData{}
+	for name, list := range allTmplFiles {
+		for _, file := range list {
+			files[name] = append(files[name],
+				filepath.Join("..", "backendviews", filepath.Base(file)))
+		}
+	}
+	return newTemplateCache(files)
+}
+
+//mixed role requests served at the same time must each get their own role's
+//page; run with -race to also catch shared template data.
+func TestConcurrentRoles(t *testing.T) {
+	app := newTestApp(t)
+	app.sessionManager = scs.New()
+	app.cache = testTemplateCache(t)
+	mux := app.sessionManager.LoadAndSave(app.routes())
+
+	roles := []struct {
+		path  string
+		scope string
+	}{
+		{superLogin, "Super User"},
+		{adminLogin, "Admin User"},
+		{agentLogin, "Agent"},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		for _, role := range roles {
+			wg.Add(1)
+			go func(path, scope string) {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				page := w.Body.String()
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: status %d", path, w.Code)
+				}
+				if !strings.Contains(page, `action="`+path+`"`) {
+					t.Errorf("%s: page has another role's login form", path)
+				}
+				if !strings.Contains(page, "Toy Chat Project - "+scope+"<") {
+					t.Errorf("%s: page has another role's scope", path)
+				}
+			}(role.path, role.scope)
+		}
+	}
+	wg.Wait()
+}
+
+//logged in accounts of mixed roles posting forms with errors at the same time
+//must each get their own role's page, form errors and role list back; run
+//with -race to also catch shared template data.
+func TestConcurrentForms(t *testing.T) {
+	app := newTestApp(t)
+	app.sessionManager = scs.New()
+	app.cache = testTemplateCache(t)
+	app.perms = &permissions{ttl: time.Hour, load: func() (
+		map[string]*broker.RoleGrant, error) {
+		return testRoles(), nil
+	}}
+	names := map[int]string{1: "Super Sam", 2: "Admin Ann", 3: "Agent Al"}
+	getUser = func(table string, id int) (*broker.TableRow, error) {
+		return &broker.TableRow{ID: id, Name: names[id]}, nil
+	}
+	defer func() { getUser = broker.GetXR }()
+	routes := app.routes()
+	//what authenticate does for a logged in account.
+	mux := app.sessionManager.LoadAndSave(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id, _ := strconv.Atoi(r.Header.Get("X-Test-ID"))
+			app.sessionManager.Put(r.Context(), authenticatedUserID, id)
+			ctx := context.WithValue(r.Context(), contextKeyIsAuthenticated, true)
+			ctx = context.WithValue(ctx, contextKeyRole, r.Header.Get("X-Test-Role"))
+			routes.ServeHTTP(w, r.WithContext(ctx))
+		}))
+
+	posts := []struct {
+		id     int
+		role   string
+		path   string
+		form   url.Values
+		want   []string
+		unwant []string
+	}{
+		{1, "superadmin", addAdmin, url.Values{"name": {"Ann"},
+			"email": {"ann@example.com"}, "role": {admin}, "password": {"short"}},
+			[]string{"Welcome Super Sam", "too short", `<option value="admin">`,
+				`<option value="auditor">`},
+			[]string{"You cannot add", "cannot be blank", `<option value="agent">`}},
+		{2, admin, addAgent, url.Values{"name": {"Al"}, "email": {"al@example.com"},
+			"role": {"superadmin"}, "password": {"long enough password"}},
+			[]string{"Welcome Admin Ann", "You cannot add this role",
+				`<option value="agent">`},
+			[]string{"too short", "cannot be blank", `<option value="admin">`}},
+		{3, agent, agentChgPwd, url.Values{"email": {"al@example.com"},
+			"passwordNew": {"long enough password"}},
+			[]string{"Welcome Agent Al", "cannot be blank"},
+			[]string{"too short", "You cannot add", `<option value="admin">`,
+				`<option value="agent">`}},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		for _, p := range posts {
+			wg.Add(1)
+			go func(id int, role, path string, form url.Values, want,
+				unwant []string) {
+				defer wg.Done()
+				r := httptest.NewRequest("POST", path,
+					strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.Header.Set("X-Test-ID", strconv.Itoa(id))
+				r.Header.Set("X-Test-Role", role)
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				page := w.Body.String()
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: status %d", path, w.Code)
+				}
+				for _, s := range want {
+					if !strings.Contains(page, s) {
+						t.Errorf("%s: page without %q", path, s)
+					}
+				}
+				for _, s := range unwant {
+					if strings.Contains(page, s) {
+						t.Errorf("%s: page has another role's %q", path, s)
+					}
+				}
+			}(p.id, p.role, p.path, p.form, p.want, p.unwant)
+		}
+	}
+	wg.Wait()
+}
@@ -2,21 +2,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/justinas/nosurf"
-	nats "github.com/nats-io/nats.go"
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
 	"github.com/saied74/toychat/pkg/forms"
+	"github.com/saied74/toychat/pkg/search"
+	"github.com/saied74/toychat/pkg/secure"
+	"github.com/saied74/toychat/pkg/throttle"
 )
 
 var getToken = nosurf.Token
@@ -40,12 +48,19 @@ func (app *App) clientError(w http.ResponseWriter, status int, err error) {
 	http.Error(w, http.StatusText(status), status)
 }
 
-func (app *App) pickPath(w http.ResponseWriter, r *http.Request) error {
+//pickPath returns the App the request is served with: a copy of the shared App
+//carrying the role context of the path (table, role, links) and its own
+//template data.  Nothing request specific is ever written to the shared App,
+//so concurrent requests for different roles can not see each other's data.
+func (app *App) pickPath(w http.ResponseWriter, r *http.Request) (*App, error) {
+	rq := *app
+	app = &rq
 	app.initTD()
 	path := strings.Split(r.URL.Path, "/")
 	if len(path) < 3 {
-		return fmt.Errorf("bad path %s, short string", r.URL.Path)
+		return nil, fmt.Errorf("bad path %s, short string", r.URL.Path)
 	}
+	app.console = path[1]
 	switch path[1] {
 	case "super":
 		app.buildSuper()
@@ -70,27 +85,45 @@ func (app *App) pickPath(w http.ResponseWriter, r *http.Request) error {
 	case agent:
 		app.buildAgent()
 	default:
-		return fmt.Errorf("bad path %s", r.URL.Path)
+		return nil, fmt.Errorf("bad path %s", r.URL.Path)
 	}
 	if strings.HasPrefix(path[2], "add") {
 		app.td.Msg = addMsg
 	}
-	return nil
+	//the role of the console is the default, a logged in account has its own.
+	if role, ok := r.Context().Value(contextKeyRole).(string); ok {
+		app.role = role
+		app.td.Can = app.perms.grants(role)
+	}
+	return app, nil
 }
 
 func (app *App) buildSuper() {
 	app.table = admins
 	app.role = "superadmin"
-	app.nextRole = admin
 	app.redirect = superHome
 	app.td.Scope = "Super User"
 	app.td.Home = superHome
 	app.td.Login = superLogin
 	app.td.Logout = superLogout
-	app.td.ChgPwd = ""
+	app.td.ChgPwd = superChgPwd
+	app.td.Forgot = superForgot
+	app.td.Reset = superReset
+	app.td.TwoFactor = superTwoFactor
+	app.td.OTP = superOTP
+	app.td.MySessions = superSessions
 	app.td.SideLink1 = addAdmin
 	app.td.SideLink2 = activateAdmin
 	app.td.SideLink3 = deactivateAdmin
+	app.td.SideLink4 = superAudit
+	app.td.SideLink5 = ""
+	app.td.SideLink6 = ""
+	app.td.SideLink7 = ""
+	app.td.SideLink8 = ""
+	app.td.SideLink9 = ""
+	app.td.SideLink10 = ""
+	app.td.SideLink11 = superAccounts
+	app.td.SideLink12 = ""
 	app.td.Super = true
 	app.td.Admin = false
 	app.td.Agent = false
@@ -100,16 +133,29 @@ func (app *App) buildSuper() {
 func (app *App) buildAdmin() {
 	app.table = admins
 	app.role = admin
-	app.nextRole = agent
 	app.redirect = adminHome
 	app.td.Scope = "Admin User"
 	app.td.Home = adminHome
 	app.td.Login = adminLogin
 	app.td.Logout = adminLogout
 	app.td.ChgPwd = adminChgPwd
+	app.td.Forgot = adminForgot
+	app.td.Reset = adminReset
+	app.td.TwoFactor = adminTwoFactor
+	app.td.OTP = adminOTP
+	app.td.MySessions = adminSessions
 	app.td.SideLink1 = addAgent
 	app.td.SideLink2 = activateAgent
 	app.td.SideLink3 = deactivateAgent
+	app.td.SideLink4 = agentCapacity
+	app.td.SideLink5 = agentDashboard
+	app.td.SideLink6 = adminDispositions
+	app.td.SideLink7 = adminSurveys
+	app.td.SideLink8 = adminReports
+	app.td.SideLink9 = adminExport
+	app.td.SideLink10 = adminSearch
+	app.td.SideLink11 = adminAccounts
+	app.td.SideLink12 = adminUsers
 	app.td.Super = false
 	app.td.Admin = true
 	app.td.Agent = false
@@ -119,22 +165,83 @@ func (app *App) buildAdmin() {
 func (app *App) buildAgent() {
 	app.table = admins
 	app.role = agent
-	app.nextRole = ""
 	app.redirect = agentHome
 	app.td.Scope = "Agent"
 	app.td.Home = agentHome
 	app.td.Login = agentLogin
 	app.td.Logout = agentLogout
 	app.td.ChgPwd = agentChgPwd
+	app.td.Forgot = agentForgot
+	app.td.Reset = agentReset
+	app.td.TwoFactor = agentTwoFactor
+	app.td.OTP = agentOTP
+	app.td.MySessions = agentSessions
 	app.td.SideLink1 = agentOnline
 	app.td.SideLink2 = agentOffline
-	app.td.SideLink3 = ""
+	app.td.SideLink3 = agentPresence
+	app.td.SideLink4 = ""
+	app.td.SideLink5 = ""
+	app.td.SideLink6 = agentClose
+	app.td.SideLink7 = ""
+	app.td.SideLink8 = ""
+	app.td.SideLink9 = ""
+	app.td.SideLink10 = ""
+	app.td.SideLink11 = ""
+	app.td.SideLink12 = ""
+	app.td.Presences = broker.PresenceStates
+	app.td.Heartbeat = agentHeartbeat
+	app.td.HBSeconds = heartbeatInterval
 	app.td.Super = false
 	app.td.Admin = false
 	app.td.Agent = true
 	app.td.Msg = loginMsg
 }
 
+//dateRange reads the from and to (yyyy-mm-dd) query parameters of the report
+//pages.  The range defaults to the last defaultRangeDays days and the
+//returned end is exclusive (the day after to).
+func dateRange(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	to = today.AddDate(0, 0, 1)
+	from = to.AddDate(0, 0, -defaultRangeDays)
+	q := r.URL.Query()
+	if f := q.Get("from"); f != "" {
+		from, err = time.Parse(dateLayout, f)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if t := q.Get("to"); t != "" {
+		to, err = time.Parse(dateLayout, t)
+		if err != nil {
+			return from, to, err
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from %s is after to %s", q.Get("from"),
+			q.Get("to"))
+	}
+	return from, to, nil
+}
+
+//writeCSV sends the rows as a csv file download with the header as the first row.
+func writeCSV(w http.ResponseWriter, filename string, header []string,
+	rows [][]string) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	cw := csv.NewWriter(w)
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+	err = cw.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
 func (app *App) initTD() {
 	app.td = &templateData{
 		Form: &forms.FormData{
@@ -212,8 +319,11 @@ func addDefaultData(td *templateData, r *http.Request,
 			return nil, err
 		}
 		td.UserName = string(usr.Name)
+		td.Presence = usr.Presence
+		td.Online = usr.Online
 	}
 	td.CSRFToken = getToken(r) //nosurf.Token(r)
+	td.Nonce = secure.Nonce(r)
 	return td, nil
 }
 
@@ -241,12 +351,13 @@ func (app *App) render(w http.ResponseWriter, r *http.Request, name string) {
 func (app *App) chatConnection(matValue, forCM, fromCM string) []byte {
 	var err error
 
-	nc1, err := nats.Connect(nats.DefaultURL)
+	nc1, err := broker.Connect()
 	if err != nil {
 		centerr.ErrorLog.Printf("in chatConnection connecting error %v", err)
+		return []byte{}
 	}
 	defer nc1.Close()
-	msg, err := nc1.Request(forCM, []byte(matValue), 2*time.Second)
+	msg, err := broker.Request(nc1, forCM, []byte(matValue), 2*time.Second)
 	if err != nil {
 		centerr.ErrorLog.Printf("in chatConnection %s request did not complete %v",
 			forCM, err)
@@ -254,3 +365,163 @@ func (app *App) chatConnection(matValue, forCM, fromCM string) []byte {
 	}
 	return msg.Data
 }
+
+//searchQuery reads the search page's query parameters: q (the words), agent,
+//user, state and the date range as in dateRange.
+func searchQuery(r *http.Request, now time.Time) (*search.Query, time.Time,
+	time.Time, error) {
+	v := r.URL.Query()
+	from, to, err := dateRange(r, now)
+	if err != nil {
+		return nil, from, to, err
+	}
+	q := &search.Query{Text: strings.TrimSpace(v.Get("q")),
+		User: strings.TrimSpace(v.Get("user")), State: v.Get("state"),
+		From: from, To: to}
+	if a := v.Get("agent"); a != "" {
+		q.AgentID, err = strconv.Atoi(a)
+		if err != nil {
+			return nil, from, to, fmt.Errorf("bad agent %q", a)
+		}
+	}
+	if !search.ValidState(q.State) {
+		return nil, from, to, fmt.Errorf("bad dialog state %q", q.State)
+	}
+	return q, from, to, nil
+}
+
+//audit records an event done by the logged in user, or by nobody yet for a
+//failed login.  A failure to record is logged but does not fail the request.
+func (app *App) audit(r *http.Request, event string, targetID int, target,
+	detail string) {
+	err := broker.AuditR(&broker.AuditEvent{
+		Event:     event,
+		ActorID:   app.sessionManager.GetInt(r.Context(), authenticatedUserID),
+		ActorRole: app.role,
+		TargetID:  targetID,
+		Target:    target,
+		IP:        clientIP(r),
+		Detail:    detail,
+	})
+	if err != nil {
+		centerr.ErrorLog.Printf("audit %s %v", event, err)
+	}
+}
+
+//loginLocked reports whether the account (email) or the address of a login
+//attempt is locked by the throttling, auditing the refused attempt.
+func (app *App) loginLocked(r *http.Request, email string) (bool, error) {
+	until, err := broker.LoginCheckR(app.table, email, clientIP(r))
+	if err != nil || until.IsZero() {
+		return false, err
+	}
+	app.audit(r, broker.AuditLoginFailed, 0, email,
+		"locked until "+until.Format(time.RFC3339))
+	return true, nil
+}
+
+//loginFailed audits a failed login and counts it for the throttling, auditing
+//the lock when it is one too many.
+func (app *App) loginFailed(r *http.Request, id int, email, detail string) {
+	app.audit(r, broker.AuditLoginFailed, id, email, detail)
+	kind, until, err := broker.LoginFailedR(app.table, email, clientIP(r))
+	if err != nil {
+		centerr.ErrorLog.Printf("login failure count %v", err)
+		return
+	}
+	if kind == "" {
+		return
+	}
+	target := email
+	if kind == throttle.IP {
+		target = clientIP(r)
+	}
+	app.audit(r, broker.AuditLockout, id, target,
+		kind+" locked until "+until.Format(time.RFC3339))
+}
+
+//clientIP is the address of the client without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//auditFilter reads the audit page's query parameters: event, actor, target
+//and the date range as in dateRange.
+func auditFilter(r *http.Request, now time.Time) (*broker.AuditFilter, error) {
+	v := r.URL.Query()
+	from, to, err := dateRange(r, now)
+	if err != nil {
+		return nil, err
+	}
+	f := &broker.AuditFilter{Event: v.Get("event"),
+		Actor:  strings.TrimSpace(v.Get("actor")),
+		Target: strings.TrimSpace(v.Get("target")), From: from, To: to}
+	if f.Event != "" {
+		known := false
+		for _, e := range broker.AuditEvents {
+			known = known || e == f.Event
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown audit event %q", f.Event)
+		}
+	}
+	return f, nil
+}
+
+//tempPassword is a random password for a forced reset, 16 url safe
+//characters.
+func tempPassword() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//roleCapacity is the default maximum number of dialogs of a role.
+type roleCapacity struct {
+	Role   string
+	Max    int
+	stored bool //role_defaults has a row for the role
+}
+
+//byStatus returns the active or inactive accounts of the roles, without the
+//rows that are not a whole account (no id or password hash).
+func (app *App) byStatus(roles []string, active bool) (broker.TableRows, error) {
+	people := broker.TableRows{}
+	for _, role := range roles {
+		accounts, err := broker.GetByStatusR(app.table, role, active)
+		if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+			return nil, err
+		}
+		for _, account := range accounts {
+			if account.ID != 0 && len(account.HashedPassword) == 60 {
+				people = append(people, account)
+			}
+		}
+	}
+	return people, nil
+}
+
+//capacities returns the default maximum dialogs of the roles from
+//role_defaults, defaultCapacity for a role without a row.
+func capacities(roles []string) ([]roleCapacity, error) {
+	caps := []roleCapacity{}
+	for _, role := range roles {
+		max, err := broker.GetRoleCapacityR(role)
+		stored := err == nil
+		if errors.Is(err, broker.ErrNoRecord) {
+			max, err = defaultCapacity, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		caps = append(caps, roleCapacity{Role: role, Max: max, stored: stored})
+	}
+	return caps, nil
+}
@@ -12,70 +12,110 @@ import (
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/search"
 )
 
 var testSupertd = templateData{
-	Scope:     "Super User",
-	Home:      "/super/home",
-	Login:     "/super/login",
-	Logout:    "/super/logout",
-	ChgPwd:    "",
-	SideLink1: "/super/addAdmin",
-	SideLink2: "/super/activateAdmin",
-	SideLink3: "/super/deactivateAdmin",
-	Super:     true,
-	Admin:     false,
-	Agent:     false,
-	Msg:       "Please log in",
+	Scope:      "Super User",
+	Home:       "/super/home",
+	Login:      "/super/login",
+	Logout:     "/super/logout",
+	ChgPwd:     "/super/changePassword",
+	Forgot:     "/super/forgot",
+	Reset:      "/super/reset",
+	TwoFactor:  "/super/twofactor",
+	OTP:        "/super/otp",
+	MySessions: "/super/sessions",
+	SideLink1:  "/super/addAdmin",
+	SideLink2:  "/super/activateAdmin",
+	SideLink3:  "/super/deactivateAdmin",
+	SideLink4:  "/super/audit",
+	SideLink5:  "",
+	SideLink6:  "",
+	SideLink7:  "",
+	SideLink8:  "",
+	SideLink9:  "",
+	SideLink10: "",
+	SideLink11: "/super/accounts",
+	SideLink12: "",
+	Super:      true,
+	Admin:      false,
+	Agent:      false,
+	Msg:        "Please log in",
 }
 var testSuperapp = App{
 	table:    "admins",
 	role:     "superadmin",
-	nextRole: "admin",
 	redirect: "/super/home",
 	td:       &testSupertd,
 }
 
 var testAdmintd = templateData{
-	Scope:     "Admin User",
-	Home:      "/admin/home",
-	Login:     "/admin/login",
-	Logout:    "/admin/logout",
-	ChgPwd:    "/admin/changePassword",
-	SideLink1: "/admin/addAgent",
-	SideLink2: "/admin/activateAgent",
-	SideLink3: "/admin/deactivateAgent",
-	Super:     false,
-	Admin:     true,
-	Agent:     false,
-	Msg:       "Please log in",
+	Scope:      "Admin User",
+	Home:       "/admin/home",
+	Login:      "/admin/login",
+	Logout:     "/admin/logout",
+	ChgPwd:     "/admin/changePassword",
+	Forgot:     "/admin/forgot",
+	Reset:      "/admin/reset",
+	TwoFactor:  "/admin/twofactor",
+	OTP:        "/admin/otp",
+	MySessions: "/admin/sessions",
+	SideLink1:  "/admin/addAgent",
+	SideLink2:  "/admin/activateAgent",
+	SideLink3:  "/admin/deactivateAgent",
+	SideLink4:  "/admin/capacity",
+	SideLink5:  "/admin/dashboard",
+	SideLink6:  "/admin/dispositions",
+	SideLink7:  "/admin/surveys",
+	SideLink8:  "/admin/reports",
+	SideLink9:  "/admin/export",
+	SideLink10: "/admin/search",
+	SideLink11: "/admin/accounts",
+	SideLink12: "/admin/users",
+	Super:      false,
+	Admin:      true,
+	Agent:      false,
+	Msg:        "Please log in",
 }
 var testAdminapp = App{
 	table:    "admins",
 	role:     "admin",
-	nextRole: "agent",
 	redirect: "/admin/home",
 	td:       &testAdmintd,
 }
 
 var testAgenttd = templateData{
-	Scope:     "Agent",
-	Home:      "/agent/home",
-	Login:     "/agent/login",
-	Logout:    "/agent/logout",
-	ChgPwd:    "/agent/changePassword",
-	SideLink1: "/agent/online",
-	SideLink2: "/agent/offline",
-	SideLink3: "",
-	Super:     false,
-	Admin:     false,
-	Agent:     true,
-	Msg:       "Please log in",
+	Scope:      "Agent",
+	Home:       "/agent/home",
+	Login:      "/agent/login",
+	Logout:     "/agent/logout",
+	ChgPwd:     "/agent/changePassword",
+	Forgot:     "/agent/forgot",
+	Reset:      "/agent/reset",
+	TwoFactor:  "/agent/twofactor",
+	OTP:        "/agent/otp",
+	MySessions: "/agent/sessions",
+	SideLink1:  "/agent/online",
+	SideLink2:  "/agent/offline",
+	SideLink3:  "/agent/presence",
+	SideLink4:  "",
+	SideLink5:  "",
+	SideLink6:  "/agent/close",
+	SideLink7:  "",
+	SideLink8:  "",
+	SideLink9:  "",
+	SideLink10: "",
+	SideLink11: "",
+	SideLink12: "",
+	Super:      false,
+	Admin:      false,
+	Agent:      true,
+	Msg:        "Please log in",
 }
 var testAgentapp = App{
 	table:    "admins",
 	role:     "agent",
-	nextRole: "",
 	redirect: "/agent/home",
 	td:       &testAgenttd,
 }
@@ -87,9 +127,6 @@ func (app *App) appCompare(testApp *App) bool {
 	if app.role != testApp.role {
 		return false
 	}
-	if app.nextRole != testApp.nextRole {
-		return false
-	}
 	if app.redirect != testApp.redirect {
 		return false
 	}
@@ -108,6 +145,21 @@ func (app *App) appCompare(testApp *App) bool {
 	if app.td.ChgPwd != testApp.td.ChgPwd {
 		return false
 	}
+	if app.td.Forgot != testApp.td.Forgot {
+		return false
+	}
+	if app.td.Reset != testApp.td.Reset {
+		return false
+	}
+	if app.td.TwoFactor != testApp.td.TwoFactor {
+		return false
+	}
+	if app.td.OTP != testApp.td.OTP {
+		return false
+	}
+	if app.td.MySessions != testApp.td.MySessions {
+		return false
+	}
 	if app.td.SideLink1 != testApp.td.SideLink1 {
 		return false
 	}
@@ -117,6 +169,36 @@ func (app *App) appCompare(testApp *App) bool {
 	if app.td.SideLink3 != testApp.td.SideLink3 {
 		return false
 	}
+	if app.td.SideLink4 != testApp.td.SideLink4 {
+		return false
+	}
+	if app.td.SideLink5 != testApp.td.SideLink5 {
+		return false
+	}
+	if app.td.SideLink4 != testApp.td.SideLink4 {
+		return false
+	}
+	if app.td.SideLink6 != testApp.td.SideLink6 {
+		return false
+	}
+	if app.td.SideLink7 != testApp.td.SideLink7 {
+		return false
+	}
+	if app.td.SideLink8 != testApp.td.SideLink8 {
+		return false
+	}
+	if app.td.SideLink9 != testApp.td.SideLink9 {
+		return false
+	}
+	if app.td.SideLink10 != testApp.td.SideLink10 {
+		return false
+	}
+	if app.td.SideLink11 != testApp.td.SideLink11 {
+		return false
+	}
+	if app.td.SideLink12 != testApp.td.SideLink12 {
+		return false
+	}
 	if app.td.Super != testApp.td.Super {
 		return false
 	}
@@ -177,13 +259,20 @@ func TestPickPath(t *testing.T) {
 	var app = App{
 		td: &templateData{},
 	}
-	var err error
 	var urlList = []string{"/super/home", "/super/login", "/super/logout",
 		"/super/addAdmin", "/super/activateAdmin", "/super/deactivateAdmin",
 		"/admin/home", "/admin/login", "/admin/logout", "/admin/changePassword",
 		"/admin/addAgent", "/admin/activateAgent", "/admin/deactivateAgent",
 		"/agent/home", "/agent/login", "/agent/logout", "/agent/changePassword",
-		"/agent/online", "/agent/offline"}
+		"/agent/online", "/agent/offline", "/agent/presence", "/admin/capacity",
+		"/admin/dashboard", "/admin/dispositions", "/agent/close",
+		"/admin/surveys", "/admin/reports", "/admin/export",
+		"/admin/search", "/super/audit",
+		"/super/changePassword", "/super/accounts", "/admin/accounts",
+		"/admin/users", "/super/forgot", "/super/reset", "/admin/forgot",
+		"/admin/reset", "/agent/forgot", "/agent/reset", "/super/twofactor",
+		"/super/otp", "/admin/twofactor", "/admin/otp", "/agent/twofactor",
+		"/agent/otp", "/super/sessions", "/admin/sessions", "/agent/sessions"}
 
 	w := httptest.NewRecorder()
 
@@ -192,36 +281,40 @@ func TestPickPath(t *testing.T) {
 		switch item[1] {
 		case "super":
 			r := httptest.NewRequest("GET", urlItem, nil)
-			err = app.pickPath(w, r)
+			got, err := app.pickPath(w, r)
 			if err != nil {
 				t.Errorf("Error %v processing %s,", err, urlItem)
 			}
-			if !app.appCompare(&testSuperapp) {
+			if !got.appCompare(&testSuperapp) {
 				t.Errorf("\nexp: %v\ngot: %v\nexp: %v\ngot: %v\n",
-					testSuperapp, app, testSuperapp.td, app.td)
+					testSuperapp, got, testSuperapp.td, got.td)
 			}
 		case "admin":
 			r := httptest.NewRequest("GET", urlItem, nil)
-			err = app.pickPath(w, r)
+			got, err := app.pickPath(w, r)
 			if err != nil {
 				t.Errorf("Error %v processing %s,", err, urlItem)
 			}
-			if !app.appCompare(&testAdminapp) {
+			if !got.appCompare(&testAdminapp) {
 				t.Errorf("\nexp: %v\ngot: %v\nexp: %v\ngot: %v\n",
-					testAdminapp, app, testAdminapp.td, app.td)
+					testAdminapp, got, testAdminapp.td, got.td)
 			}
 		case "agent":
 			r := httptest.NewRequest("GET", urlItem, nil)
-			err = app.pickPath(w, r)
+			got, err := app.pickPath(w, r)
 			if err != nil {
 				t.Errorf("Error %v processing %s,", err, urlItem)
 			}
-			if !app.appCompare(&testAgentapp) {
+			if !got.appCompare(&testAgentapp) {
 				t.Errorf("\nexp: %v\ngot: %v\nexp: %v\ngot: %v\n",
-					testAgentapp, app, testAgentapp.td, app.td)
+					testAgentapp, got, testAgentapp.td, got.td)
 			}
 		}
 	}
+	//the role context belongs to the request, the shared app is never touched.
+	if app.table != "" || app.role != "" || app.td.Scope != "" {
+		t.Errorf("pickPath changed the shared app: %v %v", app, app.td)
+	}
 }
 
 type tmTestType map[string][]string
@@ -381,3 +474,132 @@ func TestAddDefaultData(t *testing.T) {
 		}
 	}
 }
+
+func TestDateRange(t *testing.T) {
+	now := time.Date(2020, 5, 17, 15, 4, 5, 0, time.UTC)
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		query string
+		from  time.Time
+		to    time.Time
+		err   bool
+	}{
+		{"", day(2020, 4, 18), day(2020, 5, 18), false},
+		{"?from=2020-05-01&to=2020-05-10", day(2020, 5, 1), day(2020, 5, 11), false},
+		{"?from=2020-05-01", day(2020, 5, 1), day(2020, 5, 18), false},
+		{"?from=2020-05-10&to=2020-05-01", time.Time{}, time.Time{}, true},
+		{"?from=May", time.Time{}, time.Time{}, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/admin/surveys"+test.query, nil)
+		from, to, err := dateRange(r, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.query, err)
+			continue
+		}
+		if !from.Equal(test.from) || !to.Equal(test.to) {
+			t.Errorf("%s: expected %v to %v, got %v to %v", test.query,
+				test.from, test.to, from, to)
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := writeCSV(w, "test.csv", []string{"a", "b"},
+		[][]string{{"1", "two, three"}, {"4", "5"}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	exp := "a,b\n1,\"two, three\"\n4,5\n"
+	if w.Body.String() != exp {
+		t.Errorf("expected %q got %q", exp, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/csv" {
+		t.Errorf("expected text/csv got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	now := time.Date(2020, 5, 17, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		query string
+		exp   search.Query
+		err   bool
+	}{
+		{"?q=+order+4312&agent=3&user=a%40b.com&state=open&from=2020-05-01&to=2020-05-01",
+			search.Query{Text: "order 4312", AgentID: 3, User: "a@b.com",
+				State: "open", From: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+				To: time.Date(2020, 5, 2, 0, 0, 0, 0, time.UTC)}, false},
+		{"?q=order&agent=bob", search.Query{}, true},
+		{"?q=order&state=lost", search.Query{}, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/admin/search"+test.query, nil)
+		q, _, _, err := searchQuery(r, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.query, err)
+			continue
+		}
+		if *q != test.exp {
+			t.Errorf("%s: expected %v, got %v", test.query, test.exp, *q)
+		}
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	now := time.Date(2020, 5, 17, 15, 4, 5, 0, time.UTC)
+	r := httptest.NewRequest("GET",
+		"/super/audit?event=login_failed&actor=+ann&from=2020-05-01&to=2020-05-01", nil)
+	f, err := auditFilter(r, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := broker.AuditFilter{Event: "login_failed", Actor: "ann",
+		From: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2020, 5, 2, 0, 0, 0, 0, time.UTC)}
+	if *f != exp {
+		t.Errorf("expected %v, got %v", exp, *f)
+	}
+	r = httptest.NewRequest("GET", "/super/audit?event=drop", nil)
+	if _, err = auditFilter(r, now); err == nil {
+		t.Errorf("expected an error for an unknown event")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/super/audit", nil)
+	r.RemoteAddr = "192.0.2.7:5123"
+	if ip := clientIP(r); ip != "192.0.2.7" {
+		t.Errorf("expected 192.0.2.7, got %s", ip)
+	}
+	r.RemoteAddr = "[2001:db8::1]:443"
+	if ip := clientIP(r); ip != "2001:db8::1" {
+		t.Errorf("expected 2001:db8::1, got %s", ip)
+	}
+}
+
+func TestTempPassword(t *testing.T) {
+	p1, err := tempPassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, _ := tempPassword()
+	if len(p1) != 16 || p1 == p2 {
+		t.Errorf("expected two different 16 character passwords, got %q %q", p1, p2)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"flag"
 	"html/template"
 	"net/http"
-	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -15,13 +15,18 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/config"
 	"github.com/saied74/toychat/pkg/forms"
+	"github.com/saied74/toychat/pkg/mailer"
+	"github.com/saied74/toychat/pkg/search"
+	"github.com/saied74/toychat/pkg/secure"
 )
 
 //so if the string is used in new packages, it remains privat for this app.
 type contextKey string
 
 const contextKeyIsAuthenticated = contextKey("isAuthenticated")
+const contextKeyRole = contextKey("role")
 
 //UserModel wraps the sql.DB connections
 type UserModel struct {
@@ -33,34 +38,89 @@ type App struct {
 	cache          map[string]*template.Template
 	sessionManager *scs.SessionManager
 	users          *UserModel
-	td             *templateData
-	table          string
-	role           string
-	nextRole       string
-	redirect       string
+	presence       *presenceTracker
+	perms          *permissions
+	mailer         mailer.Mailer
+	baseURL        string //scheme and host of the links in the mails
+	headers        *secure.Config
+	//request scoped, only set on the copy pickPath returns for each request.
+	td       *templateData
+	console  string //super, admin or agent, from the path
+	table    string
+	role     string
+	redirect string
 }
 
 type templateData struct {
-	Scope     string //scope pharase on the navbar
-	Home      string //home address link (e.g. /super/home or /admin/home)
-	Login     string //login link (e.g. /super/login or /admin/login)
-	Logout    string //same with logout.
-	ChgPwd    string
-	Msg       string            //login, add admin or add agent message.
-	SideLink1 string            //addAgent or addAdmin
-	SideLink2 string            //activateAgent or activateAdmin
-	SideLink3 string            //deactivateAgent or deactivateAdmin
-	Super     bool              //role super = true
-	Admin     bool              //role admin = true
-	Agent     bool              // role agent= true
-	Active    bool              //active or not
-	Online    bool              //Agent online or offline
-	Table     *broker.TableRows //[]broker.Person
-	Form      *forms.FormData
-	UserName  string
-	LoggedIn  bool
-	Flash     string
-	CSRFToken string
+	Scope       string //scope pharase on the navbar
+	Home        string //home address link (e.g. /super/home or /admin/home)
+	Login       string //login link (e.g. /super/login or /admin/login)
+	Logout      string //same with logout.
+	ChgPwd      string
+	Forgot      string              //forgot password link
+	Reset       string              //password reset link (mailed)
+	TwoFactor   string              //two-factor login settings link
+	OTP         string              //second login step link
+	MySessions  string              //own sessions page link
+	Msg         string              //login, add admin or add agent message.
+	SideLink1   string              //addAgent or addAdmin
+	SideLink2   string              //activateAgent or activateAdmin
+	SideLink3   string              //deactivateAgent or deactivateAdmin or agent presence
+	SideLink4   string              //agent capacity for the admin, audit log for the super
+	SideLink5   string              //agent status dashboard for the admin
+	SideLink6   string              //dispositions for the admin, close dialog for the agent
+	SideLink7   string              //survey results for the admin
+	SideLink8   string              //operational reports for the admin
+	SideLink9   string              //transcript export for the admin
+	SideLink10  string              //message search for the admin
+	SideLink11  string              //all admins for the super, all agents for the admin
+	SideLink12  string              //end users for the admin
+	Super       bool                //role super = true
+	Admin       bool                //role admin = true
+	Agent       bool                // role agent= true
+	Active      bool                //active or not
+	Online      bool                //Agent online or offline
+	Presence    string              //Agent presence state (available, busy...)
+	Presences   []string            //presence states the agent can choose from
+	Heartbeat   string              //agent heartbeat link
+	HBSeconds   int                 //agent heartbeat interval
+	Capacities  []roleCapacity      //default maximum dialogs of the agent roles
+	Roles       []string            //roles the add form can make
+	Agents      []agentStatus       //agent status dashboard rows
+	Codes       *broker.TableRows   //disposition codes
+	Tags        *broker.TableRows   //dialog tags
+	Require     bool                //disposition required on close
+	From        string              //report range start (yyyy-mm-dd)
+	To          string              //report range end, inclusive
+	Period      string              //report grouping (day, week or month)
+	Kind        string              //survey kind (csat or nps)
+	Question    string              //survey question
+	SurveyOn    bool                //survey enabled
+	Volume      *broker.TableRows   //volume report rows
+	Search      *search.Query       //message search query
+	Hits        []search.Hit        //message search results
+	Audit       []broker.AuditEvent //audit log entries
+	AuditFilter *broker.AuditFilter //audit log filter
+	Events      []string            //audit events to filter on
+	Person      *broker.TableRow    //account being edited
+	TempPass    string              //password set by a reset, shown once
+	Find        string              //end user search text
+	Dialogs     *broker.TableRows   //dialogs of an end user
+	Token       string              //password reset token of the link
+	TOTPURI     string              //provisioning URI of a secret being enrolled
+	TOTPSecret  string              //the same secret for typing in
+	Recovery    []string            //new recovery codes, shown once
+	Policies    []rolePolicy        //roles that must use two-factor login
+	Can         map[string]bool     //permissions of the logged in role
+	LockedUntil time.Time           //end of the login lock of the account shown
+	Sessions    *broker.TableRows   //sessions of the account shown
+	Table       *broker.TableRows   //[]broker.Person
+	Form        *forms.FormData
+	UserName    string
+	LoggedIn    bool
+	Flash       string
+	CSRFToken   string
+	Nonce       string //nonce of the Content-Security-Policy for the script tags
 }
 
 func (t *templateData) Length() int {
@@ -78,13 +138,35 @@ func (t *templateData) setPeople(p *broker.TableRows) {
 
 func main() {
 	var err error
-	//the pw flag is mandatory.
 	ipAddress := flag.String("ipa", ":8000", "server ip address")
-	dsn := flag.String("dsn", "toy:password@/toychat?parseTime=true",
-		"MySQL data source name")
-	pw := flag.String("pw", "password", "database password is always required")
+	baseURL := flag.String("url", "https://localhost:8000",
+		"address of this server in the mailed links")
+	cspReportOnly := flag.Bool("cspreportonly", false,
+		"only report Content-Security-Policy violations, do not enforce the policy")
+	hsts := flag.Duration("hsts", secure.Default.HSTS,
+		"max-age of Strict-Transport-Security, 0 leaves the header out")
+	configFile, printConfig := config.Flags(flag.CommandLine)
 	flag.Parse()
-	dbAddress := strings.Replace(*dsn, "password", *pw, 1)
+	cfg, err := config.Load("backend", *configFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	if *printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	err = cfg.Apply()
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	err = broker.SetCallerFile(broker.CallerBackend, cfg.RequestKeyFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	dbAddress, err := cfg.DataSource()
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
 
 	db, err := openDB(dbAddress)
 	if err != nil {
@@ -92,24 +174,38 @@ func main() {
 	}
 	defer db.Close()
 
+	mail, err := mailer.New(cfg.SMTPServer, cfg.SMTPUser, cfg.SMTPPassword(),
+		cfg.SMTPFrom, cfg.SMTPMailFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+
 	// var allTmplFiles tmDataer
+	headers := secure.Default
+	headers.ReportOnly = *cspReportOnly
+	headers.HSTS = *hsts
 
 	app := &App{
 		sessionManager: scs.New(),
 		users:          &UserModel{DB: db},
-		td: &templateData{
-			Form: &forms.FormData{
-				Fields: url.Values{},
-				Errors: forms.ErrOrs{},
-			},
-		},
-		cache: newTemplateCache(allTmplFiles),
+		presence:       newPresenceTracker(),
+		perms:          newPermissions(),
+		mailer:         mail,
+		baseURL:        strings.TrimSuffix(*baseURL, "/"),
+		headers:        &headers,
+		cache:          newTemplateCache(allTmplFiles),
 	}
 	//at some point when different applicaitons are running on different servers
 	//the database for each applicaiton needs to be seperated.
 	app.sessionManager.Store = mysqlstore.New(db)
-	app.sessionManager.Lifetime = 72 * time.Hour
-	app.sessionManager.Cookie.Name = "sessionTwo"
+	app.sessionManager.Lifetime = cfg.SessionLifetime
+	app.sessionManager.Cookie.Name = cfg.SessionCookie
+
+	stopPresence, err := broker.SubscribePresence(app.presence.update)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	defer stopPresence()
 
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
@@ -127,7 +223,7 @@ func main() {
 	}
 
 	centerr.InfoLog.Printf("Starting server on %s", *ipAddress)
-	err = srv.ListenAndServeTLS(serverCrt, serverKey)
+	err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
 	centerr.ErrorLog.Fatal(err)
 }
 
@@ -144,29 +240,60 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-//chat and play, in addition to the dynamicRoutes middlware are wrapped with
-//requireAuthentication so they are not accessible to non authenicated users.
+//the pages of a logged in account are wrapped with requireAuthentication or,
+//when they need a permission of the role, with requirePermission naming it.
 func (app *App) routes() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc(superHome, app.homeHandler)
 	mux.HandleFunc(superLogin, app.loginHandler)
 	mux.HandleFunc(superLogout, app.logoutHandler)
-	mux.HandleFunc(addAdmin, app.requireAuthentication(app.addHandler))
-	mux.HandleFunc(activateAdmin, app.requireAuthentication(app.activationHandler))
-	mux.HandleFunc(deactivateAdmin, app.requireAuthentication(app.activationHandler))
+	mux.HandleFunc(addAdmin, app.requirePermission(broker.PermManageAdmins, app.addHandler))
+	mux.HandleFunc(activateAdmin, app.requirePermission(broker.PermManageAdmins, app.activationHandler))
+	mux.HandleFunc(deactivateAdmin, app.requirePermission(broker.PermManageAdmins, app.activationHandler))
 	mux.HandleFunc(adminHome, app.homeHandler)
 	mux.HandleFunc(adminLogin, app.loginHandler)
 	mux.HandleFunc(adminLogout, app.logoutHandler)
 	mux.HandleFunc(adminChgPwd, app.requireAuthentication(app.changePasswordHandler))
-	mux.HandleFunc(addAgent, app.requireAuthentication(app.addHandler))
-	mux.HandleFunc(activateAgent, app.requireAuthentication(app.activationHandler))
-	mux.HandleFunc(deactivateAgent, app.requireAuthentication(app.activationHandler))
+	mux.HandleFunc(addAgent, app.requirePermission(broker.PermManageAgents, app.addHandler))
+	mux.HandleFunc(activateAgent, app.requirePermission(broker.PermManageAgents, app.activationHandler))
+	mux.HandleFunc(deactivateAgent, app.requirePermission(broker.PermManageAgents, app.activationHandler))
 	mux.HandleFunc(agentHome, app.homeHandler)
 	mux.HandleFunc(agentLogin, app.loginHandler)
 	mux.HandleFunc(agentChgPwd, app.requireAuthentication(app.changePasswordHandler))
 	mux.HandleFunc(agentLogout, app.logoutHandler)
-	mux.HandleFunc(agentOnline, app.requireAuthentication(app.agentOnlineHandler))
-	mux.HandleFunc(agentOffline, app.requireAuthentication(app.agentOfflineHandler))
-	mux.HandleFunc("/agent/chat", app.requireAuthentication(app.agentChatHandler))
+	mux.HandleFunc(agentOnline, app.requirePermission(broker.PermChat, app.agentOnlineHandler))
+	mux.HandleFunc(agentOffline, app.requirePermission(broker.PermChat, app.agentOfflineHandler))
+	mux.HandleFunc(agentPresence, app.requirePermission(broker.PermChat, app.agentPresenceHandler))
+	mux.HandleFunc(agentHeartbeat, app.requirePermission(broker.PermChat, app.heartbeatHandler))
+	mux.HandleFunc(agentCapacity, app.requirePermission(broker.PermManageAgents, app.capacityHandler))
+	mux.HandleFunc(agentDashboard, app.requirePermission(broker.PermViewReports, app.dashboardHandler))
+	mux.HandleFunc(adminDispositions, app.requirePermission(broker.PermManageSettings, app.dispositionsHandler))
+	mux.HandleFunc(agentClose, app.requirePermission(broker.PermChat, app.closeDialogHandler))
+	mux.HandleFunc(adminSurveys, app.requirePermission(broker.PermManageSettings, app.surveysHandler))
+	mux.HandleFunc(adminReports, app.requirePermission(broker.PermViewReports, app.reportsHandler))
+	mux.HandleFunc(adminExport, app.requirePermission(broker.PermExport, app.exportHandler))
+	mux.HandleFunc(adminSearch, app.requirePermission(broker.PermViewTranscripts, app.searchHandler))
+	mux.HandleFunc(superAudit, app.requirePermission(broker.PermViewAudit, app.auditHandler))
+	mux.HandleFunc(superChgPwd, app.requireAuthentication(app.changePasswordHandler))
+	mux.HandleFunc(superAccounts, app.requirePermission(broker.PermManageAdmins, app.accountsHandler))
+	mux.HandleFunc(adminAccounts, app.requirePermission(broker.PermManageAgents, app.accountsHandler))
+	mux.HandleFunc(adminUsers, app.requirePermission(broker.PermManageUsers, app.usersHandler))
+	mux.HandleFunc(superForgot, app.forgotHandler)
+	mux.HandleFunc(superReset, app.resetHandler)
+	mux.HandleFunc(adminForgot, app.forgotHandler)
+	mux.HandleFunc(adminReset, app.resetHandler)
+	mux.HandleFunc(agentForgot, app.forgotHandler)
+	mux.HandleFunc(agentReset, app.resetHandler)
+	mux.HandleFunc(superOTP, app.otpHandler)
+	mux.HandleFunc(adminOTP, app.otpHandler)
+	mux.HandleFunc(agentOTP, app.otpHandler)
+	mux.HandleFunc(superTwoFactor, app.requireAuthentication(app.twoFactorHandler))
+	mux.HandleFunc(adminTwoFactor, app.requireAuthentication(app.twoFactorHandler))
+	mux.HandleFunc(agentTwoFactor, app.requireAuthentication(app.twoFactorHandler))
+	mux.HandleFunc(superSessions, app.requireAuthentication(app.sessionsHandler))
+	mux.HandleFunc(adminSessions, app.requireAuthentication(app.sessionsHandler))
+	mux.HandleFunc(agentSessions, app.requireAuthentication(app.sessionsHandler))
+	mux.HandleFunc("/agent/chat", app.requirePermission(broker.PermChat, app.agentChatHandler))
+	mux.HandleFunc(secure.ReportPath, secure.ReportHandler)
 	return mux
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/justinas/nosurf"
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/secure"
 )
 
 type plainHandler func(w http.ResponseWriter, r *http.Request)
@@ -56,7 +57,7 @@ func (app *App) recoverPanic(next http.Handler) http.Handler {
 func (app *App) requireAuthentication(next plainHandler) plainHandler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !isAuth(r) {
-			http.Redirect(w, r, app.td.Login, http.StatusSeeOther)
+			http.Redirect(w, r, loginPath(r), http.StatusSeeOther)
 			return
 		}
 		w.Header().Add("Cache-Control", "no-store")
@@ -64,8 +65,39 @@ func (app *App) requireAuthentication(next plainHandler) plainHandler {
 	}
 }
 
+//requirePermission is requireAuthentication for the routes that need the role
+//of the logged in account to have the permission.
+func (app *App) requirePermission(permission string,
+	next plainHandler) plainHandler {
+	return app.requireAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(contextKeyRole).(string)
+		if !app.perms.can(role, permission) {
+			app.clientError(w, http.StatusForbidden,
+				fmt.Errorf("%s needs %s for %s", role, permission, r.URL.Path))
+			return
+		}
+		next(w, r)
+	})
+}
+
+//loginPath is the login page of the role the request path belongs to.
+func loginPath(r *http.Request) string {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) > 1 {
+		switch path[1] {
+		case admin:
+			return adminLogin
+		case agent:
+			return agentLogin
+		}
+	}
+	return superLogin
+}
+
 func noSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
+	//the browsers post the violation reports without a token.
+	csrfHandler.ExemptPath(secure.ReportPath)
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
@@ -85,9 +117,9 @@ func (app *App) authenticate(next http.Handler) http.Handler {
 		if len(path) < 3 {
 			centerr.ErrorLog.Printf("bad path %s, short string", r.URL.Path)
 		}
-		usr, err := broker.GetXR(app.table, app.sessionManager.GetInt(r.Context(),
+		usr, err := broker.GetXR(admins, app.sessionManager.GetInt(r.Context(),
 			authenticatedUserID))
-		if errors.Is(err, broker.ErrNoRecord) || !usr.Active {
+		if errors.Is(err, broker.ErrNoRecord) || !usr.Active || usr.Deleted {
 			app.sessionManager.Remove(r.Context(), authenticatedUserID)
 			next.ServeHTTP(w, r)
 			return
@@ -95,27 +127,57 @@ func (app *App) authenticate(next http.Handler) http.Handler {
 			app.serverError(w, err)
 			return
 		}
-		switch path[1] {
-		case super:
-			if usr.Role != "superadmin" {
-				app.sessionManager.Remove(r.Context(), authenticatedUserID)
-			}
-		case admin:
-			if usr.Role != admin {
-				app.sessionManager.Remove(r.Context(), authenticatedUserID)
+		//the session is only good for the console the role logs in to.
+		if len(path) < 2 || app.perms.console(usr.Role) != path[1] {
+			app.sessionManager.Remove(r.Context(), authenticatedUserID)
+			next.ServeHTTP(w, r)
+			return
+		}
+		//a revoked session is no longer in the session index.
+		err = broker.SeenSessionR(admins, app.sessionManager.GetString(r.Context(),
+			sessionIDKey), usr.ID)
+		if errors.Is(err, broker.ErrNoRecord) {
+			app.sessionManager.Remove(r.Context(), authenticatedUserID)
+			app.sessionManager.Remove(r.Context(), sessionIDKey)
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		//after a forced reset the password has to be changed before anything else.
+		if usr.MustReset && len(path) > 2 && path[2] != "changePassword" &&
+			path[2] != "logout" &&
+			app.sessionManager.Exists(r.Context(), authenticatedUserID) {
+			app.sessionManager.Put(r.Context(), "flash",
+				"Your password was reset, please change it")
+			http.Redirect(w, r, "/"+path[1]+"/changePassword", http.StatusSeeOther)
+			return
+		}
+		//a role that must use two-factor login has to enroll before anything else.
+		if !usr.TOTPEnabled && len(path) > 2 && path[2] != "twofactor" &&
+			path[2] != "changePassword" && path[2] != "logout" &&
+			app.sessionManager.Exists(r.Context(), authenticatedUserID) {
+			required, err := broker.Require2FAR(usr.Role)
+			if err != nil {
+				app.serverError(w, err)
+				return
 			}
-		case agent:
-			if usr.Role != agent {
-				app.sessionManager.Remove(r.Context(), authenticatedUserID)
+			if required {
+				app.sessionManager.Put(r.Context(), "flash",
+					"Two-factor login is required, please set it up")
+				http.Redirect(w, r, "/"+path[1]+"/twofactor", http.StatusSeeOther)
+				return
 			}
 		}
 		ctx := context.WithValue(r.Context(), contextKeyIsAuthenticated, true)
+		ctx = context.WithValue(ctx, contextKeyRole, usr.Role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 func (app *App) dynamicRoutes(next http.Handler) http.Handler {
-	return noSurf(app.sessionManager.LoadAndSave(app.recoverPanic(app.logRequest(app.authenticate(next)))))
+	return app.headers.Headers(noSurf(app.sessionManager.LoadAndSave(app.recoverPanic(app.logRequest(app.authenticate(next))))))
 }
 
 // func (app *App) dynamicAuthRoute(next plainHandler) http.Handler {
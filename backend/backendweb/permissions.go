@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/centerr"
+)
+
+//how long the roles read from the database are used before they are read
+//again, so a change of the permissions takes effect without a restart.
+const rolesTTL = 30 * time.Second
+
+//permissions caches the roles and their permissions (see broker.RolesR).  If
+//reading them fails the last ones read are kept, with none nothing is allowed.
+type permissions struct {
+	mu     sync.Mutex
+	load   func() (map[string]*broker.RoleGrant, error)
+	ttl    time.Duration
+	loaded time.Time
+	roles  map[string]*broker.RoleGrant
+}
+
+func newPermissions() *permissions {
+	return &permissions{load: broker.RolesR, ttl: rolesTTL}
+}
+
+//current returns the roles, reading them again once they are too old.
+func (p *permissions) current() map[string]*broker.RoleGrant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.roles == nil || time.Since(p.loaded) > p.ttl {
+		roles, err := p.load()
+		if err != nil {
+			centerr.ErrorLog.Printf("reading roles %v", err)
+		} else {
+			p.roles = roles
+		}
+		p.loaded = time.Now()
+	}
+	return p.roles
+}
+
+//can tells if the role has the permission.
+func (p *permissions) can(role, permission string) bool {
+	grant, ok := p.current()[role]
+	return ok && grant.Permissions[permission]
+}
+
+//grants returns the permissions of the role, for the template data.
+func (p *permissions) grants(role string) map[string]bool {
+	grant, ok := p.current()[role]
+	if !ok {
+		return map[string]bool{}
+	}
+	return grant.Permissions
+}
+
+//console returns the console (super, admin or agent) the role logs in to.
+func (p *permissions) console(role string) string {
+	grant, ok := p.current()[role]
+	if !ok {
+		return ""
+	}
+	return grant.Console
+}
+
+//inConsole lists the roles of a console by name.
+func (p *permissions) inConsole(console string) []string {
+	roles := []string{}
+	for name, grant := range p.current() {
+		if grant.Console == console {
+			roles = append(roles, name)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+//managedConsoles are the consoles whose accounts each manage permission
+//covers, so a role added with data is managed like the others of its console.
+var managedConsoles = map[string]string{
+	broker.PermManageAdmins: admin,
+	broker.PermManageAgents: agent,
+}
+
+//manages tells if the accounts of the role can manage the accounts of target.
+func (p *permissions) manages(role, target string) bool {
+	roles := p.current()
+	grant, ok := roles[role]
+	if !ok {
+		return false
+	}
+	t, ok := roles[target]
+	if !ok {
+		return false
+	}
+	for permission, console := range managedConsoles {
+		if grant.Permissions[permission] && t.Console == console {
+			return true
+		}
+	}
+	return false
+}
+
+//managed lists the roles the accounts of the role can manage, by name.
+func (p *permissions) managed(role string) []string {
+	roles := []string{}
+	for name := range p.current() {
+		if p.manages(role, name) {
+			roles = append(roles, name)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+//agents lists the roles the accounts of the role can manage that take dialogs
+//(with the chat permission), by name.
+func (p *permissions) agents(role string) []string {
+	roles := []string{}
+	for _, name := range p.managed(role) {
+		if p.can(name, broker.PermChat) {
+			roles = append(roles, name)
+		}
+	}
+	return roles
+}
+
+//all lists the roles by name.
+func (p *permissions) all() []*broker.RoleGrant {
+	roles := []*broker.RoleGrant{}
+	for _, grant := range p.current() {
+		roles = append(roles, grant)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+func testRoles() map[string]*broker.RoleGrant {
+	return map[string]*broker.RoleGrant{
+		"superadmin": {Name: "superadmin", Console: super,
+			Permissions: map[string]bool{broker.PermManageAdmins: true}},
+		admin: {Name: admin, Console: admin,
+			Permissions: map[string]bool{broker.PermManageAgents: true,
+				broker.PermExport: true}},
+		"auditor": {Name: "auditor", Console: admin,
+			Permissions: map[string]bool{broker.PermViewTranscripts: true}},
+		agent: {Name: agent, Console: agent,
+			Permissions: map[string]bool{broker.PermChat: true}},
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	loads := 0
+	p := &permissions{ttl: time.Hour, load: func() (map[string]*broker.RoleGrant,
+		error) {
+		loads++
+		return testRoles(), nil
+	}}
+	tests := []struct {
+		role       string
+		permission string
+		want       bool
+	}{
+		{"superadmin", broker.PermManageAdmins, true},
+		{"superadmin", broker.PermManageAgents, false},
+		{admin, broker.PermExport, true},
+		{"auditor", broker.PermViewTranscripts, true},
+		{"auditor", broker.PermExport, false},
+		{agent, broker.PermChat, true},
+		{"nobody", broker.PermChat, false},
+	}
+	for _, tt := range tests {
+		if got := p.can(tt.role, tt.permission); got != tt.want {
+			t.Errorf("can(%s, %s) = %v, want %v", tt.role, tt.permission, got,
+				tt.want)
+		}
+	}
+	if got := p.console("auditor"); got != admin {
+		t.Errorf("console(auditor) = %q, want %q", got, admin)
+	}
+	if got := p.console("nobody"); got != "" {
+		t.Errorf("console(nobody) = %q, want nothing", got)
+	}
+	want := []string{admin, "auditor"}
+	if got := p.inConsole(admin); !reflect.DeepEqual(got, want) {
+		t.Errorf("inConsole(admin) = %v, want %v", got, want)
+	}
+	if loads != 1 {
+		t.Errorf("roles read %d times, want once within the ttl", loads)
+	}
+}
+
+func TestManages(t *testing.T) {
+	roles := testRoles()
+	roles["supervisor"] = &broker.RoleGrant{Name: "supervisor", Console: agent,
+		Permissions: map[string]bool{broker.PermChat: true}}
+	roles["trainee"] = &broker.RoleGrant{Name: "trainee", Console: agent,
+		Permissions: map[string]bool{}}
+	p := &permissions{ttl: time.Hour, load: func() (map[string]*broker.RoleGrant,
+		error) {
+		return roles, nil
+	}}
+	tests := []struct {
+		role   string
+		target string
+		want   bool
+	}{
+		{"superadmin", admin, true},
+		{"superadmin", "auditor", true},
+		{"superadmin", agent, false},
+		{"superadmin", "superadmin", false},
+		{admin, agent, true},
+		{admin, "supervisor", true},
+		{admin, "auditor", false},
+		{admin, admin, false},
+		{"auditor", agent, false},
+		{agent, agent, false},
+		{admin, "nobody", false},
+		{"nobody", agent, false},
+	}
+	for _, tt := range tests {
+		if got := p.manages(tt.role, tt.target); got != tt.want {
+			t.Errorf("manages(%s, %s) = %v, want %v", tt.role, tt.target, got,
+				tt.want)
+		}
+	}
+	want := []string{agent, "supervisor", "trainee"}
+	if got := p.managed(admin); !reflect.DeepEqual(got, want) {
+		t.Errorf("managed(admin) = %v, want %v", got, want)
+	}
+	want = []string{agent, "supervisor"}
+	if got := p.agents(admin); !reflect.DeepEqual(got, want) {
+		t.Errorf("agents(admin) = %v, want %v", got, want)
+	}
+	if got := p.agents("superadmin"); len(got) != 0 {
+		t.Errorf("agents(superadmin) = %v, want none", got)
+	}
+	want = []string{admin, "auditor"}
+	if got := p.managed("superadmin"); !reflect.DeepEqual(got, want) {
+		t.Errorf("managed(superadmin) = %v, want %v", got, want)
+	}
+}
+
+func TestPermissionsReload(t *testing.T) {
+	var err error
+	roles := testRoles()
+	p := &permissions{ttl: time.Millisecond, load: func() (
+		map[string]*broker.RoleGrant, error) {
+		return roles, err
+	}}
+	if p.can(agent, broker.PermExport) {
+		t.Fatal("agent can export before the grant")
+	}
+	roles = testRoles()
+	roles[agent].Permissions[broker.PermExport] = true
+	time.Sleep(2 * time.Millisecond)
+	if !p.can(agent, broker.PermExport) {
+		t.Error("grant not read again after the ttl")
+	}
+	//a failed read keeps the roles already read.
+	err = errors.New("no database")
+	roles = nil
+	time.Sleep(2 * time.Millisecond)
+	if !p.can(agent, broker.PermExport) {
+		t.Error("roles lost when reading them failed")
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	app := newTestApp(t)
+	app.perms = &permissions{ttl: time.Hour, load: func() (
+		map[string]*broker.RoleGrant, error) {
+		return testRoles(), nil
+	}}
+	defer func() { isAuth = isAuthenticated }()
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+	handler := app.requirePermission(broker.PermExport, next)
+
+	tests := []struct {
+		name string
+		auth bool
+		role string
+		code int
+	}{
+		{"not logged in", false, "", http.StatusSeeOther},
+		{"granted", true, admin, http.StatusOK},
+		{"not granted", true, "auditor", http.StatusForbidden},
+		{"unknown role", true, "nobody", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isAuth = func(r *http.Request) bool { return tt.auth }
+			r := httptest.NewRequest("GET", adminExport, nil)
+			if tt.role != "" {
+				r = r.WithContext(context.WithValue(r.Context(), contextKeyRole,
+					tt.role))
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == http.StatusSeeOther &&
+				w.Header().Get("Location") != adminLogin {
+				t.Errorf("redirected to %q, want %q", w.Header().Get("Location"),
+					adminLogin)
+			}
+		})
+	}
+}
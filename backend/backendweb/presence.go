@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//presenceTracker keeps the latest presence event of each agent as it arrives
+//over nats so the dashboard does not need to wait for the database.
+type presenceTracker struct {
+	mu     sync.RWMutex
+	agents map[int]broker.PresenceEvent
+}
+
+//agentStatus is one row of the agent status dashboard.
+type agentStatus struct {
+	ID       int
+	Name     string
+	Presence string
+	Load     int //dialogs the agent is handling
+	Capacity int //max dialogs of the agent, role default if not set
+	InState  string
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{agents: map[int]broker.PresenceEvent{}}
+}
+
+//update is the handler given to broker.SubscribePresence.  Out of order
+//events are ignored.
+func (p *presenceTracker) update(ev *broker.PresenceEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, ok := p.agents[ev.AgentID]
+	if ok && last.Time.After(ev.Time) {
+		return
+	}
+	p.agents[ev.AgentID] = *ev
+}
+
+func (p *presenceTracker) get(id int) (broker.PresenceEvent, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ev, ok := p.agents[id]
+	return ev, ok
+}
+
+//status merges the agents read from the database with the events seen since
+//the server started.  Online agents are listed first.  An agent without its
+//own max dialogs has the default of its role in caps.
+func (p *presenceTracker) status(people broker.TableRows, caps []roleCapacity,
+	now time.Time) []agentStatus {
+	defaults := map[string]int{}
+	for _, c := range caps {
+		defaults[c.Role] = c.Max
+	}
+	list := []agentStatus{}
+	for _, person := range people {
+		presence, since := person.Presence, person.PresenceSince
+		if ev, ok := p.get(person.ID); ok && ev.Time.After(since) {
+			presence, since = ev.New, ev.Time
+		}
+		if presence == "" {
+			presence = broker.Offline
+		}
+		max := person.MaxDialogs
+		if max == 0 {
+			max = defaults[person.Role]
+		}
+		list = append(list, agentStatus{
+			ID:       person.ID,
+			Name:     person.Name,
+			Presence: presence,
+			Load:     person.Dialog,
+			Capacity: max,
+			InState:  now.Sub(since).Round(time.Second).String(),
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Presence != broker.Offline && list[j].Presence == broker.Offline
+	})
+	return list
+}
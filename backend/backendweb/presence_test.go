@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+func TestPresenceTrackerUpdate(t *testing.T) {
+	p := newPresenceTracker()
+	now := time.Now()
+	p.update(&broker.PresenceEvent{AgentID: 7, New: broker.Busy, Time: now})
+	p.update(&broker.PresenceEvent{AgentID: 7, New: broker.Away,
+		Time: now.Add(-time.Minute)})
+	ev, ok := p.get(7)
+	if !ok {
+		t.Fatalf("expected agent 7 to be tracked")
+	}
+	if ev.New != broker.Busy {
+		t.Errorf("out of order event applied, expected %s got %s", broker.Busy, ev.New)
+	}
+	if _, ok := p.get(8); ok {
+		t.Errorf("agent 8 was never seen but is tracked")
+	}
+}
+
+func TestPresenceTrackerStatus(t *testing.T) {
+	p := newPresenceTracker()
+	now := time.Now()
+	people := broker.TableRows{
+		broker.TableRow{ID: 1, Name: "one", Role: "agent",
+			Presence: broker.Offline, PresenceSince: now.Add(-time.Hour)},
+		broker.TableRow{ID: 2, Name: "two", Role: "agent",
+			Presence: broker.Available, PresenceSince: now.Add(-time.Hour),
+			Dialog: 2, MaxDialogs: 5},
+		broker.TableRow{ID: 3, Name: "three", Role: "supervisor",
+			Presence: broker.Offline, PresenceSince: now.Add(-time.Hour)},
+	}
+	p.update(&broker.PresenceEvent{AgentID: 1, New: broker.Busy,
+		Time: now.Add(-time.Minute)})
+	list := p.status(people, []roleCapacity{{Role: "agent", Max: 3},
+		{Role: "supervisor", Max: 1}}, now)
+	if len(list) != 3 {
+		t.Fatalf("expected 3 rows got %d", len(list))
+	}
+	if list[0].ID != 1 || list[0].Presence != broker.Busy {
+		t.Errorf("expected the event to override the database, got %v", list[0])
+	}
+	if list[0].InState != "1m0s" || list[0].Capacity != 3 {
+		t.Errorf("expected 1m0s with capacity 3, got %v", list[0])
+	}
+	if list[1].Capacity != 5 || list[1].Load != 2 {
+		t.Errorf("expected load 2 of 5, got %v", list[1])
+	}
+	if list[2].Capacity != 1 {
+		t.Errorf("expected the supervisor default 1, got %v", list[2])
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//auditRecord appends an event to the audit table.  It is used by the "audit"
+//action and by the dbmgr itself (sweeper, export) with its own actor.
+func (m *userModel) auditRecord(a *broker.TableRow) error {
+	stmt := `INSERT INTO audit (created, event, actor_id, actor_role, target_id,
+	target, ip, detail) VALUES (UTC_TIMESTAMP(), ?, ?, ?, ?, ?, ?, ?)`
+	_, err := m.dB.Exec(stmt, a.Event, a.ActorID, a.ActorRole, a.TargetID,
+		clip(a.Target, 256), clip(a.IP, 64), clip(a.Detail, 1000))
+	return err
+}
+
+//clip shortens s to the size of its column.
+func clip(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+//audit is the "audit" action, see broker.AuditR.
+func (m *userModel) audit(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	return m.auditRecord(&e.Tables[0])
+}
+
+//auditLog is the "auditLog" action, see broker.AuditLogR.  The actor's name
+//comes from admins for the staff and from users for the end users.
+func (m *userModel) auditLog(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	stmt := `SELECT x.id, x.created, x.event, x.actor_id, x.actor_role,
+	COALESCE(a.name, u.name, ''), x.target_id, x.target, x.ip, x.detail
+	FROM audit x
+	LEFT JOIN admins a ON a.id = x.actor_id AND x.actor_role IN (SELECT name FROM roles)
+	LEFT JOIN users u ON u.id = x.actor_id AND x.actor_role = 'user'
+	WHERE 1 = 1`
+	args := []interface{}{}
+	if f.Event != "" {
+		stmt += ` AND x.event = ?`
+		args = append(args, f.Event)
+	}
+	if f.Actor != "" {
+		stmt += ` AND (a.name LIKE ? OR a.email LIKE ? OR u.name LIKE ? OR u.email LIKE ?)`
+		like := escapeLike(f.Actor) + "%"
+		args = append(args, like, like, like, like)
+	}
+	if f.Target != "" {
+		stmt += ` AND x.target LIKE ?`
+		args = append(args, escapeLike(f.Target)+"%")
+	}
+	if !f.Created.IsZero() {
+		stmt += ` AND x.created >= ?`
+		args = append(args, f.Created)
+	}
+	if !f.Ended.IsZero() {
+		stmt += ` AND x.created < ?`
+		args = append(args, f.Ended)
+	}
+	limit := f.Count
+	if limit <= 0 || limit > broker.MaxAudit {
+		limit = broker.MaxAudit
+	}
+	stmt += ` ORDER BY x.created DESC, x.id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := m.dB.Query(stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e.Tables = broker.TableRows{}
+	for rows.Next() {
+		r := broker.TableRow{}
+		err = rows.Scan(&r.ID, &r.Created, &r.Event, &r.ActorID, &r.ActorRole,
+			&r.Actor, &r.TargetID, &r.Target, &r.IP, &r.Detail)
+		if err != nil {
+			return err
+		}
+		e.Tables = append(e.Tables, r)
+	}
+	return rows.Err()
+}
+
+//escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+//auditSystem records an event done by the dbmgr itself.
+func (m *userModel) auditSystem(role, event string, targetID int, target,
+	detail string) error {
+	return m.auditRecord(&broker.TableRow{Event: event, ActorRole: role,
+		TargetID: targetID, Target: target, Detail: detail})
+}
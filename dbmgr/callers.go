@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/secret"
+)
+
+//grant is a table a caller may use with an action.  put are the columns it
+//may write and spec the columns it has to pick the rows by, at least one of
+//them, so a get or put cannot take the whole table.  Nil allows any.
+type grant struct {
+	table string
+	put   []string
+	spec  []string
+}
+
+//callerPolicy is what a caller may do, the grants of each action.  A nil
+//policy allows everything.
+type callerPolicy map[string][]grant
+
+//policies of the callers of the dbmgr.  The backend runs the consoles of the
+//staff and may do everything.  The frontend only needs the account, login and
+//session actions of the end users, their dialogs and messages (and the
+//replies of the agents it relays from the chat service), their surveys,
+//the settings and the audit events it writes.  It reads and writes single
+//rows: an end user by id or email and only the password and verified columns,
+//the dialogs of one user and only the agent of a dialog.  It inserts only the
+//columns of a sign up, a new dialog, a message and a survey answer, so an end
+//user is not created active or verified, say.
+var policies = map[string]callerPolicy{
+	broker.CallerBackend: nil,
+	broker.CallerFrontend: {
+		"get": {
+			{table: "users", spec: []string{"id", broker.Email}},
+			{table: "settings", spec: []string{"name"}},
+			{table: "dialogs", spec: []string{"user_id"}},
+		},
+		"put": {
+			{table: "users", put: []string{broker.HashedPassword, broker.MustReset,
+				broker.Verified}, spec: []string{"id"}},
+			{table: "dialogs", put: []string{broker.AgentID},
+				spec: []string{broker.DialogID}},
+		},
+		"insert": {
+			{table: "users", put: []string{broker.Name, broker.Email,
+				broker.HashedPassword, broker.Created}},
+			{table: "dialogs", put: []string{"user_id", broker.AgentID,
+				broker.Started}},
+			{table: "messages", put: []string{broker.DialogID, broker.Created,
+				broker.Sender, broker.Message}},
+			{table: "surveys", put: []string{broker.DialogID, broker.AgentID,
+				"user_id", broker.Kind, broker.Rating, broker.Comment, broker.Created}},
+		},
+		"agent":          tables("dialogs"),
+		"unanswered":     tables("messages"),
+		"audit":          tables("audit"),
+		"pendingSurvey":  tables("surveys"),
+		"createReset":    tables("users"),
+		"useReset":       tables("users"),
+		"loginCheck":     tables("lockouts"),
+		"loginFailed":    tables("lockouts"),
+		"loginSucceeded": tables("lockouts"),
+		"startSession":   tables("users"),
+		"seenSession":    tables("users"),
+		"endSession":     tables("users"),
+		"sessions":       tables("users"),
+		"revokeSession":  tables("users"),
+		"revokeSessions": tables("users"),
+	},
+}
+
+//tables grants the tables with any columns.
+func tables(names ...string) []grant {
+	grants := []grant{}
+	for _, name := range names {
+		grants = append(grants, grant{table: name})
+	}
+	return grants
+}
+
+//allowed checks the action, table and columns of the exchange against the
+//policy of the caller.
+func allowed(caller string, e *broker.Exchange) error {
+	p, ok := policies[caller]
+	if !ok {
+		return fmt.Errorf("unknown caller %q", caller)
+	}
+	if p == nil {
+		return nil
+	}
+	for _, g := range p[e.Action] {
+		if g.table == e.Table && within(e.Put, g.put) && within(e.SpecList, g.spec) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not %s on %s (put %v, by %v)", caller, e.Action,
+		e.Table, e.Put, e.SpecList)
+}
+
+//within tells if there are columns and all of them are in allowed, always
+//true for a nil allowed.
+func within(columns, allowed []string) bool {
+	if allowed == nil {
+		return true
+	}
+	if len(columns) == 0 {
+		return false
+	}
+	for _, c := range columns {
+		found := false
+		for _, a := range allowed {
+			found = found || c == a
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//newVerifier reads the key of each caller from <caller>.key in dir.  Without a
+//dir the dbmgr does not start, unless unsigned asks for the requests to be
+//taken unsigned, which is only for development: any nats client can then
+//claim to be any caller.
+func newVerifier(dir string, window time.Duration, unsigned bool) (
+	*broker.Verifier, error) {
+	keys := map[string][]byte{}
+	switch {
+	case dir != "" && unsigned:
+		return nil, errors.New("-unsigned with callers.keys, give only one")
+	case dir == "" && !unsigned:
+		return nil, errors.New("no callers.keys, -unsigned takes the requests " +
+			"unsigned for development")
+	case unsigned:
+		centerr.ErrorLog.Println("WARNING: -unsigned, the requests are NOT " +
+			"verified and any nats client can act as any caller, " +
+			"for development only")
+		return broker.NewVerifier(keys, window), nil
+	}
+	for caller := range policies {
+		key, err := secret.ReadKey(filepath.Join(dir, caller+".key"))
+		if err != nil {
+			return nil, err
+		}
+		keys[caller] = key
+	}
+	return broker.NewVerifier(keys, window), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		e      broker.Exchange
+		ok     bool
+	}{
+		{"backend anything", broker.CallerBackend,
+			broker.Exchange{Action: "put", Table: "admins", Put: []string{"role"}}, true},
+		{"unknown caller", "mallory",
+			broker.Exchange{Action: "get", Table: "users", SpecList: []string{"id"}},
+			false},
+		{"no caller", "",
+			broker.Exchange{Action: "get", Table: "users", SpecList: []string{"id"}},
+			false},
+
+		{"login by email", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "users",
+				SpecList: []string{broker.Email}}, true},
+		{"user by id", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "users", SpecList: []string{"id"}},
+			true},
+		{"all the users", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "users"}, false},
+		{"users by role", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "users",
+				SpecList: []string{"role"}}, false},
+		{"setting", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "settings",
+				SpecList: []string{"name"}}, true},
+		{"all the settings", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "settings"}, false},
+		{"dialogs of the user", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "dialogs",
+				SpecList: []string{"user_id"}}, true},
+		{"all the dialogs", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "dialogs"}, false},
+		{"dialogs of an agent", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "dialogs",
+				SpecList: []string{broker.AgentID}}, false},
+		{"admins", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "admins",
+				SpecList: []string{broker.Email}}, false},
+		{"messages", broker.CallerFrontend,
+			broker.Exchange{Action: "get", Table: "messages",
+				SpecList: []string{broker.DialogID}}, false},
+
+		{"change password", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "users",
+				Put:      []string{broker.HashedPassword, broker.MustReset},
+				SpecList: []string{"id"}}, true},
+		{"verify", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "users",
+				Put: []string{broker.Verified}, SpecList: []string{"id"}}, true},
+		{"activate a user", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "users",
+				Put: []string{broker.Active}, SpecList: []string{"id"}}, false},
+		{"password and email", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "users",
+				Put:      []string{broker.HashedPassword, broker.Email},
+				SpecList: []string{"id"}}, false},
+		{"password by email", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "users",
+				Put:      []string{broker.HashedPassword},
+				SpecList: []string{broker.Email}}, false},
+		{"nothing to put", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "users",
+				SpecList: []string{"id"}}, false},
+		{"agent of a dialog", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "dialogs",
+				Put:      []string{broker.AgentID},
+				SpecList: []string{broker.DialogID}}, true},
+		{"end a dialog", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "dialogs",
+				Put:      []string{broker.Ended},
+				SpecList: []string{broker.DialogID}}, false},
+		{"agent of the dialogs of a user", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "dialogs",
+				Put:      []string{broker.AgentID},
+				SpecList: []string{"user_id"}}, false},
+		{"put admins", broker.CallerFrontend,
+			broker.Exchange{Action: "put", Table: "admins",
+				Put: []string{broker.HashedPassword}, SpecList: []string{"id"}},
+			false},
+
+		{"unanswered messages", broker.CallerFrontend,
+			broker.Exchange{Action: "unanswered", Table: "messages"}, true},
+		{"unanswered of the staff", broker.CallerFrontend,
+			broker.Exchange{Action: "unanswered", Table: "admins"}, false},
+		{"insert admins", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "admins"}, false},
+		{"sign up", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "users",
+				Put: []string{broker.Name, broker.Email, broker.HashedPassword,
+					broker.Created}}, true},
+		{"sign up verified", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "users",
+				Put: []string{broker.Name, broker.Email, broker.HashedPassword,
+					broker.Created, broker.Verified}}, false},
+		{"insert no columns", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "users"}, false},
+		{"message", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "messages",
+				Put: []string{broker.DialogID, broker.Created, broker.Sender,
+					broker.Message}}, true},
+		{"message sealed", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "messages",
+				Put: []string{broker.DialogID, broker.Created, broker.Sender,
+					broker.Message, "sealed"}}, false},
+		{"dialog ended", broker.CallerFrontend,
+			broker.Exchange{Action: "insert", Table: "dialogs",
+				Put: []string{"user_id", broker.AgentID, broker.Started,
+					broker.Ended}}, false},
+		{"agent on admins", broker.CallerFrontend,
+			broker.Exchange{Action: "agent", Table: "admins"}, false},
+		{"requeue", broker.CallerFrontend,
+			broker.Exchange{Action: "requeue", Table: "dialogs"}, false},
+		{"roles", broker.CallerFrontend,
+			broker.Exchange{Action: "roles", Table: "roles"}, false},
+		{"search", broker.CallerFrontend,
+			broker.Exchange{Action: "search", Table: "messages"}, false},
+		{"staff sessions", broker.CallerFrontend,
+			broker.Exchange{Action: "revokeSessions", Table: "admins"}, false},
+		{"staff lockouts", broker.CallerFrontend,
+			broker.Exchange{Action: "unlock", Table: "lockouts"}, false},
+		{"staff reset", broker.CallerFrontend,
+			broker.Exchange{Action: "createReset", Table: "admins"}, false},
+	}
+	for _, tt := range tests {
+		err := allowed(tt.caller, &tt.e)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want allowed %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+//TestAllowedGrants checks every grant of the frontend is allowed as given and
+//refused on another table.
+func TestAllowedGrants(t *testing.T) {
+	for action, grants := range policies[broker.CallerFrontend] {
+		for _, g := range grants {
+			e := broker.Exchange{Action: action, Table: g.table, Put: g.put,
+				SpecList: g.spec}
+			err := allowed(broker.CallerFrontend, &e)
+			if err != nil {
+				t.Errorf("%s on %s: %v", action, g.table, err)
+			}
+			e.Table = "admins"
+			if allowed(broker.CallerFrontend, &e) == nil {
+				t.Errorf("%s allowed on admins", action)
+			}
+		}
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "callers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = newVerifier("", time.Second, false)
+	if err == nil || !strings.Contains(err.Error(), "-unsigned") {
+		t.Errorf("no keys: got %v", err)
+	}
+	_, err = newVerifier(dir, time.Second, true)
+	if err == nil {
+		t.Error("keys and -unsigned together taken")
+	}
+	v, err := newVerifier("", time.Second, true)
+	if err != nil || len(v.Keys) != 0 {
+		t.Errorf("unsigned: got %v", err)
+	}
+	_, err = newVerifier(dir, time.Second, false)
+	if err == nil {
+		t.Error("taken without the key files")
+	}
+	for caller := range policies {
+		err = ioutil.WriteFile(filepath.Join(dir, caller+".key"),
+			[]byte("0123456789abcdef-"+caller+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err = newVerifier(dir, time.Second, false)
+	if err != nil || len(v.Keys) != len(policies) {
+		t.Errorf("with keys: got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//closeDialog is the "close" action.  The first row of the exchange carries
+//the dialog, the agent, the disposition and the wrap up notes.  Every other
+//row carries a tag in TagID.  Closing ends the dialog, records the tags and
+//frees one dialog of the agent's capacity, all in one transaction.  Only an
+//open dialog of the agent can be closed.
+func (m *userModel) closeDialog(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	d := e.Tables[0]
+	var disposition interface{}
+	if d.DispositionID != 0 {
+		disposition = d.DispositionID
+	}
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE dialogs SET ended = UTC_TIMESTAMP(), disposition_id = ?,
+	wrapup = ? WHERE dialog_id = ? AND agent_id = ? AND ended < started`
+	res, err := tx.Exec(stmt, disposition, d.Wrapup, d.DialogID, d.AgentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return broker.ErrNoRecord
+	}
+	stmt = "INSERT INTO dialog_tags (dialog_id, tag_id) VALUES(?, ?)"
+	for _, t := range e.Tables[1:] {
+		_, err = tx.Exec(stmt, d.DialogID, t.TagID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt = "UPDATE admins SET dialog = dialog - 1 WHERE id = ? AND dialog > 0"
+	_, err = tx.Exec(stmt, d.AgentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//unanswered is the "unanswered" action, see broker.UnansweredR.  The dialog is
+//picked by the user as well, so a caller only reads the messages of the user
+//it names.
+func (m *userModel) unanswered(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	d := e.Tables[0]
+	stmt := `SELECT m.message, m.sealed FROM messages m
+	JOIN dialogs d ON d.dialog_id = m.dialog_id
+	WHERE m.dialog_id = ? AND d.user_id = ? AND m.sender = 'user'
+	AND m.message_id > (SELECT IFNULL(MAX(message_id), 0) FROM messages
+		WHERE dialog_id = ? AND sender = 'agent')
+	ORDER BY m.message_id`
+	rows, err := m.dB.Query(stmt, d.DialogID, d.ID, d.DialogID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	msgs := broker.TableRows{}
+	for rows.Next() {
+		var text string
+		var sealed []byte
+		err = rows.Scan(&text, &sealed)
+		if err != nil {
+			return err
+		}
+		text, err = m.openMessage(d.DialogID, text, sealed)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, broker.TableRow{DialogID: d.DialogID, Msg: text})
+	}
+	e.Tables = msgs
+	return rows.Err()
+}
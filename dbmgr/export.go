@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/config"
+	"github.com/saied74/toychat/pkg/transcript"
+)
+
+const dateLayout = "2006-01-02"
+
+//exportCmd is the export subcommand.  It reads the database directly so it does
+//not need the nats server or a running dbmgr.  For example
+//"dbmgr export -format html -dialog 42 -o dialog42.html" exports
+//one dialog and "dbmgr export -format csv -from 2020-05-01" all the
+//dialogs started since May first.  -to is not included and defaults to
+//tomorrow, -from defaults to 30 days before -to.  Without -o the export is
+//written to the standard output.
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	configFile := config.FileFlag(fs)
+	format := fs.String("format", transcript.JSON, "json, csv or html")
+	dialog := fs.Int("dialog", 0, "export only this dialog")
+	from := fs.String("from", "", "first day of the range (yyyy-mm-dd)")
+	to := fs.String("to", "", "day after the range (yyyy-mm-dd)")
+	out := fs.String("o", "", "output file, standard output if empty")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	f := transcript.Filter{DialogID: *dialog}
+	f.To = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	if *to != "" {
+		f.To, err = time.Parse(dateLayout, *to)
+		if err != nil {
+			return fmt.Errorf("bad -to date: %v", err)
+		}
+	}
+	f.From = f.To.AddDate(0, 0, -30)
+	if *from != "" {
+		f.From, err = time.Parse(dateLayout, *from)
+		if err != nil {
+			return fmt.Errorf("bad -from date: %v", err)
+		}
+	}
+	if !f.From.Before(f.To) {
+		return fmt.Errorf("-from must be before -to")
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	bw := bufio.NewWriter(w)
+	tw, err := transcript.NewWriter(*format, bw)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load("dbmgr", *configFile)
+	if err != nil {
+		return err
+	}
+	m, err := newUserModel(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.dB.Close()
+	detail := fmt.Sprintf("format %s, dialog %d, from %s to %s, file %q", *format,
+		f.DialogID, f.From.Format(dateLayout), f.To.Format(dateLayout), *out)
+	err = m.auditSystem(broker.ActorCLI, broker.AuditExport, f.DialogID, "",
+		detail)
+	if err != nil {
+		return err
+	}
+	n, err := transcript.Export(m, f, tw)
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	centerr.InfoLog.Printf("exported %d dialogs", n)
+	return nil
+}
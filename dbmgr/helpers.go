@@ -6,18 +6,28 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	nats "github.com/nats-io/nats.go"
 	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/centerr"
 )
 
 func (app *App) processDBRequests(msg *nats.Msg, conn *nats.Conn) {
 	gob.Register(broker.TableRows{})
 	var err error
 	var exchange = &broker.Exchange{}
-	err = exchange.FromGob(msg.Data)
+	caller, payload, err := app.verifier.Open(msg.Data, time.Now())
+	if err == nil {
+		err = exchange.FromGob(payload)
+	}
+	if err == nil {
+		err = allowed(caller, exchange)
+	}
 	if err != nil {
+		centerr.ErrorLog.Printf("request from %q refused: %v", caller, err)
+		exchange = &broker.Exchange{}
 		exchange.EncodeErr(err)
 	}
 	if err == nil {
@@ -34,6 +44,105 @@ func (app *App) processDBRequests(msg *nats.Msg, conn *nats.Conn) {
 		case "agent":
 			err = app.users.getAgent(exchange)
 			exchange.EncodeErr(err)
+		case "requeue":
+			err = app.users.requeue(exchange)
+			exchange.EncodeErr(err)
+		case "close":
+			err = app.users.closeDialog(exchange)
+			exchange.EncodeErr(err)
+		case "unanswered":
+			err = app.users.unanswered(exchange)
+			exchange.EncodeErr(err)
+		case "pendingSurvey":
+			err = app.users.pendingSurvey(exchange)
+			exchange.EncodeErr(err)
+		case "surveyStats":
+			err = app.users.surveyStats(exchange)
+			exchange.EncodeErr(err)
+		case "volumeReport":
+			err = app.users.volumeReport(exchange)
+			exchange.EncodeErr(err)
+		case "agentReport":
+			err = app.users.agentReport(exchange)
+			exchange.EncodeErr(err)
+		case "transcripts":
+			err = app.users.transcripts(exchange)
+			exchange.EncodeErr(err)
+		case "transcriptMessages":
+			err = app.users.transcriptMessages(exchange)
+			exchange.EncodeErr(err)
+		case "search":
+			err = app.users.searchMessages(exchange)
+			exchange.EncodeErr(err)
+		case "audit":
+			err = app.users.audit(exchange)
+			exchange.EncodeErr(err)
+		case "auditLog":
+			err = app.users.auditLog(exchange)
+			exchange.EncodeErr(err)
+		case "findUsers":
+			err = app.users.findUsers(exchange)
+			exchange.EncodeErr(err)
+		case "userDialogs":
+			err = app.users.userDialogs(exchange)
+			exchange.EncodeErr(err)
+		case "userActive":
+			err = app.users.userActive(exchange)
+			exchange.EncodeErr(err)
+		case "createReset":
+			err = app.users.createReset(exchange)
+			exchange.EncodeErr(err)
+		case "useReset":
+			err = app.users.useReset(exchange)
+			exchange.EncodeErr(err)
+		case "enableTOTP":
+			err = app.users.enableTOTP(exchange)
+			exchange.EncodeErr(err)
+		case "resetTOTP":
+			err = app.users.resetTOTP(exchange)
+			exchange.EncodeErr(err)
+		case "totpStep":
+			err = app.users.totpStep(exchange)
+			exchange.EncodeErr(err)
+		case "useRecovery":
+			err = app.users.useRecovery(exchange)
+			exchange.EncodeErr(err)
+		case "newRecovery":
+			err = app.users.newRecovery(exchange)
+			exchange.EncodeErr(err)
+		case "loginCheck":
+			err = app.users.loginCheck(exchange)
+			exchange.EncodeErr(err)
+		case "loginFailed":
+			err = app.users.loginFailed(exchange)
+			exchange.EncodeErr(err)
+		case "loginSucceeded":
+			err = app.users.loginSucceeded(exchange)
+			exchange.EncodeErr(err)
+		case "unlock":
+			err = app.users.unlock(exchange)
+			exchange.EncodeErr(err)
+		case "roles":
+			err = app.users.roles(exchange)
+			exchange.EncodeErr(err)
+		case "startSession":
+			err = app.users.startSession(exchange)
+			exchange.EncodeErr(err)
+		case "seenSession":
+			err = app.users.seenSession(exchange)
+			exchange.EncodeErr(err)
+		case "endSession":
+			err = app.users.endSession(exchange)
+			exchange.EncodeErr(err)
+		case "sessions":
+			err = app.users.sessions(exchange)
+			exchange.EncodeErr(err)
+		case "revokeSession":
+			err = app.users.revokeSession(exchange)
+			exchange.EncodeErr(err)
+		case "revokeSessions":
+			err = app.users.revokeSessions(exchange)
+			exchange.EncodeErr(err)
 		default:
 			exchange.EncodeErr(err)
 		}
@@ -47,22 +156,21 @@ func (app *App) processDBRequests(msg *nats.Msg, conn *nats.Conn) {
 }
 
 type userModel struct {
-	dB *sql.DB
+	dB    *sql.DB
+	vault *messageVault //nil stores the messages as they are
+	//lifetime of the sessions of the web apps, their index is kept as long.
+	lifetime time.Duration
 }
 
 func (m *userModel) insert(e *broker.Exchange) error {
+	if e.Table == "messages" && m.vault != nil {
+		return m.insertMessages(e)
+	}
 	stmt := buildInsertStmt(e.Table, e.Put)
 	for _, c := range e.Spec {
 		_, err := m.dB.Exec(stmt, c...)
 		if err != nil {
-			var mySQLError *mysql.MySQLError
-			if errors.As(err, &mySQLError) {
-				if mySQLError.Number == 1062 &&
-					strings.Contains(mySQLError.Message, e.Table+"_uc_email") {
-					return broker.ErrDuplicateEmail
-				}
-			}
-			return err
+			return duplicateErr(err, e.Table)
 		}
 	}
 	return nil
@@ -110,22 +218,42 @@ func (m *userModel) put(e *broker.Exchange) error {
 	for _, c := range e.Spec {
 		_, err := m.dB.Exec(stmt, c...)
 		if err != nil {
-			return err
+			return duplicateErr(err, e.Table)
 		}
 	}
 	return nil
 }
 
+//duplicateErr maps the MySQL duplicate entry error to ErrDuplicateEmail for
+//the email unique constraint and to ErrDuplicate for the others.
+func duplicateErr(err error, table string) error {
+	var mySQLError *mysql.MySQLError
+	if errors.As(err, &mySQLError) && mySQLError.Number == 1062 {
+		if strings.Contains(mySQLError.Message, table+"_uc_email") {
+			return broker.ErrDuplicateEmail
+		}
+		return broker.ErrDuplicate
+	}
+	return err
+}
+
 //getAgent is coded longhand without any abstraction since it is only one of its
 //kind for now.  We will see what happens as the application develops.
+//Only active agents that are available and below their capacity are picked.
+//The capacity is the agent's max_dialogs or, when that is zero, the default
+//for the role from role_defaults (and 3 if the role has no default).
 func (m *userModel) getAgent(e *broker.Exchange) error {
 	userMsgs := broker.TableRows{}
-	stmt := "SELECT id, dialog  FROM admins WHERE role='agent' AND dialog < 3 ORDER BY dialog"
+	stmt := `SELECT a.id, a.dialog FROM admins a
+	LEFT JOIN role_defaults r ON r.role = a.role
+	WHERE a.role IN ` + chatRoles + ` AND a.active = TRUE AND a.presence = ?
+	AND a.dialog < IF(a.max_dialogs > 0, a.max_dialogs, COALESCE(r.max_dialogs, 3))
+	ORDER BY a.dialog LIMIT 1 FOR UPDATE`
 	tx, err := m.dB.Begin()
 	if err != nil {
 		return err
 	}
-	rows := tx.QueryRow(stmt)
+	rows := tx.QueryRow(stmt, broker.Available)
 	userMsg := broker.TableRow{}
 	err = rows.Scan(&userMsg.AgentID, &userMsg.Dialog)
 	if err != nil {
@@ -137,7 +265,7 @@ func (m *userModel) getAgent(e *broker.Exchange) error {
 	}
 	userMsg.Dialog++
 	stmt = "UPDATE admins SET dialog = ? WHERE id = ?"
-	_, err = m.dB.Exec(stmt, &userMsg.Dialog, &userMsg.Dialog)
+	_, err = tx.Exec(stmt, userMsg.Dialog, userMsg.AgentID)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -162,6 +290,8 @@ func buildInsertStmt(table string, put []string) string {
 			stmt += "UTC_TIMESTAMP(), "
 		case "started":
 			stmt += "UTC_TIMESTAMP(), "
+		case "agent_id": //0 is a dialog waiting for an agent
+			stmt += "NULLIF(?, 0), "
 		default:
 			stmt += "?, "
 		}
@@ -173,9 +303,20 @@ func buildInsertStmt(table string, put []string) string {
 
 func buildGetStmt(table string, get, spec []string) string {
 	stmt := "SELECT "
-	getFields := strings.Join(get[:], ", ")
-	stmt += getFields
-	stmt += " FROM " + table + " WHERE "
+	for _, item := range get {
+		switch item {
+		case "agent_id": //null while the dialog is waiting for an agent
+			stmt += "IFNULL(agent_id, 0), "
+		default:
+			stmt += item + ", "
+		}
+	}
+	stmt = strings.TrimSuffix(stmt, ", ")
+	stmt += " FROM " + table
+	if len(spec) == 0 { //all rows of the table
+		return stmt
+	}
+	stmt += " WHERE "
 	specFields := strings.Join(spec[:], " = ? AND ")
 	stmt += specFields
 	stmt += " = ?"
@@ -184,8 +325,15 @@ func buildGetStmt(table string, get, spec []string) string {
 
 func buildPutStmt(table string, put, spec []string) string {
 	stmt := "UPDATE " + table + " SET "
-	putFields := strings.Join(put[:], " = ? AND ")
-	stmt += putFields + " = ?"
+	for _, item := range put {
+		switch item {
+		case "presence_since", "heartbeat":
+			stmt += item + " = UTC_TIMESTAMP(), "
+		default:
+			stmt += item + " = ?, "
+		}
+	}
+	stmt = strings.TrimSuffix(stmt, ", ")
 	stmt += " WHERE "
 	specFields := strings.Join(spec[:], " = ? AND ")
 	stmt += specFields
@@ -8,12 +8,13 @@
 //end are run on seperate servers or in a more scalable solution, each will
 //have its own mysql database for the session data.
 //
-//The dbmgr expects a password with the -pw flag for the database at startup.
-//It also expects the nats server to be up and running.
+//The dbmgr reads the database, with the password from a file, and the nats
+//server from the -config file and the environment (see pkg/config).  It
+//expects the nats server to be up and running.
 //
-//The interface to the dbmgr is through nats.  It listens on the nats.DefaultURL
-//looking for messages addressed to "forDB".  It blocks until it recieves the
-//message with a return mailbox.  Once it recieves that, it fires off a goroutine
+//The interface to the dbmgr is through nats.  It listens on the nats server
+//looking for messages addressed to subject.db, "forDB".  It blocks until it
+//recieves the message with a return mailbox.  Once it recieves that, it fires off a goroutine
 //to process the request and goes back to listening for the next request.
 //
 //When firing off the go routine,  it hands it pointers to the connection and
@@ -58,52 +59,130 @@
 //
 //the MySQL database, in addition to the session tables as indicated above,
 //has the users, admins (which includes agents) dialogs and messages tables.
+//
+//The dbmgr also runs the presence sweeper.  Agent consoles send a heartbeat
+//every 30 seconds.  Agents that miss heartbeats for longer than the -hb window
+//are moved offline, their open dialogs are requeued (agent_id set to NULL)
+//and a presence event is published.
+//
+//"dbmgr export" exports transcripts as JSON, CSV or HTML straight from the
+//database, see the exportCmd function for the flags.
+//
+//Every -retain interval the dbmgr applies the retention policies of the
+//retention table (see dbscripts/retention.txt) to the messages, dialogs and
+//users, purging or anonymising the rows past their retention period.  Each
+//run is recorded in retention_runs.  "dbmgr retain -dry-run" reports what a
+//run would do without changing anything.
+//
+//With vault.keyfile the message bodies are stored encrypted, see pkg/vault
+//and vault.go.  The transcripts, the export and the search open them for the
+//callers allowed to read them.  "dbmgr keygen" makes a master key line for
+//the key file and "dbmgr rekey" wraps the data keys with the first key of
+//the file after a rotation (and with -seal encrypts the messages stored
+//before the vault).
+//
+//The requests come in a broker.Envelope signed by the caller (see
+//pkg/broker/sign.go).  With callers.keys the dbmgr checks the signature with
+//the key of the caller, refuses requests more than callers.window off and
+//requests it has seen before, and then only does what the policy of the
+//caller allows (see callers.go).  It does not start without the keys unless
+//-unsigned asks for unsigned requests, which is only for development.
 
 package main
 
 import (
 	"database/sql"
 	"flag"
+	"fmt"
+	"os"
 	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	nats "github.com/nats-io/nats.go"
+	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/config"
 )
 
 //App for inseertion of variables into functions
 type App struct {
-	users *userModel
+	users    *userModel
+	verifier *broker.Verifier
 }
 
 func main() {
 
-	pw := flag.String("pw", "password", "database password is always required")
-	flag.Parse()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		var err error
+		switch os.Args[1] {
+		case "export":
+			err = exportCmd(os.Args[2:])
+		case "retain":
+			err = retainCmd(os.Args[2:])
+		case "rekey":
+			err = rekeyCmd(os.Args[2:])
+		case "keygen":
+			err = keygenCmd(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q, use export, retain, rekey or keygen",
+				os.Args[1])
+		}
+		if err != nil {
+			centerr.ErrorLog.Fatal(err)
+		}
+		return
+	}
 
-	var err error
-	dsn := "toy:password@/toychat?parseTime=true"
-	dsn = strings.Replace(dsn, "password", *pw, 1)
+	hb := flag.Duration("hb", 90*time.Second, "missed heartbeat window for agents")
+	retain := flag.Duration("retain", 24*time.Hour, "retention run interval, 0 for none")
+	unsigned := flag.Bool("unsigned", false,
+		"take the requests unsigned without callers.keys, for development only")
+	configFile, printConfig := config.Flags(flag.CommandLine)
+	flag.Parse()
+	cfg, err := config.Load("dbmgr", *configFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	if *printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	err = cfg.Apply()
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	verifier, err := newVerifier(cfg.CallerKeys, cfg.CallerWindow, *unsigned)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
 
-	db, err := openDB(dsn)
+	users, err := newUserModel(cfg)
 	if err != nil {
 		centerr.ErrorLog.Fatal(err)
 	}
-	defer db.Close()
+	defer users.dB.Close()
+	if users.vault == nil {
+		centerr.InfoLog.Println("no vault.keyfile, messages are stored unencrypted")
+	}
 
 	//the function of app is dpenendency injection.
 	app := App{
-		users: &userModel{dB: db},
+		users:    users,
+		verifier: verifier,
 	}
 
-	nc1, err := nats.Connect(nats.DefaultURL)
+	nc1, err := broker.Connect()
 	if err != nil {
 		centerr.ErrorLog.Fatal("Error from onnection", err)
 	}
 	defer nc1.Close()
 
-	sub, _ := nc1.SubscribeSync("forDB")
+	go app.users.sweep(nc1, *hb, *hb/3)
+	if *retain > 0 {
+		go app.users.retainEvery(*retain)
+	}
+
+	sub, _ := nc1.SubscribeSync(cfg.Subjects.DB)
 	for {
 		msg, err := sub.NextMsg(10 * time.Hour)
 		if err != nil {
@@ -113,9 +192,27 @@ func main() {
 	}
 }
 
+//newUserModel opens the database of the configuration with the vault of the
+//messages, none without vault.keyfile, and the session lifetime.
+func newUserModel(cfg *config.Config) (*userModel, error) {
+	v, err := newMessageVault(cfg.VaultKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &userModel{dB: db, vault: v, lifetime: cfg.SessionLifetime}, nil
+}
+
 // The openDB() function wraps sql.Open() and returns a sql.DB connection pool
-// for a given DSN.
-func openDB(dsn string) (*sql.DB, error) {
+// for the database of the configuration.
+func openDB(cfg *config.Config) (*sql.DB, error) {
+	dsn, err := cfg.DataSource()
+	if err != nil {
+		return nil, err
+	}
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, err
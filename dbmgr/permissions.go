@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//chatRoles are the roles with the chat permission, the ones that take
+//dialogs, for "role IN " + chatRoles.  A role added in the tables with the
+//permission is an agent like the others.
+const chatRoles = `(SELECT role FROM role_permissions WHERE permission = '` +
+	broker.PermChat + `')`
+
+//roles is the "roles" action, see broker.RolesR.  There is a row for each
+//permission of a role and one with an empty permission for a role without any.
+func (m *userModel) roles(e *broker.Exchange) error {
+	rows, err := m.dB.Query(`SELECT r.name, r.label, r.console,
+	COALESCE(p.permission, '') FROM roles r
+	LEFT JOIN role_permissions p ON p.role = r.name ORDER BY r.name, p.permission`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e.Tables = broker.TableRows{}
+	for rows.Next() {
+		row := broker.TableRow{}
+		err = rows.Scan(&row.Role, &row.Label, &row.Kind, &row.Value)
+		if err != nil {
+			return err
+		}
+		e.Tables = append(e.Tables, row)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//firstResponse is joined to dialogs to get the time of the first agent message.
+const firstResponse = `LEFT JOIN (SELECT dialog_id, MIN(created) AS first
+	FROM messages WHERE sender = 'agent' GROUP BY dialog_id) f
+	ON f.dialog_id = d.dialog_id`
+
+//handleTime is the length of a closed dialog in seconds, NULL while open.
+const handleTime = `CASE WHEN d.ended >= d.started
+	THEN TIMESTAMPDIFF(SECOND, d.started, d.ended) END`
+
+//volumeReport is the "volumeReport" action, see broker.VolumeReportR.
+func (m *userModel) volumeReport(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	format, ok := periodFormats[f.Period]
+	if !ok {
+		return fmt.Errorf("unknown period %q", f.Period)
+	}
+	stmt := `SELECT DATE_FORMAT(d.started, '` + format + `') AS period, COUNT(*),
+	IFNULL(AVG(` + handleTime + `), 0),
+	IFNULL(AVG(TIMESTAMPDIFF(SECOND, d.started, f.first)), 0),
+	IFNULL(100 * SUM(f.first IS NULL AND d.ended >= d.started) /
+		NULLIF(SUM(d.ended >= d.started), 0), 0)
+	FROM dialogs d ` + firstResponse + `
+	WHERE d.started >= ? AND d.started < ?
+	GROUP BY period ORDER BY period`
+	rows, err := m.dB.Query(stmt, f.Created, f.Ended)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	report := broker.TableRows{}
+	for rows.Next() {
+		r := broker.TableRow{}
+		err = rows.Scan(&r.Period, &r.Count, &r.Average, &r.Response, &r.Score)
+		if err != nil {
+			return err
+		}
+		report = append(report, r)
+	}
+	e.Tables = report
+	return rows.Err()
+}
+
+//agentReport is the "agentReport" action, see broker.AgentReportR.  The
+//utilisation is the sum of the handle times over the capacity of the agent
+//(max_dialogs or the role default) times the length of the range.
+func (m *userModel) agentReport(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	stmt := `SELECT a.id, a.name, COUNT(d.dialog_id),
+	IFNULL(AVG(` + handleTime + `), 0),
+	IFNULL(AVG(TIMESTAMPDIFF(SECOND, d.started, f.first)), 0),
+	IFNULL(SUM(` + handleTime + `), 0),
+	IF(a.max_dialogs > 0, a.max_dialogs, IFNULL(r.max_dialogs, 3))
+	FROM admins a LEFT JOIN role_defaults r ON r.role = a.role
+	LEFT JOIN dialogs d ON d.agent_id = a.id AND d.started >= ? AND d.started < ?
+	` + firstResponse + `
+	WHERE a.role IN ` + chatRoles + `
+	GROUP BY a.id, a.name, a.max_dialogs, r.max_dialogs ORDER BY a.name`
+	rows, err := m.dB.Query(stmt, f.Created, f.Ended)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	seconds := f.Ended.Sub(f.Created).Seconds()
+	report := broker.TableRows{}
+	for rows.Next() {
+		r := broker.TableRow{}
+		var busy float64
+		err = rows.Scan(&r.AgentID, &r.Name, &r.Count, &r.Average, &r.Response,
+			&busy, &r.MaxDialogs)
+		if err != nil {
+			return err
+		}
+		if seconds > 0 && r.MaxDialogs > 0 {
+			r.Score = 100 * busy / (seconds * float64(r.MaxDialogs))
+		}
+		report = append(report, r)
+	}
+	e.Tables = report
+	return rows.Err()
+}
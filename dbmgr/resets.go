@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//resetTables are the account tables a password reset can be issued for.
+var resetTables = map[string]bool{"users": true, "admins": true}
+
+//createReset is the "createReset" action, see broker.CreateResetR.
+func (m *userModel) createReset(e *broker.Exchange) error {
+	if !resetTables[e.Table] {
+		return fmt.Errorf("no password reset for table %q", e.Table)
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	r := e.Tables[0]
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE resets SET used = TRUE
+	WHERE table_name = ? AND account_id = ? AND used = FALSE`, e.Table, r.ID)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO resets (table_name, account_id, token_hash,
+		created, expires) VALUES (?, ?, ?, UTC_TIMESTAMP(), ?)`,
+			e.Table, r.ID, r.Token, r.Ended)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	return tx.Commit()
+}
+
+//useReset is the "useReset" action, see broker.UseResetR.  The token is locked
+//while it is checked and used up so two requests cannot both use it.
+func (m *userModel) useReset(e *broker.Exchange) error {
+	if !resetTables[e.Table] {
+		return fmt.Errorf("no password reset for table %q", e.Table)
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	r := e.Tables[0]
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	var id, accountID int
+	err = tx.QueryRow(`SELECT id, account_id FROM resets
+	WHERE table_name = ? AND token_hash = ? AND used = FALSE
+	AND expires > UTC_TIMESTAMP() FOR UPDATE`, e.Table, r.Token).Scan(&id,
+		&accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = broker.ErrNoRecord
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE resets SET used = TRUE WHERE id = ?", id)
+	}
+	if err == nil {
+		//the table is one of resetTables, never the request's own text.
+		_, err = tx.Exec("UPDATE "+e.Table+
+			" SET hashed_password = ?, must_reset = FALSE WHERE id = ?",
+			r.HashedPassword, accountID)
+	}
+	account := broker.TableRow{}
+	if err == nil {
+		err = tx.QueryRow("SELECT id, name, email FROM "+e.Table+" WHERE id = ?",
+			accountID).Scan(&account.ID, &account.Name, &account.Email)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	e.Tables = broker.TableRows{account}
+	return tx.Commit()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/config"
+)
+
+//Retention actions, a table's rows past its retention period are either
+//deleted or stripped of personal data.
+const (
+	retainPurge     = "purge"
+	retainAnonymise = "anonymise"
+)
+
+//anonymous replaces the text of anonymised messages, wrap up notes and
+//survey comments and the name of anonymised users.
+const anonymous = "anonymous"
+
+//policy is a row of the retention table.  Days of zero keeps the table's
+//rows forever.
+type policy struct {
+	table  string
+	days   int
+	action string
+}
+
+//retained is the outcome of one policy in a run, it is also the audit record
+//written to retention_runs.
+type retained struct {
+	table    string
+	action   string
+	cutoff   time.Time
+	affected int64
+	err      error
+}
+
+//retainer applies a policy with the cutoff inside the run's transaction and
+//returns the number of rows of the policy's table changed or deleted.
+type retainer func(tx *sql.Tx, cutoff time.Time) (int64, error)
+
+//retainers by table and action.  Only closed dialogs are ever touched and a
+//dialog's age is when it ended.  Children go before their parents so the
+//foreign keys hold: messages, dialog tags and surveys before their dialog
+//and dialogs before their user, the words of the sealed messages before their
+//message.  Dropping the data key of a dialog whose messages are purged or
+//anonymised also leaves any copy of them, in a backup say, sealed for good.
+//Users are only purged once they have no dialogs or surveys left and only
+//anonymised once all their dialogs are closed and past the cutoff.
+var retainers = map[string]map[string]retainer{
+	"messages": {
+		retainPurge: execAll(also(purgeTerms), own(purgeMessages), also(purgeKeys)),
+		retainAnonymise: execAll(also(purgeTerms), own(anonymiseMessages),
+			also(purgeKeys)),
+	},
+	"dialogs": {
+		retainPurge: execAll(also(purgeTerms), also(purgeMessages), also(purgeKeys),
+			also(`DELETE t FROM dialog_tags t JOIN dialogs d ON d.dialog_id = t.dialog_id
+		WHERE d.ended >= d.started AND d.ended < ?`),
+			also(`DELETE s FROM surveys s JOIN dialogs d ON d.dialog_id = s.dialog_id
+		WHERE d.ended >= d.started AND d.ended < ?`),
+			own(`DELETE FROM dialogs WHERE ended >= started AND ended < ?`)),
+		retainAnonymise: execAll(also(purgeTerms), also(anonymiseMessages),
+			also(purgeKeys),
+			also(`UPDATE surveys s JOIN dialogs d ON d.dialog_id = s.dialog_id
+		SET s.comment = '' WHERE d.ended >= d.started AND d.ended < ?
+		AND s.comment <> ''`),
+			own(`UPDATE dialogs SET wrapup = '' WHERE ended >= started AND ended < ?
+		AND wrapup <> ''`)),
+	},
+	"users": {
+		retainPurge: execAll(own(`DELETE u FROM users u WHERE u.created < ?
+		AND NOT EXISTS (SELECT 1 FROM dialogs d WHERE d.user_id = u.id)
+		AND NOT EXISTS (SELECT 1 FROM surveys s WHERE s.user_id = u.id)`)),
+		retainAnonymise: func(tx *sql.Tx, cutoff time.Time) (int64, error) {
+			stmt := `UPDATE users u SET u.name = '` + anonymous + `',
+			u.email = CONCAT('` + anonymous + `-', u.id, '@invalid'),
+			u.hashed_password = ''
+			WHERE u.created < ? AND u.email <> CONCAT('` + anonymous + `-', u.id, '@invalid')
+			AND NOT EXISTS (SELECT 1 FROM dialogs d WHERE d.user_id = u.id
+			AND (d.ended < d.started OR d.ended >= ?))`
+			res, err := tx.Exec(stmt, cutoff, cutoff)
+			if err != nil {
+				return 0, err
+			}
+			return res.RowsAffected()
+		},
+	},
+	//old login failures no longer count (see pkg/throttle) and an old lock
+	//no longer doubles the next one.
+	"login_failures": {
+		retainPurge: execAll(own(`DELETE FROM login_failures WHERE created < ?`),
+			also(`DELETE FROM lockouts WHERE locked_until < ?`)),
+	},
+	//a session is gone once it is older than the session lifetime, however
+	//recently it was seen, see cutoff.
+	"session_index": {
+		retainPurge: execAll(own(`DELETE FROM session_index WHERE created < ?`)),
+	},
+}
+
+//statements the messages and dialogs retainers share.
+const (
+	purgeTerms = `DELETE t FROM message_terms t
+	JOIN messages m ON m.message_id = t.message_id
+	JOIN dialogs d ON d.dialog_id = m.dialog_id
+	WHERE d.ended >= d.started AND d.ended < ?`
+	purgeMessages = `DELETE m FROM messages m
+	JOIN dialogs d ON d.dialog_id = m.dialog_id
+	WHERE d.ended >= d.started AND d.ended < ?`
+	purgeKeys = `DELETE k FROM data_keys k
+	JOIN dialogs d ON k.owner = '` + ownerDialog + `' AND k.owner_id = d.dialog_id
+	WHERE d.ended >= d.started AND d.ended < ?`
+	anonymiseMessages = `UPDATE messages m
+	JOIN dialogs d ON d.dialog_id = m.dialog_id
+	SET m.message = '` + anonymous + `', m.sealed = NULL
+	WHERE d.ended >= d.started AND d.ended < ? AND m.message <> '` + anonymous + `'`
+)
+
+//step is a statement of a retainer.  Only the rows of the policy's own
+//table are counted, not those of their children or data keys.
+type step struct {
+	stmt    string
+	counted bool
+}
+
+//own is a step on the policy's table, also one on another table.
+func own(stmt string) step  { return step{stmt: stmt, counted: true} }
+func also(stmt string) step { return step{stmt: stmt} }
+
+//execAll is a retainer that runs each step with the cutoff and adds up the
+//rows the counted ones change.
+func execAll(steps ...step) retainer {
+	return func(tx *sql.Tx, cutoff time.Time) (int64, error) {
+		var total int64
+		for _, s := range steps {
+			res, err := tx.Exec(s.stmt, cutoff)
+			if err != nil {
+				return total, err
+			}
+			if !s.counted {
+				continue
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+		return total, nil
+	}
+}
+
+//policies reads the retention table, in the order the tables have to be
+//processed for the foreign keys.  A table or action without a retainer is an
+//error so a typo does not silently keep data forever.
+func (m *userModel) policies() ([]policy, error) {
+	stmt := `SELECT table_name, days, action FROM retention WHERE days > 0
+	ORDER BY FIELD(table_name, 'messages', 'dialogs', 'users')`
+	rows, err := m.dB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ps := []policy{}
+	for rows.Next() {
+		p := policy{}
+		err = rows.Scan(&p.table, &p.days, &p.action)
+		if err != nil {
+			return nil, err
+		}
+		if retainers[p.table][p.action] == nil {
+			return nil, fmt.Errorf("no retention %s for table %s", p.action, p.table)
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+//cutoff is the time before which the policy applies as of now.  The index of
+//a session is kept for at least the session lifetime, a shorter period would
+//drop live sessions from it and their logout everywhere would miss them.
+func (m *userModel) cutoff(p policy, now time.Time) time.Time {
+	cutoff := now.AddDate(0, 0, -p.days)
+	if p.table == "session_index" && now.Add(-m.lifetime).Before(cutoff) {
+		cutoff = now.Add(-m.lifetime)
+	}
+	return cutoff
+}
+
+//retain runs the retention policies as of now in one transaction.  A dry
+//run makes all the changes and rolls them back, so it reports exactly what
+//a real run would remove.  Either way the outcome of each policy is recorded
+//in retention_runs.
+func (m *userModel) retain(now time.Time, dryRun bool) ([]retained, error) {
+	now = now.UTC().Truncate(time.Second)
+	ps, err := m.policies()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	results := []retained{}
+	for _, p := range ps {
+		r := retained{table: p.table, action: p.action, cutoff: m.cutoff(p, now)}
+		r.affected, r.err = retainers[p.table][p.action](tx, r.cutoff)
+		results = append(results, r)
+		if r.err != nil {
+			err = fmt.Errorf("retention %s %s: %v", p.action, p.table, r.err)
+			break
+		}
+	}
+	if err != nil || dryRun {
+		tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	auditErr := m.auditRetention(now, dryRun, results)
+	if err != nil {
+		return results, err
+	}
+	return results, auditErr
+}
+
+func (m *userModel) auditRetention(started time.Time, dryRun bool,
+	results []retained) error {
+	stmt := `INSERT INTO retention_runs (started, dry_run, table_name, action,
+	cutoff, affected, error) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	for _, r := range results {
+		msg := ""
+		if r.err != nil {
+			msg = r.err.Error()
+			if len(msg) > 255 {
+				msg = msg[:255]
+			}
+		}
+		_, err := m.dB.Exec(stmt, started, dryRun, r.table, r.action, r.cutoff,
+			r.affected, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//retainEvery runs forever, applying the retention policies every interval.
+func (m *userModel) retainEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		results, err := m.retain(time.Now(), false)
+		if err != nil {
+			centerr.ErrorLog.Printf("retention %v", err)
+		}
+		for _, r := range results {
+			centerr.InfoLog.Printf("retention %s %s before %s: %d rows", r.action,
+				r.table, r.cutoff.Format(time.RFC3339), r.affected)
+		}
+	}
+}
+
+//retainCmd is the retain subcommand.  It applies the retention policies once
+//and prints what was done, with -dry-run nothing is changed but the run is
+//still recorded.
+func retainCmd(args []string) error {
+	fs := flag.NewFlagSet("retain", flag.ContinueOnError)
+	configFile := config.FileFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "report what would be removed, change nothing")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load("dbmgr", *configFile)
+	if err != nil {
+		return err
+	}
+	m, err := newUserModel(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.dB.Close()
+	results, err := m.retain(time.Now(), *dryRun)
+	verb := "changed"
+	if *dryRun {
+		verb = "would change"
+	}
+	for _, r := range results {
+		fmt.Printf("%-9s %-8s before %s: %s %d rows\n", r.action, r.table,
+			r.cutoff.Format(time.RFC3339), verb, r.affected)
+	}
+	if len(results) == 0 && err == nil {
+		fmt.Println("no retention policies are set")
+	}
+	return err
+}
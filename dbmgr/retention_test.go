@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCutoff(t *testing.T) {
+	now := time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		p        policy
+		lifetime time.Duration
+		want     time.Time
+	}{
+		{"messages", policy{"messages", 1, retainPurge}, 72 * time.Hour,
+			now.AddDate(0, 0, -1)},
+		{"sessions past their lifetime", policy{"session_index", 3, retainPurge},
+			24 * time.Hour, now.AddDate(0, 0, -3)},
+		{"sessions as long as they live", policy{"session_index", 3, retainPurge},
+			30 * 24 * time.Hour, now.AddDate(0, 0, -30)},
+	}
+	for _, tt := range tests {
+		m := &userModel{lifetime: tt.lifetime}
+		if got := m.cutoff(tt.p, now); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+//rowsDriver is a database that changes the number of rows of rowsByTable in
+//the table of each statement, it only runs statements.
+type rowsDriver struct{}
+type rowsConn struct{}
+type rowsStmt string
+
+var rowsByTable = map[string]int64{"message_terms": 40, "messages": 7,
+	"data_keys": 2, "dialog_tags": 3, "surveys": 2, "dialogs": 2,
+	"login_failures": 11, "lockouts": 4}
+
+func (rowsDriver) Open(string) (driver.Conn, error)        { return rowsConn{}, nil }
+func (rowsConn) Prepare(q string) (driver.Stmt, error)     { return rowsStmt(q), nil }
+func (rowsConn) Close() error                              { return nil }
+func (rowsConn) Begin() (driver.Tx, error)                 { return rowsConn{}, nil }
+func (rowsConn) Commit() error                             { return nil }
+func (rowsConn) Rollback() error                           { return nil }
+func (rowsStmt) Close() error                              { return nil }
+func (rowsStmt) NumInput() int                             { return -1 }
+func (rowsStmt) Query([]driver.Value) (driver.Rows, error) { return nil, driver.ErrSkip }
+
+//Exec changes the rows of the table after the FROM of a DELETE or the
+//UPDATE.
+func (s rowsStmt) Exec([]driver.Value) (driver.Result, error) {
+	f := strings.Fields(string(s))
+	table := f[1]
+	for i, w := range f {
+		if f[0] == "DELETE" && w == "FROM" {
+			table = f[i+1]
+			break
+		}
+	}
+	return driver.RowsAffected(rowsByTable[table]), nil
+}
+
+func init() {
+	sql.Register("rows", rowsDriver{})
+}
+
+//a policy counts the rows of its own table, not those of their children and
+//keys or of the lockouts.
+func TestRetainerCount(t *testing.T) {
+	db, err := sql.Open("rows", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tests := []struct {
+		table  string
+		action string
+		want   int64
+	}{
+		{"messages", retainPurge, 7},
+		{"messages", retainAnonymise, 7},
+		{"dialogs", retainPurge, 2},
+		{"dialogs", retainAnonymise, 2},
+		{"login_failures", retainPurge, 11},
+	}
+	for _, tt := range tests {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := retainers[tt.table][tt.action](tx, time.Now())
+		tx.Rollback()
+		if err != nil || n != tt.want {
+			t.Errorf("%s %s: %d rows %v, want %d", tt.action, tt.table, n, err,
+				tt.want)
+		}
+	}
+}
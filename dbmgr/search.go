@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/search"
+)
+
+//userModel searches the messages with the FULLTEXT index of
+//dbscripts/search.txt.  The sealed messages are found by the hashes of their
+//words instead, see termMatch.
+var _ search.Searcher = &userModel{}
+
+//Search implements search.Searcher.
+func (m *userModel) Search(q search.Query, limit int) ([]search.Hit, error) {
+	hits := []search.Hit{}
+	text := search.Boolean(q.Text)
+	if text == "" {
+		return hits, nil
+	}
+	if !search.ValidState(q.State) {
+		return nil, fmt.Errorf("unknown dialog state %q", q.State)
+	}
+	terms, termArgs, err := m.termMatch(q.Text)
+	if err != nil {
+		return nil, err
+	}
+	stmt := `SELECT m.message_id, m.dialog_id, d.user_id, u.name, u.email,
+	IFNULL(d.agent_id, 0), IFNULL(a.name, ''), m.created, m.sender, m.message,
+	m.sealed, IF(d.ended < d.started, 'open', 'closed')
+	FROM messages m JOIN dialogs d ON d.dialog_id = m.dialog_id
+	JOIN users u ON u.id = d.user_id LEFT JOIN admins a ON a.id = d.agent_id
+	WHERE (MATCH (m.message) AGAINST (? IN BOOLEAN MODE)`
+	args := []interface{}{text}
+	if terms != "" {
+		stmt += ` OR ` + terms
+		args = append(args, termArgs...)
+	}
+	stmt += `)`
+	if q.AgentID != 0 {
+		stmt += ` AND d.agent_id = ?`
+		args = append(args, q.AgentID)
+	}
+	if q.User != "" {
+		stmt += ` AND (u.email = ? OR u.name = ?)`
+		args = append(args, q.User, q.User)
+	}
+	if !q.From.IsZero() {
+		stmt += ` AND m.created >= ?`
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		stmt += ` AND m.created < ?`
+		args = append(args, q.To)
+	}
+	switch q.State {
+	case search.Open:
+		stmt += ` AND d.ended < d.started`
+	case search.Closed:
+		stmt += ` AND d.ended >= d.started`
+	}
+	stmt += ` ORDER BY m.created DESC, m.message_id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := m.dB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		h := search.Hit{}
+		var sealed []byte
+		err = rows.Scan(&h.MessageID, &h.DialogID, &h.UserID, &h.UserName,
+			&h.UserEmail, &h.AgentID, &h.AgentName, &h.Created, &h.Sender,
+			&h.Text, &sealed, &h.State)
+		if err != nil {
+			return nil, err
+		}
+		h.Text, err = m.openMessage(h.DialogID, h.Text, sealed)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+//searchMessages is the "search" action, see broker.SearchR.
+func (m *userModel) searchMessages(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	limit := f.Count
+	if limit <= 0 || limit > search.MaxHits {
+		limit = search.MaxHits
+	}
+	hits, err := m.Search(search.Query{Text: f.Msg, AgentID: f.AgentID,
+		User: f.Name, From: f.Created, To: f.Ended, State: f.State}, limit)
+	if err != nil {
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	for _, h := range hits {
+		e.Tables = append(e.Tables, broker.TableRow{MessageID: h.MessageID,
+			DialogID: h.DialogID, ID: h.UserID, Name: h.UserName,
+			Email: h.UserEmail, AgentID: h.AgentID, AgentName: h.AgentName,
+			Created: h.Created, Sender: h.Sender, Msg: h.Text, State: h.State})
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//sessionTables are the account tables sessions are indexed for.
+var sessionTables = map[string]bool{"users": true, "admins": true}
+
+func checkSessionTable(e *broker.Exchange) error {
+	if !sessionTables[e.Table] {
+		return fmt.Errorf("no sessions for table %q", e.Table)
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	return nil
+}
+
+//startSession is the "startSession" action, see broker.StartSessionR.
+func (m *userModel) startSession(e *broker.Exchange) error {
+	err := checkSessionTable(e)
+	if err != nil {
+		return err
+	}
+	s := e.Tables[0]
+	now := time.Now().UTC()
+	_, err = m.dB.Exec(`INSERT INTO session_index (table_name, account_id,
+	sid_hash, created, last_seen, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.Table, s.ID, s.Token, now, now, clip(s.IP, 64), clip(s.UserAgent, 255))
+	e.Tables = broker.TableRows{}
+	return err
+}
+
+//seenSession is the "seenSession" action, see broker.SeenSessionR.  The last
+//seen time is only written once it is broker.SessionSeenEvery old.
+func (m *userModel) seenSession(e *broker.Exchange) error {
+	err := checkSessionTable(e)
+	if err != nil {
+		return err
+	}
+	s := e.Tables[0]
+	e.Tables = broker.TableRows{}
+	var id int
+	var seen time.Time
+	err = m.dB.QueryRow(`SELECT id, last_seen FROM session_index
+	WHERE table_name = ? AND account_id = ? AND sid_hash = ?`,
+		e.Table, s.ID, s.Token).Scan(&id, &seen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return broker.ErrNoRecord
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if now.Sub(seen) < broker.SessionSeenEvery {
+		return nil
+	}
+	_, err = m.dB.Exec("UPDATE session_index SET last_seen = ? WHERE id = ?",
+		now, id)
+	return err
+}
+
+//endSession is the "endSession" action, see broker.EndSessionR.
+func (m *userModel) endSession(e *broker.Exchange) error {
+	err := checkSessionTable(e)
+	if err != nil {
+		return err
+	}
+	_, err = m.dB.Exec(`DELETE FROM session_index
+	WHERE table_name = ? AND sid_hash = ?`, e.Table, e.Tables[0].Token)
+	e.Tables = broker.TableRows{}
+	return err
+}
+
+//sessions is the "sessions" action, see broker.SessionsR.
+func (m *userModel) sessions(e *broker.Exchange) error {
+	err := checkSessionTable(e)
+	if err != nil {
+		return err
+	}
+	rows, err := m.dB.Query(`SELECT id, sid_hash, created, last_seen, ip,
+	user_agent FROM session_index WHERE table_name = ? AND account_id = ?
+	ORDER BY last_seen DESC`, e.Table, e.Tables[0].ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e.Tables = broker.TableRows{}
+	for rows.Next() {
+		s := broker.TableRow{}
+		err = rows.Scan(&s.ID, &s.Token, &s.Created, &s.LastSeen, &s.IP,
+			&s.UserAgent)
+		if err != nil {
+			return err
+		}
+		e.Tables = append(e.Tables, s)
+	}
+	return rows.Err()
+}
+
+//revokeSession is the "revokeSession" action, see broker.RevokeSessionR.
+func (m *userModel) revokeSession(e *broker.Exchange) error {
+	err := checkSessionTable(e)
+	if err != nil {
+		return err
+	}
+	if len(e.Tables) < 2 {
+		return broker.ErrNoRecord
+	}
+	result, err := m.dB.Exec(`DELETE FROM session_index
+	WHERE table_name = ? AND account_id = ? AND id = ?`,
+		e.Table, e.Tables[0].ID, e.Tables[1].ID)
+	e.Tables = broker.TableRows{}
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		return broker.ErrNoRecord
+	}
+	return err
+}
+
+//revokeSessions is the "revokeSessions" action, see broker.RevokeSessionsR.
+func (m *userModel) revokeSessions(e *broker.Exchange) error {
+	err := checkSessionTable(e)
+	if err != nil {
+		return err
+	}
+	_, err = m.dB.Exec(`DELETE FROM session_index
+	WHERE table_name = ? AND account_id = ? AND sid_hash <> ?`,
+		e.Table, e.Tables[0].ID, e.Tables[0].Token)
+	e.Tables = broker.TableRows{}
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//periodFormats maps the report periods to MySQL DATE_FORMAT patterns.
+var periodFormats = map[string]string{
+	broker.PeriodHour:  "%Y-%m-%d %H:00",
+	broker.PeriodDay:   "%Y-%m-%d",
+	broker.PeriodWeek:  "%x-W%v",
+	broker.PeriodMonth: "%Y-%m",
+}
+
+//pendingSurvey is the "pendingSurvey" action.  Only dialogs closed in the last
+//day are offered so users are not asked about old conversations.
+func (m *userModel) pendingSurvey(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	stmt := `SELECT d.dialog_id, IFNULL(d.agent_id, 0), d.started, d.ended
+	FROM dialogs d LEFT JOIN surveys s ON s.dialog_id = d.dialog_id
+	WHERE d.user_id = ? AND d.ended >= d.started AND s.id IS NULL
+	AND d.ended > UTC_TIMESTAMP() - INTERVAL 1 DAY
+	ORDER BY d.ended DESC LIMIT 1`
+	d := broker.TableRow{ID: e.Tables[0].ID}
+	err := m.dB.QueryRow(stmt, d.ID).Scan(&d.DialogID, &d.AgentID, &d.Created,
+		&d.Ended)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return broker.ErrNoRecord
+		}
+		return err
+	}
+	e.Tables = broker.TableRows{d}
+	return nil
+}
+
+//surveyStats is the "surveyStats" action, see broker.SurveyStatsR.
+func (m *userModel) surveyStats(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	format, ok := periodFormats[f.Period]
+	if !ok {
+		return fmt.Errorf("unknown period %q", f.Period)
+	}
+	//satisfied is rating 4 or 5 for CSAT, promoters (9, 10) less detractors
+	//(0 to 6) for NPS.
+	score := "100 * AVG(s.rating >= 4)"
+	if f.Kind == broker.NPS {
+		score = "100 * (AVG(s.rating >= 9) - AVG(s.rating <= 6))"
+	}
+	stmt := `SELECT s.agent_id, a.name, DATE_FORMAT(s.created, '` + format + `') AS period,
+	COUNT(*), AVG(s.rating), ` + score + `
+	FROM surveys s JOIN admins a ON a.id = s.agent_id
+	WHERE s.kind = ? AND s.created >= ? AND s.created < ?
+	GROUP BY s.agent_id, a.name, period ORDER BY period, a.name`
+	rows, err := m.dB.Query(stmt, f.Kind, f.Created, f.Ended)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	stats := broker.TableRows{}
+	for rows.Next() {
+		s := broker.TableRow{Kind: f.Kind}
+		err = rows.Scan(&s.AgentID, &s.Name, &s.Period, &s.Count, &s.Average,
+			&s.Score)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, s)
+	}
+	e.Tables = stats
+	return rows.Err()
+}
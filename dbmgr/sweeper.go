@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/centerr"
+)
+
+//requeue is the "requeue" action.  It is used when an agent logs out.
+func (m *userModel) requeue(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	err = requeueAgent(tx, e.Tables[0].AgentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//requeueAgent sets the agent of the agent's open dialogs to NULL so the
+//frontend selects a new agent on the next message.  A dialog is open as long
+//as it has not ended (ended is still the default, before started).
+func requeueAgent(tx *sql.Tx, agentID int) error {
+	stmt := "UPDATE dialogs SET agent_id = NULL WHERE agent_id = ? AND ended < started"
+	_, err := tx.Exec(stmt, agentID)
+	if err != nil {
+		return err
+	}
+	stmt = "UPDATE admins SET dialog = 0 WHERE id = ?"
+	_, err = tx.Exec(stmt, agentID)
+	return err
+}
+
+//sweep runs forever.  Every interval it moves the agents that have not sent a
+//heartbeat within window offline, requeues their dialogs and publishes the
+//presence event.  This also covers expired sessions since an agent without
+//a session cannot send heartbeats.
+func (m *userModel) sweep(conn *nats.Conn, window, interval time.Duration) {
+	for range time.Tick(interval) {
+		lost, err := m.lostAgents(window)
+		if err != nil {
+			centerr.ErrorLog.Printf("sweeper %v", err)
+			continue
+		}
+		for _, agent := range lost {
+			err = m.expireAgent(agent.ID)
+			if err != nil {
+				centerr.ErrorLog.Printf("sweeper agent %d: %v", agent.ID, err)
+				continue
+			}
+			centerr.InfoLog.Printf("sweeper moved agent %d offline", agent.ID)
+			err = m.auditSystem(broker.ActorSystem, broker.AuditTransfer, agent.ID,
+				agent.Name, "heartbeat lost, open dialogs requeued")
+			if err != nil {
+				centerr.ErrorLog.Printf("sweeper audit %v", err)
+			}
+			err = broker.PublishPresenceConn(conn, &broker.PresenceEvent{
+				AgentID: agent.ID,
+				Name:    agent.Name,
+				Old:     agent.Presence,
+				New:     broker.Offline,
+				Reason:  broker.ReasonExpired,
+				Time:    time.Now().UTC(),
+			})
+			if err != nil {
+				centerr.ErrorLog.Printf("sweeper publish %v", err)
+			}
+		}
+	}
+}
+
+//lostAgents returns the agents that are not offline and whose last heartbeat
+//is older than window.
+func (m *userModel) lostAgents(window time.Duration) (broker.TableRows, error) {
+	stmt := `SELECT id, name, presence FROM admins WHERE role IN ` + chatRoles + `
+	AND presence <> ? AND heartbeat < UTC_TIMESTAMP() - INTERVAL ? SECOND`
+	rows, err := m.dB.Query(stmt, broker.Offline, int(window.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lost := broker.TableRows{}
+	for rows.Next() {
+		agent := broker.TableRow{}
+		err = rows.Scan(&agent.ID, &agent.Name, &agent.Presence)
+		if err != nil {
+			return nil, err
+		}
+		lost = append(lost, agent)
+	}
+	return lost, rows.Err()
+}
+
+func (m *userModel) expireAgent(agentID int) error {
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := `UPDATE admins SET presence = ?, online = FALSE,
+	presence_since = UTC_TIMESTAMP() WHERE id = ?`
+	res, err := tx.Exec(stmt, broker.Offline, agentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return broker.ErrNoRecord
+	}
+	err = requeueAgent(tx, agentID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
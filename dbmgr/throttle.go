@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/throttle"
+)
+
+//loginCheck is the "loginCheck" action, see broker.LoginCheckR.
+func (m *userModel) loginCheck(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	k := e.Tables[0]
+	var until sql.NullTime
+	err := m.dB.QueryRow(`SELECT MAX(locked_until) FROM lockouts
+	WHERE ((kind = ? AND lkey = ?) OR (kind = ? AND lkey = ?))
+	AND locked_until > ?`, throttle.Account, k.Email, throttle.IP, k.IP,
+		time.Now().UTC()).Scan(&until)
+	if err != nil {
+		return err
+	}
+	e.Tables = broker.TableRows{{Ended: until.Time}}
+	return nil
+}
+
+//loginFailed is the "loginFailed" action, see broker.LoginFailedR.  The
+//failure is recorded for the account and the address and each is locked if
+//it has too many in the window.  A lock starts a new window.
+func (m *userModel) loginFailed(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	k := e.Tables[0]
+	now := time.Now().UTC()
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	result := broker.TableRow{}
+	for _, key := range [][2]string{{throttle.Account, k.Email},
+		{throttle.IP, k.IP}} {
+		if key[1] == "" {
+			continue
+		}
+		locked, until, err := failKey(tx, key[0], key[1], now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if locked && until.After(result.Ended) {
+			result.Detail = key[0]
+			result.Ended = until
+		}
+	}
+	e.Tables = broker.TableRows{result}
+	return tx.Commit()
+}
+
+//failKey records a failure of one key and locks it if the policy says so.
+//The lockouts row of the key is made (not locked yet) if it is missing and
+//locked for the transaction before the failures are counted, so two failures
+//at the same time are counted one after the other.  The count is a locking
+//read as well, so it sees the failures committed before the lock and not the
+//snapshot of the first key of the transaction.
+func failKey(tx *sql.Tx, kind, key string, now time.Time) (bool, time.Time,
+	error) {
+	p := throttle.Default
+	_, err := tx.Exec(`INSERT INTO lockouts (kind, lkey, locked_until, locks)
+	VALUES (?, ?, ?, 0) ON DUPLICATE KEY UPDATE locks = locks`, kind, key, now)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	var failures, locks int
+	err = tx.QueryRow(`SELECT locks FROM lockouts WHERE kind = ? AND lkey = ?
+	FOR UPDATE`, kind, key).Scan(&locks)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	_, err = tx.Exec(`DELETE FROM login_failures
+	WHERE kind = ? AND lkey = ? AND created <= ?`, kind, key, now.Add(-p.Window))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	_, err = tx.Exec(`INSERT INTO login_failures (kind, lkey, created)
+	VALUES (?, ?, ?)`, kind, key, now)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	err = tx.QueryRow(`SELECT COUNT(*) FROM login_failures
+	WHERE kind = ? AND lkey = ? FOR UPDATE`, kind, key).Scan(&failures)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	locked, until := p.Fail(kind, failures, locks, now)
+	if !locked {
+		return false, time.Time{}, nil
+	}
+	_, err = tx.Exec(`UPDATE lockouts SET locked_until = ?, locks = locks + 1
+	WHERE kind = ? AND lkey = ?`, until, kind, key)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM login_failures WHERE kind = ? AND lkey = ?",
+			kind, key)
+	}
+	return err == nil, until, err
+}
+
+//loginSucceeded is the "loginSucceeded" action, see broker.LoginSucceededR.
+func (m *userModel) loginSucceeded(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	key := e.Tables[0].Email
+	_, err := m.dB.Exec("DELETE FROM login_failures WHERE kind = ? AND lkey = ?",
+		throttle.Account, key)
+	if err == nil {
+		_, err = m.dB.Exec(`DELETE FROM lockouts WHERE kind = ? AND lkey = ?
+		AND locked_until <= ?`, throttle.Account, key, time.Now().UTC())
+	}
+	e.Tables = broker.TableRows{}
+	return err
+}
+
+//unlock is the "unlock" action, see broker.UnlockR.
+func (m *userModel) unlock(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	key := e.Tables[0].Email
+	_, err := m.dB.Exec("DELETE FROM login_failures WHERE kind = ? AND lkey = ?",
+		throttle.Account, key)
+	if err == nil {
+		_, err = m.dB.Exec("DELETE FROM lockouts WHERE kind = ? AND lkey = ?",
+			throttle.Account, key)
+	}
+	e.Tables = broker.TableRows{}
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/transcript"
+)
+
+//userModel is the transcript.Source of the export subcommand.  The
+//"transcripts" and "transcriptMessages" actions serve BrokerSource.
+var _ transcript.Source = &userModel{}
+
+//Dialogs returns a page of dialogs for an export, see transcript.Source.
+func (m *userModel) Dialogs(f transcript.Filter, after, limit int) (
+	[]transcript.Transcript, error) {
+	stmt := `SELECT d.dialog_id, d.user_id, u.name, u.email,
+	IFNULL(d.agent_id, 0), IFNULL(a.name, ''), d.started, d.ended
+	FROM dialogs d JOIN users u ON u.id = d.user_id
+	LEFT JOIN admins a ON a.id = d.agent_id
+	WHERE d.dialog_id > ? AND `
+	args := []interface{}{after}
+	if f.DialogID != 0 {
+		stmt += `d.dialog_id = ?`
+		args = append(args, f.DialogID)
+	} else {
+		stmt += `d.started >= ? AND d.started < ?`
+		args = append(args, f.From, f.To)
+	}
+	stmt += ` ORDER BY d.dialog_id LIMIT ?`
+	args = append(args, limit)
+	rows, err := m.dB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := []transcript.Transcript{}
+	for rows.Next() {
+		t := transcript.Transcript{}
+		err = rows.Scan(&t.DialogID, &t.UserID, &t.UserName, &t.UserEmail,
+			&t.AgentID, &t.AgentName, &t.Started, &t.Ended)
+		if err != nil {
+			return nil, err
+		}
+		t.Open = t.Ended.Before(t.Started)
+		page = append(page, t)
+	}
+	return page, rows.Err()
+}
+
+//Messages returns the messages of a dialog, see transcript.Source.
+func (m *userModel) Messages(dialogID int) ([]transcript.Message, error) {
+	stmt := `SELECT created, IFNULL(sender, ''), message, sealed FROM messages
+	WHERE dialog_id = ? ORDER BY created, message_id`
+	rows, err := m.dB.Query(stmt, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	msgs := []transcript.Message{}
+	for rows.Next() {
+		var msg transcript.Message
+		var sealed []byte
+		err = rows.Scan(&msg.Created, &msg.Sender, &msg.Text, &sealed)
+		if err != nil {
+			return nil, err
+		}
+		msg.Text, err = m.openMessage(dialogID, msg.Text, sealed)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+//transcripts is the "transcripts" action, see broker.TranscriptsR.
+func (m *userModel) transcripts(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	page, err := m.Dialogs(transcript.Filter{DialogID: f.DialogID,
+		From: f.Created, To: f.Ended}, f.ID, f.Count)
+	if err != nil {
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	for _, t := range page {
+		e.Tables = append(e.Tables, broker.TableRow{DialogID: t.DialogID,
+			ID: t.UserID, Name: t.UserName, Email: t.UserEmail,
+			AgentID: t.AgentID, AgentName: t.AgentName, Created: t.Started,
+			Ended: t.Ended})
+	}
+	return nil
+}
+
+//transcriptMessages is the "transcriptMessages" action, see
+//broker.TranscriptMessagesR.
+func (m *userModel) transcriptMessages(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return errors.New("no dialog for the transcript messages")
+	}
+	msgs, err := m.Messages(e.Tables[0].DialogID)
+	if err != nil {
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	for _, msg := range msgs {
+		e.Tables = append(e.Tables, broker.TableRow{Created: msg.Created,
+			Sender: msg.Sender, Msg: msg.Text})
+	}
+	return nil
+}
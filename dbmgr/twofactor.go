@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//two-factor login is only for the admins table (super admins, admins and
+//agents), the table is checked before it goes into a statement.
+func totpTable(table string) error {
+	if table != "admins" {
+		return fmt.Errorf("no two-factor login for table %q", table)
+	}
+	return nil
+}
+
+//enableTOTP is the "enableTOTP" action, see broker.EnableTOTPR.  The first
+//row is the account, the others carry the recovery code hashes in Token.
+func (m *userModel) enableTOTP(e *broker.Exchange) error {
+	err := totpTable(e.Table)
+	if err != nil {
+		return err
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	a := e.Tables[0]
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE admins SET totp_secret = ?, totp_enabled = TRUE,
+	totp_step = ? WHERE id = ?`, a.TOTPSecret, a.TOTPStep, a.ID)
+	if err == nil {
+		err = replaceRecovery(tx, a.ID, e.Tables[1:])
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	return tx.Commit()
+}
+
+//resetTOTP is the "resetTOTP" action, see broker.ResetTOTPR.
+func (m *userModel) resetTOTP(e *broker.Exchange) error {
+	err := totpTable(e.Table)
+	if err != nil {
+		return err
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	id := e.Tables[0].ID
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE admins SET totp_secret = '', totp_enabled = FALSE,
+	totp_step = 0 WHERE id = ?`, id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recovery_codes WHERE account_id = ?", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	return tx.Commit()
+}
+
+//totpStep is the "totpStep" action, see broker.UseTOTPStepR.  The compare
+//and set is one statement so the same code cannot log in twice.
+func (m *userModel) totpStep(e *broker.Exchange) error {
+	err := totpTable(e.Table)
+	if err != nil {
+		return err
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	a := e.Tables[0]
+	result, err := m.dB.Exec(`UPDATE admins SET totp_step = ?
+	WHERE id = ? AND totp_enabled = TRUE AND totp_step < ?`, a.TOTPStep, a.ID,
+		a.TOTPStep)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return broker.ErrNoRecord
+	}
+	e.Tables = broker.TableRows{}
+	return nil
+}
+
+//useRecovery is the "useRecovery" action, see broker.UseRecoveryR.
+func (m *userModel) useRecovery(e *broker.Exchange) error {
+	err := totpTable(e.Table)
+	if err != nil {
+		return err
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	a := e.Tables[0]
+	result, err := m.dB.Exec(`UPDATE recovery_codes SET used = TRUE
+	WHERE account_id = ? AND code_hash = ? AND used = FALSE`, a.ID, a.Token)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return broker.ErrNoRecord
+	}
+	var left int
+	err = m.dB.QueryRow(`SELECT COUNT(*) FROM recovery_codes
+	WHERE account_id = ? AND used = FALSE`, a.ID).Scan(&left)
+	if err != nil {
+		return err
+	}
+	e.Tables = broker.TableRows{{ID: a.ID, Count: left}}
+	return nil
+}
+
+//newRecovery is the "newRecovery" action, see broker.NewRecoveryR.
+func (m *userModel) newRecovery(e *broker.Exchange) error {
+	err := totpTable(e.Table)
+	if err != nil {
+		return err
+	}
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	err = replaceRecovery(tx, e.Tables[0].ID, e.Tables[1:])
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	e.Tables = broker.TableRows{}
+	return tx.Commit()
+}
+
+//replaceRecovery deletes the recovery codes of the account and inserts the
+//hashes in the Token of the rows.
+func replaceRecovery(tx *sql.Tx, id int, rows broker.TableRows) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE account_id = ?", id)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (account_id, code_hash)
+		VALUES (?, ?)`, id, r.Token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//findUsers is the "findUsers" action, see broker.FindUsersR.
+func (m *userModel) findUsers(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	f := e.Tables[0]
+	like := escapeLike(f.Name) + "%"
+	stmt := `SELECT id, name, email, created, active, must_reset, verified FROM users
+	WHERE name LIKE ? OR email LIKE ? ORDER BY name, id LIMIT ?`
+	rows, err := m.dB.Query(stmt, like, like, f.Count)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e.Tables = broker.TableRows{}
+	for rows.Next() {
+		r := broker.TableRow{}
+		err = rows.Scan(&r.ID, &r.Name, &r.Email, &r.Created, &r.Active,
+			&r.MustReset, &r.Verified)
+		if err != nil {
+			return err
+		}
+		e.Tables = append(e.Tables, r)
+	}
+	return rows.Err()
+}
+
+//userDialogs is the "userDialogs" action, see broker.UserDialogsR.
+func (m *userModel) userDialogs(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	stmt := `SELECT d.dialog_id, d.started, d.ended, IFNULL(d.agent_id, 0),
+	IFNULL(a.name, ''), IF(d.ended < d.started, 'open', 'closed'),
+	(SELECT COUNT(*) FROM messages m WHERE m.dialog_id = d.dialog_id)
+	FROM dialogs d LEFT JOIN admins a ON a.id = d.agent_id
+	WHERE d.user_id = ? ORDER BY d.started DESC, d.dialog_id DESC`
+	rows, err := m.dB.Query(stmt, e.Tables[0].ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e.Tables = broker.TableRows{}
+	for rows.Next() {
+		r := broker.TableRow{}
+		err = rows.Scan(&r.DialogID, &r.Created, &r.Ended, &r.AgentID,
+			&r.AgentName, &r.State, &r.Count)
+		if err != nil {
+			return err
+		}
+		e.Tables = append(e.Tables, r)
+	}
+	return rows.Err()
+}
+
+//userActive is the "userActive" action, see broker.UserActiveR.  On
+//deactivation the user's open dialogs are ended and each frees one dialog of
+//its agent's capacity, as closeDialog does, all in one transaction.
+func (m *userModel) userActive(e *broker.Exchange) error {
+	if len(e.Tables) == 0 {
+		return broker.ErrNoRecord
+	}
+	u := e.Tables[0]
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	var n int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", u.ID).Scan(&n)
+	if err == nil && n == 0 {
+		err = broker.ErrNoRecord
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE users SET active = ? WHERE id = ?", u.Active, u.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	ended := 0
+	if !u.Active {
+		ended, err = endUserDialogs(tx, u.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	e.Tables = broker.TableRows{{ID: u.ID, Active: u.Active, Count: ended}}
+	return tx.Commit()
+}
+
+//endUserDialogs ends the open dialogs of a user and returns how many.
+func endUserDialogs(tx *sql.Tx, userID int) (int, error) {
+	stmt := `SELECT dialog_id, IFNULL(agent_id, 0) FROM dialogs
+	WHERE user_id = ? AND ended < started FOR UPDATE`
+	rows, err := tx.Query(stmt, userID)
+	if err != nil {
+		return 0, err
+	}
+	agents := []int{}
+	for rows.Next() {
+		var dialogID, agentID int
+		err = rows.Scan(&dialogID, &agentID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		agents = append(agents, agentID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, agentID := range agents {
+		if agentID == 0 {
+			continue
+		}
+		_, err = tx.Exec("UPDATE admins SET dialog = dialog - 1 WHERE id = ? AND dialog > 0",
+			agentID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec(`UPDATE dialogs SET ended = UTC_TIMESTAMP()
+	WHERE user_id = ? AND ended < started`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return len(agents), nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/config"
+	"github.com/saied74/toychat/pkg/vault"
+)
+
+//Owners of the data keys in the data_keys table (see dbscripts/vault.txt).
+const (
+	ownerDialog = "dialog" //one key per dialog, its messages are sealed with it
+	ownerIndex  = "index"  //the one key of the message terms, owner_id 0
+)
+
+//maxCachedKeys is how many unwrapped data keys are kept in memory.
+const maxCachedKeys = 1000
+
+//messageVault seals the message bodies, see pkg/vault.  The dbmgr runs
+//without one when it has no vault.keyfile and then stores them as they are.
+type messageVault struct {
+	keys  *vault.Keyring
+	mu    sync.Mutex
+	cache map[string][]byte //unwrapped data keys by keyContext
+}
+
+func newMessageVault(keyFile string) (*messageVault, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	keys, err := vault.Load(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &messageVault{keys: keys, cache: map[string][]byte{}}, nil
+}
+
+//keyContext is what the data key of the owner is wrapped against, so a
+//wrapped key moved to another row does not open.
+func keyContext(owner string, ownerID int) string {
+	return fmt.Sprintf("%s:%d", owner, ownerID)
+}
+
+//msgContext is what the messages of a dialog are sealed against.
+func msgContext(dialogID int) string {
+	return fmt.Sprintf("message:dialog:%d", dialogID)
+}
+
+//dataKey returns the data key of the owner, making it first when create is
+//set.  Two requests making the key at once both end up with the one stored
+//first.
+func (m *userModel) dataKey(owner string, ownerID int, create bool) ([]byte,
+	error) {
+	v := m.vault
+	ctx := keyContext(owner, ownerID)
+	v.mu.Lock()
+	key, ok := v.cache[ctx]
+	v.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	stmt := `SELECT key_id, wrapped FROM data_keys WHERE owner = ? AND owner_id = ?`
+	var keyID string
+	var wrapped []byte
+	err := m.dB.QueryRow(stmt, owner, ownerID).Scan(&keyID, &wrapped)
+	if errors.Is(err, sql.ErrNoRows) && create {
+		key, err = vault.NewKey()
+		if err != nil {
+			return nil, err
+		}
+		keyID, wrapped, err = v.keys.Wrap(key, ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, err = m.dB.Exec(`INSERT IGNORE INTO data_keys
+		(owner, owner_id, key_id, wrapped, created)
+		VALUES (?, ?, ?, ?, UTC_TIMESTAMP())`, owner, ownerID, keyID, wrapped)
+		if err != nil {
+			return nil, err
+		}
+		err = m.dB.QueryRow(stmt, owner, ownerID).Scan(&keyID, &wrapped)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no data key for %s", ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err = v.keys.Unwrap(keyID, wrapped, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("data key of %s: %v", ctx, err)
+	}
+	v.mu.Lock()
+	if len(v.cache) >= maxCachedKeys {
+		v.cache = map[string][]byte{}
+	}
+	v.cache[ctx] = key
+	v.mu.Unlock()
+	return key, nil
+}
+
+//insertMessages seals the messages of the insert action and stores them with
+//the hashes of their words.  The columns are those of broker.EnterMsg.
+func (m *userModel) insertMessages(e *broker.Exchange) error {
+	index, err := m.dataKey(ownerIndex, 0, true)
+	if err != nil {
+		return err
+	}
+	for _, msg := range e.Tables {
+		key, err := m.dataKey(ownerDialog, msg.DialogID, true)
+		if err != nil {
+			return err
+		}
+		sealed, err := vault.Seal(key, []byte(msg.Msg), msgContext(msg.DialogID))
+		if err != nil {
+			return err
+		}
+		tx, err := m.dB.Begin()
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`INSERT INTO messages
+		(dialog_id, created, sender, message, sealed)
+		VALUES (?, UTC_TIMESTAMP(), ?, '', ?)`, msg.DialogID, msg.Sender, sealed)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, term := range vault.Terms(index, msg.Msg) {
+			_, err = tx.Exec(`INSERT INTO message_terms (term, message_id)
+			VALUES (?, ?)`, term, id)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//openMessage is the text of a message row, message for a row stored as it is
+//and the opened sealed for a sealed one.
+func (m *userModel) openMessage(dialogID int, message string,
+	sealed []byte) (string, error) {
+	if sealed == nil {
+		return message, nil
+	}
+	if m.vault == nil {
+		return "", errors.New("a sealed message and no vault.keyfile")
+	}
+	key, err := m.dataKey(ownerDialog, dialogID, false)
+	if err != nil {
+		return "", err
+	}
+	text, err := vault.Open(key, sealed, msgContext(dialogID))
+	if err != nil {
+		return "", fmt.Errorf("message of dialog %d: %v", dialogID, err)
+	}
+	return string(text), nil
+}
+
+//termMatch is the condition of the sealed messages with all the words of
+//text and its arguments, nothing without a vault.
+func (m *userModel) termMatch(text string) (string, []interface{}, error) {
+	if m.vault == nil {
+		return "", nil, nil
+	}
+	index, err := m.dataKey(ownerIndex, 0, true)
+	if err != nil {
+		return "", nil, err
+	}
+	terms := vault.Terms(index, text)
+	if len(terms) == 0 {
+		return "", nil, nil
+	}
+	args := []interface{}{}
+	for _, t := range terms {
+		args = append(args, t)
+	}
+	args = append(args, len(terms))
+	return `m.message_id IN (SELECT message_id FROM message_terms
+	WHERE term IN (?` + strings.Repeat(", ?", len(terms)-1) + `)
+	GROUP BY message_id HAVING COUNT(*) = ?)`, args, nil
+}
+
+//rekey wraps the data keys not wrapped by the current master key with it and
+//returns how many it did.
+func (m *userModel) rekey() (int, error) {
+	v := m.vault
+	rows, err := m.dB.Query(`SELECT owner, owner_id, key_id, wrapped
+	FROM data_keys WHERE key_id <> ?`, v.keys.Current())
+	if err != nil {
+		return 0, err
+	}
+	type dataKey struct {
+		owner   string
+		ownerID int
+		keyID   string
+		wrapped []byte
+	}
+	old := []dataKey{}
+	for rows.Next() {
+		k := dataKey{}
+		err = rows.Scan(&k.owner, &k.ownerID, &k.keyID, &k.wrapped)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		old = append(old, k)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range old {
+		keyID, wrapped, err := v.keys.Rewrap(k.keyID, k.wrapped,
+			keyContext(k.owner, k.ownerID))
+		if err != nil {
+			return n, fmt.Errorf("%s %d: %v", k.owner, k.ownerID, err)
+		}
+		//only if nobody rewrapped it in the meantime.
+		_, err = m.dB.Exec(`UPDATE data_keys SET key_id = ?, wrapped = ?
+		WHERE owner = ? AND owner_id = ? AND key_id = ?`, keyID, wrapped,
+			k.owner, k.ownerID, k.keyID)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+//sealOld seals the messages stored before the vault, a batch at a time, and
+//returns how many it did.  Anonymised messages are left as they are.
+func (m *userModel) sealOld(batch int) (int, error) {
+	n := 0
+	for {
+		rows, err := m.dB.Query(`SELECT message_id, dialog_id, message
+		FROM messages WHERE sealed IS NULL AND message NOT IN ('', ?)
+		ORDER BY message_id LIMIT ?`, anonymous, batch)
+		if err != nil {
+			return n, err
+		}
+		msgs := broker.TableRows{}
+		for rows.Next() {
+			msg := broker.TableRow{}
+			err = rows.Scan(&msg.MessageID, &msg.DialogID, &msg.Msg)
+			if err != nil {
+				rows.Close()
+				return n, err
+			}
+			msgs = append(msgs, msg)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return n, err
+		}
+		if len(msgs) == 0 {
+			return n, nil
+		}
+		index, err := m.dataKey(ownerIndex, 0, true)
+		if err != nil {
+			return n, err
+		}
+		for _, msg := range msgs {
+			err = m.sealMessage(index, &msg)
+			if err != nil {
+				return n, fmt.Errorf("message %d: %v", msg.MessageID, err)
+			}
+			n++
+		}
+	}
+}
+
+func (m *userModel) sealMessage(index []byte, msg *broker.TableRow) error {
+	key, err := m.dataKey(ownerDialog, msg.DialogID, true)
+	if err != nil {
+		return err
+	}
+	sealed, err := vault.Seal(key, []byte(msg.Msg), msgContext(msg.DialogID))
+	if err != nil {
+		return err
+	}
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE messages SET message = '', sealed = ?
+	WHERE message_id = ?`, sealed, msg.MessageID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, term := range vault.Terms(index, msg.Msg) {
+		_, err = tx.Exec(`INSERT IGNORE INTO message_terms (term, message_id)
+		VALUES (?, ?)`, term, msg.MessageID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//rekeyCmd is the rekey subcommand, run after a new master key is put first in
+//the key file.  "dbmgr rekey" wraps the data keys with it, after which the old
+//key can be taken out of the file, and with -seal it also encrypts the
+//messages stored before the vault.
+func rekeyCmd(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	configFile := config.FileFlag(fs)
+	seal := fs.Bool("seal", false, "also encrypt the messages stored unencrypted")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load("dbmgr", *configFile)
+	if err != nil {
+		return err
+	}
+	m, err := newUserModel(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.dB.Close()
+	if m.vault == nil {
+		return errors.New("rekey needs vault.keyfile")
+	}
+	n, err := m.rekey()
+	fmt.Printf("%d data keys wrapped with %s\n", n, m.vault.keys.Current())
+	if err != nil {
+		return err
+	}
+	detail := fmt.Sprintf("%d data keys wrapped with %s", n, m.vault.keys.Current())
+	if *seal {
+		sealed, err := m.sealOld(500)
+		fmt.Printf("%d messages encrypted\n", sealed)
+		if err != nil {
+			return err
+		}
+		detail += fmt.Sprintf(", %d messages encrypted", sealed)
+	}
+	return m.auditSystem(broker.ActorCLI, broker.AuditRekey, 0, "", detail)
+}
+
+//keygenCmd is the keygen subcommand, it prints a key file line with a new
+//master key.
+func keygenCmd(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	id := fs.String("id", time.Now().UTC().Format("2006-01-02"),
+		"id of the key, without spaces")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *id == "" || strings.ContainsAny(*id, " \t") {
+		return fmt.Errorf("bad key id %q", *id)
+	}
+	line, err := vault.NewKeyLine(*id)
+	if err != nil {
+		return err
+	}
+	fmt.Println(line)
+	return nil
+}
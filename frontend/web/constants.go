@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"time"
 )
 
 //constants used in the handlers in place of the strings to avoid typing mistakes
@@ -12,7 +13,22 @@ const (
 	signup              = "signup"
 	chat                = "chat"
 	mat                 = "mat"
+	survey              = "survey"
+	chgPwd              = "chgPwd"
+	chgPwdPath          = "/changePassword"
+	forgot              = "forgot"
+	forgotPath          = "/forgot"
+	reset               = "reset"
+	resetPath           = "/reset"
+	verifyPage          = "verify"
+	verifyPath          = "/verify"
+	verifyTTL           = 24 * time.Hour //email verification links
+	lockedMsg           = "Too many failed logins, please try again later"
+	waitingMsg          = "All our agents are busy, one will be with you shortly"
+	sessionsPage        = "sessions"
+	sessionsPath        = "/sessions"
 	authenticatedUserID = "authenticatedUserID"
+	sessionIDKey        = "sessionID" //id of the session in the session index
 )
 
 var allTmplFiles = map[string][]string{
@@ -38,8 +54,28 @@ var allTmplFiles = map[string][]string{
 		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/mat.tmpl"),
 		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/playmat.tmpl"),
 	},
+	"survey": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/survey.tmpl"),
+	},
+	"chgPwd": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/chgpwd.tmpl"),
+	},
+	"forgot": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/forgot.tmpl"),
+	},
+	"reset": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/reset.tmpl"),
+	},
+	"verify": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/verify.tmpl"),
+	},
+	"sessions": []string{
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/base.tmpl"),
+		filepath.Join(os.Getenv("GOPATH"), "src/toychat/frontend/views/sessions.tmpl"),
+	},
 }
-
-//Self signed keys.  Works on Safari on Mac, Chrome constantly complains
-var serverKey = filepath.Join(os.Getenv("GOPATH"), "src/toychat/certs/https-server.key")
-var serverCrt = filepath.Join(os.Getenv("GOPATH"), "src/toychat/certs/https-server.crt")
@@ -17,13 +17,16 @@ handled:
 4. Check to see if one exists and if an agent is allocated
 5. If dialog does not exist, use broker.MakeDialog to make one.
 6. If agent does not assigned or it is a new dialog ask for agent.
-7. This is done by calling broker.SelectAgent.
+7. This is done by calling broker.SelectAgent.  With no agent available the
+dialog is made without one (queued), the message is stored and the user gets
+a waiting message, the next message asks for an agent again.
 8. After the agent is selected, the dialog table by calling broker.UpdateDialog
 9.// TODO: max agent, agent sill and that stuff needs work in the future.
 10. Once dialog exists and agent is assigned, store message using broker.StoreMsg
-11. Send message to "Agent-"+AgentID
-11. Messages are sent via broker.SendMsg, wait for reply.
-12. Send reply back through the Ajax interface.
+11. broker.ForwardR sends the messages the agent has not answered, the ones
+queued before the agent was assigned and this one, to the agent in order
+(broker.MessageAgent) and stores each reply as an agent message.
+12. Send the replies back through the Ajax interface.
 
 */
 
@@ -4,11 +4,16 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	//broker pkg contains the code that is used on both sides of the nats connectoin.
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
 	"github.com/saied74/toychat/pkg/forms"
+	"github.com/saied74/toychat/pkg/mailer"
+	"github.com/saied74/toychat/pkg/verify"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -18,6 +23,7 @@ import (
 
 //much of the commmon work is done in render, addDefaultData and middlewares
 func (st *sT) homeHandler(w http.ResponseWriter, r *http.Request) {
+	st = st.initTD()
 	st.render(w, r, home)
 }
 
@@ -31,6 +37,7 @@ func (st *sT) loginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 
 	case "GET":
+		st = st.initTD()
 		st.render(w, r, login)
 
 	case "POST":
@@ -41,13 +48,25 @@ func (st *sT) loginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		Form := forms.NewForm(r.PostForm)
-		st.initTD()
+		st = st.initTD()
 		//authenticateUserR R stands for remote sends the data to the dbmgr over
 		//the nats connectoin to be validated.
-		person, err := broker.AuthenticateEUR("users", Form.GetField("email"))
+		email := Form.GetField("email")
+		locked, err := st.loginLocked(r, email)
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		if locked {
+			st.td.Form.Errors.AddError("generic", lockedMsg)
+			st.render(w, r, login)
+			return
+		}
+		person, err := broker.AuthenticateEUR("users", email)
 		log.Printf("AuthEUR: %v", person)
 		if err != nil {
 			if errors.Is(err, broker.ErrNoRecord) {
+				st.loginFailed(r, 0, email, "no such account")
 				st.td.Form.Errors.AddError("generic", "Email or Password is incorrect")
 				st.render(w, r, login)
 			} else {
@@ -57,6 +76,7 @@ func (st *sT) loginHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		hashedPassword := person.HashedPassword
 		if len(hashedPassword) != 60 {
+			st.loginFailed(r, person.ID, email, "no password")
 			st.td.Form.Errors.AddError("generic", "No such a record was found")
 			st.render(w, r, login)
 			return
@@ -65,6 +85,7 @@ func (st *sT) loginHandler(w http.ResponseWriter, r *http.Request) {
 			[]byte(Form.GetField("password")))
 		if err != nil {
 			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				st.loginFailed(r, person.ID, email, "wrong password")
 				st.td.Form.Errors.AddError("generic", "Email or Password is incorrect")
 				st.render(w, r, login)
 			} else {
@@ -72,10 +93,43 @@ func (st *sT) loginHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		//a user deactivated by an admin cannot log in anymore.
+		if !person.Active {
+			st.audit(r, broker.AuditLoginFailed, person.ID, email, "inactive")
+			st.td.Form.Errors.AddError("generic", "This account is disabled")
+			st.render(w, r, login)
+			return
+		}
+		if st.requireVerified && !person.Verified {
+			st.audit(r, broker.AuditLoginFailed, person.ID, email, "unverified")
+			st.td.Form.Errors.AddError("generic",
+				"Please confirm your email address with the link we mailed to you")
+			st.td.Unverified = true
+			st.render(w, r, login)
+			return
+		}
 		// st.td.Form = Form
+		sid, err := broker.StartSessionR("users", person.ID, clientIP(r),
+			r.UserAgent())
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
 		//RenewToken is used for security purpose for each state change.
 		st.sessionManager.RenewToken(r.Context())
 		st.sessionManager.Put(r.Context(), authenticatedUserID, person.ID)
+		st.sessionManager.Put(r.Context(), sessionIDKey, sid)
+		st.audit(r, broker.AuditLogin, person.ID, email, "")
+		err = broker.LoginSucceededR("users", email)
+		if err != nil {
+			centerr.ErrorLog.Printf("login failure reset %v", err)
+		}
+		if person.MustReset {
+			st.sessionManager.Put(r.Context(), "flash",
+				"Your password was reset, please choose a new one")
+			http.Redirect(w, r, chgPwdPath, http.StatusSeeOther)
+			return
+		}
 		http.Redirect(w, r, home, http.StatusSeeOther)
 
 	default:
@@ -97,6 +151,7 @@ func (st *sT) signupHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 
 	case "GET":
+		st = st.initTD()
 		st.render(w, r, signup)
 
 	case "POST":
@@ -105,6 +160,8 @@ func (st *sT) signupHandler(w http.ResponseWriter, r *http.Request) {
 			st.clientError(w, http.StatusBadRequest, err)
 		}
 		Form := forms.NewForm(r.PostForm)
+		st = st.initTD()
+		st.td.Form = Form
 		Form.FieldRequired("name", "email", "password")
 		Form.MaxLength("name", 255)
 		Form.MaxLength("email", 255)
@@ -135,9 +192,19 @@ func (st *sT) signupHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		flash := "Your signup was successful, pleaselogin"
+		if st.requireVerified {
+			person, err := broker.AuthenticateEUR("users", Form.GetField("email"))
+			if err != nil {
+				st.serverError(w, err)
+				return
+			}
+			st.mailVerify(person)
+			flash = "Your signup was successful, please confirm your email address with the link we mailed to you"
+		}
 		//RenewToken is used for security purpose for each state change.
 		st.sessionManager.RenewToken(r.Context())
-		st.sessionManager.Put(r.Context(), "flash", "Your signup was successful, pleaselogin")
+		st.sessionManager.Put(r.Context(), "flash", flash)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 
 	default:
@@ -149,23 +216,457 @@ func (st *sT) signupHandler(w http.ResponseWriter, r *http.Request) {
 //============================== Log Out ======================================
 
 func (st *sT) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	err := broker.EndSessionR("users", st.sessionManager.GetString(r.Context(),
+		sessionIDKey))
+	if err != nil {
+		centerr.ErrorLog.Printf("logout session index %v", err)
+	}
 	//RenewToken is used for security purpose for each state change.
 	st.sessionManager.RenewToken(r.Context())
 	st.sessionManager.Remove(r.Context(), authenticatedUserID)
+	st.sessionManager.Remove(r.Context(), sessionIDKey)
 	http.Redirect(w, r, "/home", http.StatusSeeOther)
 }
 
+//=========================== Change Password =================================
+
+//the logged in user changes the password, which also clears a reset by an
+//admin.  Until then the authenticate middleware sends the user here.
+func (st *sT) chgPwdHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != chgPwdPath {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+
+	case "GET":
+		st = st.initTD()
+		st.render(w, r, chgPwd)
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			st.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		Form := forms.NewForm(r.PostForm)
+		st = st.initTD()
+		st.td.Form = Form
+		Form.FieldRequired("password", "newPassword")
+		Form.MinLength("newPassword", 10)
+		if !Form.Valid() {
+			st.render(w, r, chgPwd)
+			return
+		}
+		id := st.sessionManager.GetInt(r.Context(), authenticatedUserID)
+		person, err := broker.GetEUR("users", id)
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		err = bcrypt.CompareHashAndPassword([]byte(person.HashedPassword),
+			[]byte(Form.GetField("password")))
+		if err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				Form.Errors.AddError("password", "Password is incorrect")
+				st.render(w, r, chgPwd)
+			} else {
+				st.serverError(w, err)
+			}
+			return
+		}
+		hashed, err := bcrypt.GenerateFromPassword([]byte(Form.GetField("newPassword")), 12)
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		err = broker.ChgUserPwdR(id, string(hashed))
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		st.audit(r, broker.AuditPassword, person.ID, person.Email, "")
+		//the other sessions may be someone who has the old password.
+		err = broker.RevokeSessionsR("users", id,
+			st.sessionManager.GetString(r.Context(), sessionIDKey))
+		if err != nil {
+			centerr.ErrorLog.Printf("revoke sessions of %d: %v", id, err)
+		}
+		//RenewToken is used for security purpose for each state change.
+		st.sessionManager.RenewToken(r.Context())
+		st.sessionManager.Put(r.Context(), "flash", "Your password was changed")
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================== Sessions =====================================
+
+//lists the sessions of the logged in user, the POST op is revoke (the session
+//with the id) or others (all but this one).
+func (st *sT) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != sessionsPath {
+		http.NotFound(w, r)
+		return
+	}
+	id := st.sessionManager.GetInt(r.Context(), authenticatedUserID)
+	sid := st.sessionManager.GetString(r.Context(), sessionIDKey)
+	switch r.Method {
+
+	case "GET":
+		st = st.initTD()
+		sessions, err := broker.SessionsR("users", id, sid)
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		st.td.Sessions = &sessions
+		st.render(w, r, sessionsPage)
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			st.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		flash := ""
+		switch r.PostForm.Get("op") {
+		case "revoke":
+			n, err := strconv.Atoi(r.PostForm.Get("id"))
+			if err != nil {
+				st.clientError(w, http.StatusBadRequest, err)
+				return
+			}
+			err = broker.RevokeSessionR("users", id, n)
+			if errors.Is(err, broker.ErrNoRecord) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				st.serverError(w, err)
+				return
+			}
+			st.audit(r, broker.AuditRevoke, id, "", "session "+strconv.Itoa(n))
+			flash = "The session was logged out"
+		case "others":
+			err = broker.RevokeSessionsR("users", id, sid)
+			if err != nil {
+				st.serverError(w, err)
+				return
+			}
+			st.audit(r, broker.AuditRevoke, id, "", "all other sessions")
+			flash = "All your other sessions were logged out"
+		default:
+			st.clientError(w, http.StatusBadRequest,
+				errors.New("unknown sessions op "+r.PostForm.Get("op")))
+			return
+		}
+		st.sessionManager.Put(r.Context(), "flash", flash)
+		http.Redirect(w, r, sessionsPath, http.StatusSeeOther)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//=========================== Forgot Password =================================
+
+//mails a password reset link to an active user.  The answer is the same
+//whether or not there is such a user so the page does not give away addresses.
+func (st *sT) forgotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != forgotPath {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+
+	case "GET":
+		st = st.initTD()
+		st.render(w, r, forgot)
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			st.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		Form := forms.NewForm(r.PostForm)
+		st = st.initTD()
+		st.td.Form = Form
+		Form.FieldRequired("email")
+		Form.MaxLength("email", 255)
+		Form.MatchPattern("email", forms.EmailRX)
+		if !Form.Valid() {
+			st.render(w, r, forgot)
+			return
+		}
+		email := Form.GetField("email")
+		person, err := broker.AuthenticateEUR("users", email)
+		switch {
+		case errors.Is(err, broker.ErrNoRecord):
+			st.audit(r, broker.AuditForgot, 0, email, "no such account")
+		case err != nil:
+			st.serverError(w, err)
+			return
+		case !person.Active:
+			st.audit(r, broker.AuditForgot, person.ID, email, "inactive")
+		default:
+			err = st.mailReset(person)
+			if err != nil {
+				st.serverError(w, err)
+				return
+			}
+			st.audit(r, broker.AuditForgot, person.ID, email, "link mailed")
+		}
+		st.sessionManager.Put(r.Context(), "flash",
+			"If the address has an account, a link to reset the password was mailed to it")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//records a new reset token for the user and mails the link in the background
+//so a slow mail server does not hold up the answer.
+func (st *sT) mailReset(person *broker.TableRow) error {
+	token, hash, err := broker.NewToken()
+	if err != nil {
+		return err
+	}
+	err = broker.CreateResetR("users", person.ID, hash,
+		time.Now().Add(broker.ResetTTL))
+	if err != nil {
+		return err
+	}
+	body := mailer.ResetBody(person.Name, st.baseURL+resetPath+"?token="+token,
+		broker.ResetTTL)
+	go func() {
+		err := st.mailer.Send(person.Email, "Password reset", body)
+		if err != nil {
+			centerr.ErrorLog.Printf("reset mail to %s %v", person.Email, err)
+		}
+	}()
+	return nil
+}
+
+//=========================== Reset Password ==================================
+
+//sets a new password with the token of a mailed reset link.
+func (st *sT) resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != resetPath {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+
+	case "GET":
+		st = st.initTD()
+		st.td.Token = r.URL.Query().Get("token")
+		if st.td.Token == "" {
+			http.Redirect(w, r, forgotPath, http.StatusSeeOther)
+			return
+		}
+		st.render(w, r, reset)
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			st.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		Form := forms.NewForm(r.PostForm)
+		st = st.initTD()
+		st.td.Form = Form
+		st.td.Token = Form.GetField("token")
+		Form.FieldRequired("token", "password")
+		Form.MinLength("password", 10)
+		if !Form.Valid() {
+			st.render(w, r, reset)
+			return
+		}
+		hashed, err := bcrypt.GenerateFromPassword([]byte(Form.GetField("password")), 12)
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		person, err := broker.UseResetR("users", broker.HashToken(st.td.Token),
+			string(hashed))
+		if errors.Is(err, broker.ErrNoRecord) {
+			Form.Errors.AddError("generic",
+				"The link is not valid or has expired, please ask for a new one")
+			st.render(w, r, reset)
+			return
+		}
+		if err == nil {
+			err = broker.RevokeSessionsR("users", person.ID, "")
+		}
+		if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		st.audit(r, broker.AuditPassword, person.ID, person.Email, "reset link")
+		//RenewToken is used for security purpose for each state change.
+		st.sessionManager.RenewToken(r.Context())
+		st.sessionManager.Put(r.Context(), "flash",
+			"Your password was reset, please log in")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//============================ Verify Email ===================================
+
+//GET with the token of a mailed link confirms the email address, without a
+//token or with a bad one it shows the form to ask for a new link.  The POST of
+//that form mails a new link to an unconfirmed address, the answer is the same
+//whether or not there is such a user.
+func (st *sT) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != verifyPath || st.verify == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+
+	case "GET":
+		st = st.initTD()
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			st.render(w, r, verifyPage)
+			return
+		}
+		person, err := st.verifyToken(token)
+		if err != nil {
+			switch {
+			case errors.Is(err, verify.ErrExpired):
+				st.td.Form.Errors.AddError("generic",
+					"The link has expired, please ask for a new one")
+			case errors.Is(err, verify.ErrInvalid):
+				st.td.Form.Errors.AddError("generic",
+					"The link is not valid, please ask for a new one")
+			default:
+				st.serverError(w, err)
+				return
+			}
+			st.render(w, r, verifyPage)
+			return
+		}
+		if !person.Verified {
+			err = broker.VerifyUserR(person.ID)
+			if err != nil {
+				st.serverError(w, err)
+				return
+			}
+			st.audit(r, broker.AuditVerify, person.ID, person.Email, "")
+		}
+		st.sessionManager.Put(r.Context(), "flash",
+			"Your email address is confirmed, please log in")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			st.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		Form := forms.NewForm(r.PostForm)
+		st = st.initTD()
+		st.td.Form = Form
+		Form.FieldRequired("email")
+		Form.MaxLength("email", 255)
+		Form.MatchPattern("email", forms.EmailRX)
+		if !Form.Valid() {
+			st.render(w, r, verifyPage)
+			return
+		}
+		person, err := broker.AuthenticateEUR("users", Form.GetField("email"))
+		if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+			st.serverError(w, err)
+			return
+		}
+		if err == nil && person.Active && !person.Verified {
+			st.mailVerify(person)
+		}
+		st.sessionManager.Put(r.Context(), "flash",
+			"If the address is waiting to be confirmed, a new link was mailed to it")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
+//returns the user of a verification token if it is good,
+//verify.ErrInvalid or verify.ErrExpired if it is not.
+func (st *sT) verifyToken(token string) (*broker.TableRow, error) {
+	id, err := verify.UserID(token)
+	if err != nil {
+		return nil, err
+	}
+	person, err := broker.GetEUR("users", id)
+	if errors.Is(err, broker.ErrNoRecord) {
+		return nil, verify.ErrInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = st.verify.Check(token, person.Email, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return person, nil
+}
+
+//mails the user a signed link to confirm the email address, in the
+//background so a slow mail server does not hold up the answer.
+func (st *sT) mailVerify(person *broker.TableRow) {
+	token := st.verify.Sign(person.ID, person.Email, time.Now())
+	body := mailer.VerifyBody(person.Name, st.baseURL+verifyPath+"?token="+token,
+		verifyTTL)
+	go func() {
+		err := st.mailer.Send(person.Email, "Please confirm your email address", body)
+		if err != nil {
+			centerr.ErrorLog.Printf("verify mail to %s %v", person.Email, err)
+		}
+	}()
+}
+
 //=============================== Chat ======================================
 
 //for chatValue and matHandler, the work is done in thier Ajax handlers
 //below wch are playHandler (for chatHandler) and playMatHandler for matHandler
 func (st *sT) chatHandler(w http.ResponseWriter, r *http.Request) {
+	st = st.initTD()
+	enabled, err := broker.GetSettingBoolR(broker.SettingSurveyEnabled)
+	if err != nil {
+		st.serverError(w, err)
+		return
+	}
+	if enabled {
+		id := st.sessionManager.GetInt(r.Context(), authenticatedUserID)
+		_, err = broker.PendingSurveyR(id)
+		if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+			st.serverError(w, err)
+			return
+		}
+		st.td.SurveyPending = err == nil
+	}
 	st.render(w, r, chat)
 }
 
 //=============================== Mat ======================================
 
 func (st *sT) matHandler(w http.ResponseWriter, r *http.Request) {
+	st = st.initTD()
 	st.render(w, r, mat)
 }
 
@@ -192,22 +693,24 @@ func (st *sT) playHandler(w http.ResponseWriter, r *http.Request) {
 
 			//<---------- If no dialog record, get agent ---------------->
 			if errors.Is(err, broker.ErrNoRecord) { //&& dialog.AgentID != 0 {
-				agentID, err2 := broker.SelectAgent() // TODO: no record found is not cared for
+				var err2 error
+				agentID, err2 = selectAgent()
 				if err2 != nil {
 					st.serverError(w, err2)
 					return
 				}
-				// <------------ with agentID and user ID, make dialog ----------->
+				// <------- with agentID (0 queues it) and user ID, make dialog ------->
 				err2 = broker.MakeDialog("dialogs", id, agentID)
 				if err2 != nil {
 					st.serverError(w, err2)
 					return
 				}
 				dialog, err := broker.GetDialog("dialogs", id)
-				dialogID = dialog.DialogID
 				if err != nil {
 					st.serverError(w, err)
+					return
 				}
+				dialogID = dialog.DialogID
 			} else {
 				st.serverError(w, err)
 				return
@@ -216,20 +719,133 @@ func (st *sT) playHandler(w http.ResponseWriter, r *http.Request) {
 			dialogID = dialog.DialogID
 			agentID = dialog.AgentID
 		}
-		err = broker.EnterMsg("messages", dialogID, msg)
+		//<---- queued and requeued dialogs have no agent, pick a new one ---->
+		if agentID == 0 {
+			agentID, err = selectAgent()
+			if err != nil {
+				st.serverError(w, err)
+				return
+			}
+			if agentID != 0 {
+				err = broker.AddAgentToDialog(dialogID, agentID)
+				if err != nil {
+					st.serverError(w, err)
+					return
+				}
+			}
+		}
+		err = broker.EnterMsg("messages", dialogID, broker.SenderUser, msg)
 		if err != nil {
 			st.serverError(w, err)
+			return
 		}
-		reply, err := broker.MessageAgent(agentID, id, msg)
+		//<------ still queued, the message waits in the dialog for the agent ------>
+		if agentID == 0 {
+			w.Write([]byte(waitingMsg))
+			return
+		}
+		//<---- the agent gets the queued messages with this one, in order ---->
+		replies, err := broker.ForwardR(dialogID, agentID, id)
 		if err != nil {
 			st.serverError(w, err)
+			return
 		}
-		w.Write([]byte(reply))
+		w.Write([]byte(strings.Join(replies, "\n")))
 		return
 	}
 	return
 }
 
+//selectAgent is broker.SelectAgent with no agent available (all of them busy,
+//away or offline) returned as agent 0 and not as an error, the dialog is then
+//queued until one is free.
+func selectAgent() (int, error) {
+	agentID, err := broker.SelectAgent()
+	if errors.Is(err, broker.ErrNoRecord) {
+		return 0, nil
+	}
+	return agentID, err
+}
+
+//============================= Survey ========================================
+
+//The survey is offered for the user's last closed dialog.  The kind (CSAT or
+//NPS) and the question are read from the settings table.
+func (st *sT) surveyHandler(w http.ResponseWriter, r *http.Request) {
+	st = st.initTD()
+	id := st.sessionManager.GetInt(r.Context(), authenticatedUserID)
+	enabled, err := broker.GetSettingBoolR(broker.SettingSurveyEnabled)
+	if err != nil {
+		st.serverError(w, err)
+		return
+	}
+	if !enabled {
+		http.NotFound(w, r)
+		return
+	}
+	kind, err := broker.GetSettingR(broker.SettingSurveyKind)
+	if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+		st.serverError(w, err)
+		return
+	}
+	if kind != broker.NPS {
+		kind = broker.CSAT
+	}
+	st.td.Question, err = broker.GetSettingR(broker.SettingSurveyQuestion)
+	if err != nil && !errors.Is(err, broker.ErrNoRecord) {
+		st.serverError(w, err)
+		return
+	}
+	min, max := broker.RatingRange(kind)
+	for i := min; i <= max; i++ {
+		st.td.Ratings = append(st.td.Ratings, i)
+	}
+	pending, err := broker.PendingSurveyR(id)
+	if err != nil {
+		if !errors.Is(err, broker.ErrNoRecord) {
+			st.serverError(w, err)
+			return
+		}
+		pending = nil
+	}
+	st.td.Survey = pending
+
+	switch r.Method {
+	case "GET":
+		st.render(w, r, survey)
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			st.clientError(w, http.StatusBadRequest, err)
+			return
+		}
+		st.td.Form = forms.NewForm(r.PostForm)
+		st.td.Form.FieldRequired("dialog", "rating")
+		st.td.Form.IntRange("rating", min, max)
+		st.td.Form.MaxLength("comment", 1000)
+		if pending == nil ||
+			st.td.Form.GetField("dialog") != strconv.Itoa(pending.DialogID) {
+			st.td.Form.Errors.AddError("generic", "This conversation cannot be rated")
+		}
+		if !st.td.Form.Valid() {
+			st.render(w, r, survey)
+			return
+		}
+		rating, _ := strconv.Atoi(st.td.Form.GetField("rating"))
+		err = broker.InsertSurveyR(pending.DialogID, pending.AgentID, id, kind,
+			rating, st.td.Form.GetField("comment"))
+		if err != nil && !errors.Is(err, broker.ErrDuplicate) {
+			st.serverError(w, err)
+			return
+		}
+		st.sessionManager.Put(r.Context(), "flash", "Thank you for your feedback")
+		http.Redirect(w, r, "/chat", http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
+	}
+}
+
 //============================= Play (mat) ====================================
 
 func (st *sT) playMatHandler(w http.ResponseWriter, r *http.Request) {
@@ -240,7 +856,7 @@ func (st *sT) playMatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	value, ok := r.Form["value"]
 	if ok {
-		matValue := st.chatConnection(value[0], "forMat", "fromMat")
+		matValue := st.chatConnection(value[0], st.matSubject, "fromMat")
 		w.Write(matValue)
 	}
 }
@@ -4,16 +4,18 @@ import (
 	"bytes"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime/debug"
 	"time"
 
 	"github.com/justinas/nosurf"
-	"github.com/nats-io/nats.go"
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
 	"github.com/saied74/toychat/pkg/forms"
+	"github.com/saied74/toychat/pkg/secure"
+	"github.com/saied74/toychat/pkg/throttle"
 )
 
 //consolidated screen error reporting.  Once the chat manager application
@@ -33,13 +35,17 @@ func (st *sT) clientError(w http.ResponseWriter, status int, err error) {
 	http.Error(w, http.StatusText(status), status)
 }
 
-func (st *sT) initTD() {
-	st.td = &templateData{
+//initTD returns the sT a request is served with: a copy of the shared sT with
+//its own template data, so concurrent requests never see each other's forms.
+func (st *sT) initTD() *sT {
+	rq := *st
+	rq.td = &templateData{
 		Form: &forms.FormData{
 			Fields: url.Values{},
 			Errors: forms.ErrOrs{},
 		},
 	}
+	return &rq
 }
 
 //templates are cashed by name to avoid repeated disk access.
@@ -79,6 +85,7 @@ func (st *sT) addDefaultData(td *templateData, r *http.Request) (*templateData,
 		td.UserName = string(usr.Name)
 	}
 	td.CSRFToken = nosurf.Token(r)
+	td.Nonce = secure.Nonce(r)
 	return td, nil
 }
 
@@ -106,12 +113,13 @@ func (st *sT) render(w http.ResponseWriter, r *http.Request, name string) {
 func (st *sT) chatConnection(matValue, forCM, fromCM string) []byte {
 	var err error
 
-	nc1, err := nats.Connect(nats.DefaultURL)
+	nc1, err := broker.Connect()
 	if err != nil {
 		centerr.ErrorLog.Printf("in chatConnection connecting error %v", err)
+		return []byte{}
 	}
 	defer nc1.Close()
-	msg, err := nc1.Request(forCM, []byte(matValue), 2*time.Second)
+	msg, err := broker.Request(nc1, forCM, []byte(matValue), 2*time.Second)
 	if err != nil {
 		centerr.ErrorLog.Printf("in chatConnection %s request did not complete %v",
 			forCM, err)
@@ -119,3 +127,62 @@ func (st *sT) chatConnection(matValue, forCM, fromCM string) []byte {
 	}
 	return msg.Data
 }
+
+//audit records an event of the end user.  A failure to record is logged but
+//does not fail the request.
+func (st *sT) audit(r *http.Request, event string, targetID int, target,
+	detail string) {
+	err := broker.AuditR(&broker.AuditEvent{
+		Event:     event,
+		ActorID:   st.sessionManager.GetInt(r.Context(), authenticatedUserID),
+		ActorRole: broker.ActorUser,
+		TargetID:  targetID,
+		Target:    target,
+		IP:        clientIP(r),
+		Detail:    detail,
+	})
+	if err != nil {
+		centerr.ErrorLog.Printf("audit %s %v", event, err)
+	}
+}
+
+//loginLocked reports whether the account (email) or the address of a login
+//attempt is locked by the throttling, auditing the refused attempt.
+func (st *sT) loginLocked(r *http.Request, email string) (bool, error) {
+	until, err := broker.LoginCheckR("users", email, clientIP(r))
+	if err != nil || until.IsZero() {
+		return false, err
+	}
+	st.audit(r, broker.AuditLoginFailed, 0, email,
+		"locked until "+until.Format(time.RFC3339))
+	return true, nil
+}
+
+//loginFailed audits a failed login and counts it for the throttling, auditing
+//the lock when it is one too many.
+func (st *sT) loginFailed(r *http.Request, id int, email, detail string) {
+	st.audit(r, broker.AuditLoginFailed, id, email, detail)
+	kind, until, err := broker.LoginFailedR("users", email, clientIP(r))
+	if err != nil {
+		centerr.ErrorLog.Printf("login failure count %v", err)
+		return
+	}
+	if kind == "" {
+		return
+	}
+	target := email
+	if kind == throttle.IP {
+		target = clientIP(r)
+	}
+	st.audit(r, broker.AuditLockout, id, target,
+		kind+" locked until "+until.Format(time.RFC3339))
+}
+
+//clientIP is the address of the client without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
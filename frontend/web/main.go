@@ -6,15 +6,20 @@ import (
 	"flag"
 	"html/template"
 	"net/http"
-	"net/url"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/mysqlstore"
 	"github.com/alexedwards/scs/v2"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/config"
 	"github.com/saied74/toychat/pkg/forms"
+	"github.com/saied74/toychat/pkg/mailer"
+	"github.com/saied74/toychat/pkg/secure"
+	"github.com/saied74/toychat/pkg/verify"
 )
 
 //so if the string is used in new packages, it remains privat for this app.
@@ -29,26 +34,65 @@ type sT struct {
 	cache          map[string]*template.Template
 	sessionManager *scs.SessionManager
 	// users          *userModel
-	td *templateData
+	td         *templateData //request scoped, only set on the copy initTD returns
+	mailer     mailer.Mailer
+	baseURL    string         //scheme and host of the links in the mails
+	verify     *verify.Signer //signs the email verification links, nil without a key
+	headers    *secure.Config //security headers of the responses
+	matSubject string         //nats subject of the mat requests
+	//requireVerified keeps users out until they confirm the email address.
+	requireVerified bool
 }
 
 type templateData struct {
-	Form      *forms.FormData
-	UserName  string
-	LoggedIn  bool
-	Flash     string
-	CSRFToken string
+	Form          *forms.FormData
+	SurveyPending bool              //a closed dialog is waiting for a survey
+	Survey        *broker.TableRow  //the dialog being surveyed
+	Question      string            //survey question
+	Token         string            //password reset token of the link
+	Unverified    bool              //login refused for an unconfirmed address
+	Ratings       []int             //survey rating choices
+	Sessions      *broker.TableRows //sessions of the user
+	UserName      string
+	LoggedIn      bool
+	Flash         string
+	CSRFToken     string
+	Nonce         string //nonce of the Content-Security-Policy for the script tags
 }
 
 func main() {
 	var err error
-	//the pw flag is mandatory.
 	ipAddress := flag.String("ipa", ":4000", "server ip address")
-	dsn := flag.String("dsn", "toy:password@/toychat?parseTime=true",
-		"MySQL data source name")
-	pw := flag.String("pw", "password", "database password is always required")
+	baseURL := flag.String("url", "https://localhost:4000",
+		"address of this server in the mailed links")
+	requireVerified := flag.Bool("verify", true,
+		"users must confirm the email address before they can log in and chat")
+	cspReportOnly := flag.Bool("cspreportonly", false,
+		"only report Content-Security-Policy violations, do not enforce the policy")
+	hsts := flag.Duration("hsts", secure.Default.HSTS,
+		"max-age of Strict-Transport-Security, 0 leaves the header out")
+	configFile, printConfig := config.Flags(flag.CommandLine)
 	flag.Parse()
-	dbAddress := strings.Replace(*dsn, "password", *pw, 1)
+	cfg, err := config.Load("frontend", *configFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	if *printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	err = cfg.Apply()
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	err = broker.SetCallerFile(broker.CallerFrontend, cfg.RequestKeyFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+	dbAddress, err := cfg.DataSource()
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
 
 	db, err := openDB(dbAddress)
 	if err != nil {
@@ -56,22 +100,42 @@ func main() {
 	}
 	defer db.Close()
 
+	mail, err := mailer.New(cfg.SMTPServer, cfg.SMTPUser, cfg.SMTPPassword(),
+		cfg.SMTPFrom, cfg.SMTPMailFile)
+	if err != nil {
+		centerr.ErrorLog.Fatal(err)
+	}
+
+	//the key has to be the same across restarts and all the instances, or the
+	//mailed links stop working.
+	var signer *verify.Signer
+	if key := cfg.VerifyKey(); key != nil {
+		signer = verify.NewSigner(key, verifyTTL)
+	} else if *requireVerified {
+		centerr.ErrorLog.Fatal("-verify needs verify.keyfile, the key of the links")
+	}
+
+	headers := secure.Default
+	headers.ReportOnly = *cspReportOnly
+	headers.HSTS = *hsts
+
 	st := &sT{
 		sessionManager: scs.New(),
-		td: &templateData{
-			Form: &forms.FormData{
-				Fields: url.Values{},
-				Errors: forms.ErrOrs{},
-			},
-		},
-		cache: newTemplateCache(allTmplFiles),
+		cache:          newTemplateCache(allTmplFiles),
+		mailer:         mail,
+		baseURL:        strings.TrimSuffix(*baseURL, "/"),
+		verify:         signer,
+		headers:        &headers,
+		matSubject:     cfg.Subjects.Mat,
+
+		requireVerified: *requireVerified,
 	}
 
 	//at some point when different applicaitons are running on different servers
 	//the database for each applicaiton needs to be seperated.
 	st.sessionManager.Store = mysqlstore.New(db)
-	st.sessionManager.Lifetime = 72 * time.Hour
-	st.sessionManager.Cookie.Name = "sessionOne"
+	st.sessionManager.Lifetime = cfg.SessionLifetime
+	st.sessionManager.Cookie.Name = cfg.SessionCookie
 
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
@@ -89,7 +153,7 @@ func main() {
 	}
 
 	centerr.InfoLog.Printf("Starting server on %s", *ipAddress)
-	err = srv.ListenAndServeTLS(serverCrt, serverKey)
+	err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
 	centerr.ErrorLog.Fatal(err)
 }
 
@@ -118,5 +182,12 @@ func (st *sT) routes() *http.ServeMux {
 	mux.HandleFunc("/login", st.loginHandler)
 	mux.HandleFunc("/logout", st.logoutHandler)
 	mux.HandleFunc("/signup", st.signupHandler)
+	mux.HandleFunc(forgotPath, st.forgotHandler)
+	mux.HandleFunc(resetPath, st.resetHandler)
+	mux.HandleFunc(verifyPath, st.verifyHandler)
+	mux.Handle("/survey", st.requireAuthentication(http.HandlerFunc(st.surveyHandler)))
+	mux.Handle(chgPwdPath, st.requireAuthentication(http.HandlerFunc(st.chgPwdHandler)))
+	mux.Handle(sessionsPath, st.requireAuthentication(http.HandlerFunc(st.sessionsHandler)))
+	mux.HandleFunc(secure.ReportPath, secure.ReportHandler)
 	return mux
 }
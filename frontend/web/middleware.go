@@ -10,6 +10,7 @@ import (
 	"github.com/justinas/nosurf"
 	"github.com/saied74/toychat/pkg/broker"
 	"github.com/saied74/toychat/pkg/centerr"
+	"github.com/saied74/toychat/pkg/secure"
 )
 
 func (st *sT) logRequest(next http.Handler) http.Handler {
@@ -52,6 +53,8 @@ func (st *sT) requireAuthentication(next http.Handler) http.Handler {
 
 func noSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
+	//the browsers post the violation reports without a token.
+	csrfHandler.ExemptPath(secure.ReportPath)
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
@@ -69,7 +72,8 @@ func (st *sT) authenticate(next http.Handler) http.Handler {
 		}
 		usr, err := broker.GetEUR("users", st.sessionManager.GetInt(r.Context(),
 			authenticatedUserID))
-		if errors.Is(err, broker.ErrNoRecord) || !usr.Active {
+		if errors.Is(err, broker.ErrNoRecord) || !usr.Active ||
+			(st.requireVerified && !usr.Verified) {
 			st.sessionManager.Remove(r.Context(), authenticatedUserID)
 			next.ServeHTTP(w, r)
 			return
@@ -77,6 +81,23 @@ func (st *sT) authenticate(next http.Handler) http.Handler {
 			st.serverError(w, err)
 			return
 		}
+		//a revoked session is no longer in the session index.
+		err = broker.SeenSessionR("users", st.sessionManager.GetString(r.Context(),
+			sessionIDKey), usr.ID)
+		if errors.Is(err, broker.ErrNoRecord) {
+			st.sessionManager.Remove(r.Context(), authenticatedUserID)
+			st.sessionManager.Remove(r.Context(), sessionIDKey)
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			st.serverError(w, err)
+			return
+		}
+		//after a reset by an admin the password has to be changed first.
+		if usr.MustReset && r.URL.Path != chgPwdPath && r.URL.Path != "/logout" {
+			http.Redirect(w, r, chgPwdPath, http.StatusSeeOther)
+			return
+		}
 		ctx := context.WithValue(r.Context(), contextKeyIsAuthenticated, true)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -85,7 +106,7 @@ func (st *sT) authenticate(next http.Handler) http.Handler {
 type plainHandler func(w http.ResponseWriter, r *http.Request)
 
 func (st *sT) dynamicRoutes(next http.Handler) http.Handler {
-	return noSurf(st.sessionManager.LoadAndSave(st.recoverPanic(st.logRequest(st.authenticate(next)))))
+	return st.headers.Headers(noSurf(st.sessionManager.LoadAndSave(st.recoverPanic(st.logRequest(st.authenticate(next))))))
 }
 
 func (st *sT) dynamicAuthRoute(next plainHandler) http.Handler {
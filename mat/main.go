@@ -1,11 +1,15 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 	"strings"
 	"time"
 
 	nats "github.com/nats-io/nats.go"
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/config"
 )
 
 //see the commments in the chat main program.
@@ -20,14 +24,28 @@ func playMatHandler(msg *nats.Msg, conn *nats.Conn) {
 
 func main() {
 	var err error
+	configFile, printConfig := config.Flags(flag.CommandLine)
+	flag.Parse()
+	cfg, err := config.Load("mat", *configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	err = cfg.Apply()
+	if err != nil {
+		log.Fatal("nats configuration: ", err)
+	}
 
-	nc1, err := nats.Connect(nats.DefaultURL)
+	nc1, err := broker.Connect()
 	if err != nil {
 		log.Fatal("Error from onnection", err)
 	}
 	defer nc1.Close()
 
-	sub, _ := nc1.SubscribeSync("forMat")
+	sub, _ := nc1.SubscribeSync(cfg.Subjects.Mat)
 	for {
 		msg, err := sub.NextMsg(10 * time.Hour)
 		if err != nil {
@@ -0,0 +1,64 @@
+//this file contains the broker methods for the account lifecycle of admins
+//and agents: list all, edit, soft delete and restore and password reset.
+
+package broker
+
+//GetAllR gets every account of the role including the inactive and the soft
+//deleted ones.
+func GetAllR(table, role string) (TableRows, error) {
+	people := TableRows{TableRow{Role: role}}
+	exchange := Exchange{
+		Table:    table,
+		Put:      []string{},
+		SpecList: []string{"role"},
+		Get: []string{"id", "name", "email", "created", "role", "active", "online",
+			"presence", "deleted", "must_reset", TOTPEnabled},
+		Tables: people,
+		Action: "get",
+	}
+	err := exchange.runGetExchange(people, exchange.SpecList)
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
+
+//UpdateAccountR changes the name and email of an account of the role.
+//ErrDuplicateEmail if the email belongs to another account.
+func UpdateAccountR(table, role string, id int, name, email string) error {
+	return putAccount(table, []string{Name, Email},
+		TableRow{ID: id, Role: role, Name: name, Email: email})
+}
+
+//DeleteAccountR soft deletes (deleted true) or restores an account of the
+//role.  A deleted account is also deactivated, it can no longer log in and
+//is left out of everything but GetAllR.  A restored account stays inactive
+//until it is activated again.
+func DeleteAccountR(table, role string, id int, deleted bool) error {
+	if deleted {
+		return putAccount(table, []string{Deleted, Active},
+			TableRow{ID: id, Role: role, Deleted: true, Active: false})
+	}
+	return putAccount(table, []string{Deleted},
+		TableRow{ID: id, Role: role, Deleted: false})
+}
+
+//ResetPasswordR sets the (hashed) password of an account of the role and
+//forces its owner to change it at the next login.
+func ResetPasswordR(table, role string, id int, password string) error {
+	return putAccount(table, []string{HashedPassword, MustReset},
+		TableRow{ID: id, Role: role, HashedPassword: password, MustReset: true})
+}
+
+func putAccount(table string, put []string, person TableRow) error {
+	exchange := Exchange{
+		Table:    table,
+		Put:      put,
+		SpecList: []string{iD, Role},
+		Tables:   TableRows{person},
+		Action:   "put",
+	}
+	exchange.Spec = append(exchange.Spec, person.Specify(exchange.Put,
+		exchange.SpecList))
+	return exchange.runExchange()
+}
@@ -0,0 +1,120 @@
+//this file contains the broker methods for the audit log.  The audit table is
+//append only (see dbscripts/audit.txt), events are only ever inserted.
+
+package broker
+
+import (
+	"time"
+)
+
+//Audit events.
+const (
+	AuditLogin       = "login"
+	AuditLoginFailed = "login_failed"
+	AuditLogout      = "logout"
+	AuditAdd         = "add"
+	AuditActivate    = "activate"
+	AuditDeactivate  = "deactivate"
+	AuditPassword    = "password"
+	AuditTransfer    = "transfer"
+	AuditExport      = "export"
+	AuditEdit        = "edit"
+	AuditDelete      = "delete"
+	AuditRestore     = "restore"
+	AuditReset       = "reset_password"
+	AuditForgot      = "forgot_password"
+	AuditVerify      = "verify_email"
+	Audit2FAEnable   = "2fa_enable"
+	Audit2FADisable  = "2fa_disable"
+	Audit2FAReset    = "2fa_reset"
+	Audit2FARecovery = "2fa_recovery_codes"
+	Audit2FAPolicy   = "2fa_policy"
+	AuditLockout     = "lockout"
+	AuditUnlock      = "unlock"
+	AuditPromote     = "promote"
+	AuditDemote      = "demote"
+	AuditRevoke      = "session_revoke"
+	AuditForceLogout = "force_logout"
+	AuditRekey       = "key_rotation"
+)
+
+//AuditEvents are the events the audit viewer can filter on.
+var AuditEvents = []string{AuditLogin, AuditLoginFailed, AuditLogout, AuditAdd,
+	AuditActivate, AuditDeactivate, AuditPassword, AuditTransfer, AuditExport,
+	AuditEdit, AuditDelete, AuditRestore, AuditReset, AuditForgot,
+	AuditVerify, Audit2FAEnable, Audit2FADisable, Audit2FAReset, Audit2FARecovery,
+	Audit2FAPolicy, AuditLockout, AuditUnlock, AuditPromote, AuditDemote,
+	AuditRevoke, AuditForceLogout, AuditRekey}
+
+//Actor roles for events not done by a logged in person.
+const (
+	ActorSystem = "system" //the dbmgr itself, e.g. the presence sweeper
+	ActorCLI    = "cli"    //the command line tools
+	ActorUser   = "user"   //end users
+)
+
+//MaxAudit is the most events AuditLogR returns.
+const MaxAudit = 500
+
+//AuditEvent is one entry of the audit log.
+type AuditEvent struct {
+	ID        int
+	Created   time.Time
+	Event     string
+	ActorID   int
+	ActorRole string
+	Actor     string //name of the actor, filled in by AuditLogR
+	TargetID  int
+	Target    string
+	IP        string
+	Detail    string
+}
+
+//AuditFilter selects the events of AuditLogR.  Empty fields do not filter,
+//Actor and Target match the start of the actor's name or email and of the
+//target.  To is not included.
+type AuditFilter struct {
+	Event  string
+	Actor  string
+	Target string
+	From   time.Time
+	To     time.Time
+}
+
+func (a *AuditEvent) row() TableRow {
+	return TableRow{ID: a.ID, Created: a.Created, Event: a.Event,
+		ActorID: a.ActorID, ActorRole: a.ActorRole, Actor: a.Actor,
+		TargetID: a.TargetID, Target: a.Target, IP: a.IP, Detail: a.Detail}
+}
+
+//AuditR appends the event to the audit log.  Created is set by the dbmgr.
+func AuditR(a *AuditEvent) error {
+	exchange := Exchange{
+		Table:  "audit",
+		Tables: TableRows{a.row()},
+		Action: "audit",
+	}
+	return exchange.runExchange()
+}
+
+//AuditLogR returns up to MaxAudit events matching f, the newest first.
+func AuditLogR(f *AuditFilter) ([]AuditEvent, error) {
+	exchange := Exchange{
+		Table: "audit",
+		Tables: TableRows{{Event: f.Event, Actor: f.Actor, Target: f.Target,
+			Created: f.From, Ended: f.To, Count: MaxAudit}},
+		Action: "auditLog",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	events := []AuditEvent{}
+	for _, r := range exchange.Tables {
+		events = append(events, AuditEvent{ID: r.ID, Created: r.Created,
+			Event: r.Event, ActorID: r.ActorID, ActorRole: r.ActorRole,
+			Actor: r.Actor, TargetID: r.TargetID, Target: r.Target, IP: r.IP,
+			Detail: r.Detail})
+	}
+	return events, nil
+}
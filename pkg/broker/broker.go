@@ -2,6 +2,7 @@ package broker
 
 import (
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -15,6 +16,7 @@ const (
 	NoRecord                    //errNoRecord
 	InvalidCreds                //errInvalidCredentials
 	DuplicateMail               //errDuplicateEmail
+	DuplicateRow                //errDuplicate
 )
 
 var (
@@ -24,6 +26,8 @@ var (
 	ErrInvalidCredentials = errors.New("models: invalid credentials")
 	// ErrDuplicateEmail indicates that email is alreday being used
 	ErrDuplicateEmail = errors.New("models: duplicate email")
+	// ErrDuplicate indicates that a unique column other than email is in use
+	ErrDuplicate = errors.New("models: duplicate entry")
 )
 
 //TableRow is a direct map of the database columns in exact the same order.
@@ -47,6 +51,44 @@ type TableRow struct {
 	Active         bool
 	Online         bool
 	Msg            string
+	Presence       string //available, busy, away or offline (agents only)
+	MaxDialogs     int    //per agent dialog capacity, zero means role default
+	PresenceSince  time.Time
+	Code           string //disposition code
+	Label          string //disposition label
+	Wrapup         string //internal wrap up notes of a closed dialog
+	DispositionID  int
+	TagID          int
+	Value          string    //value of a setting, Name is the setting name
+	Kind           string    //survey kind, csat or nps
+	Rating         int       //survey rating
+	Comment        string    //survey comment
+	Period         string    //reporting period (e.g. 2020-05 or 2020-05-17)
+	Count          int       //number of rows aggregated in a report row
+	Average        float64   //average rating or handle time in seconds
+	Score          float64   //CSAT percent satisfied or NPS
+	Response       float64   //average first response in seconds (reports)
+	Sender         string    //who wrote the message, user or agent
+	AgentName      string    //name of the dialog's agent in transcripts
+	State          string    //state of the dialog, open or closed (search)
+	Event          string    //audit event (login, add, activate...)
+	ActorID        int       //who did it, zero when unknown (failed login)
+	ActorRole      string    //role of the actor, user for end users
+	Actor          string    //name of the actor (audit log)
+	TargetID       int       //id of the admin, agent, user or dialog acted on
+	Target         string    //what was acted on, e.g. the email
+	IP             string    //address the request came from
+	Detail         string    //free text details of an audit event
+	Deleted        bool      //soft deleted account, kept for the records
+	MustReset      bool      //password was reset, it must be changed at login
+	Token          string    //hash of a single use token (password reset)
+	Verified       bool      //end user confirmed the email address
+	TOTPSecret     string    //base32 two-factor secret, empty when not enrolled
+	TOTPEnabled    bool      //two-factor login is on
+	TOTPStep       int       //last used two-factor time step, against replays
+	LastSeen       time.Time //last request of a session
+	UserAgent      string    //browser of a session
+	Current        bool      //the session of the request (SessionsR)
 }
 
 //TableRows is a slice so multiple rows can be inserted and extracted
@@ -109,14 +151,15 @@ func InsertXR(table, role, name, email, password string) error {
 //X stands for user, agent, or admin
 func AuthenticateXR(table, role, email string) (*TableRow, error) {
 	people := TableRows{
-		TableRow{Role: role, Email: email},
+		TableRow{Role: role, Email: email, Deleted: false},
 	}
 	exchange := Exchange{
 		Table:    table,
 		Put:      []string{},
-		SpecList: []string{"role", "email"},
+		SpecList: []string{"role", "email", "deleted"},
 		Get: []string{"id", "name", "email", "hashed_password", "created",
-			"role", "active", "online"},
+			"role", "active", "online", "presence", "max_dialogs", "presence_since",
+			"deleted", "must_reset", TOTPSecret, TOTPEnabled, TOTPStep},
 		Tables: people,
 		Action: "get",
 	}
@@ -140,7 +183,8 @@ func GetXR(table string, id int) (*TableRow, error) {
 		Put:      []string{},
 		SpecList: []string{"id"},
 		Get: []string{"id", "name", "email", "hashed_password", "created",
-			"role", "active", "online"},
+			"role", "active", "online", "presence", "max_dialogs", "presence_since",
+			"deleted", "must_reset", TOTPSecret, TOTPEnabled, TOTPStep},
 		Tables: people,
 		Action: "get",
 	}
@@ -156,14 +200,16 @@ func GetXR(table string, id int) (*TableRow, error) {
 }
 
 //GetByStatusR gets from the specified table a string agents by status (eg. active)
+//Soft deleted accounts are left out, see GetAllR.
 func GetByStatusR(table, role string, status bool) (TableRows, error) {
-	people := TableRows{TableRow{Active: status, Role: role}}
+	people := TableRows{TableRow{Active: status, Role: role, Deleted: false}}
 	exchange := Exchange{
 		Table:    table,
 		Put:      []string{},
-		SpecList: []string{"role", "active"},
+		SpecList: []string{"role", "active", "deleted"},
 		Get: []string{"id", "name", "email", "hashed_password", "created",
-			"role", "active", "online"},
+			"role", "active", "online", "presence", "max_dialogs", "presence_since",
+			"deleted", "must_reset"},
 		Tables: people,
 		Action: "get",
 	}
@@ -174,8 +220,9 @@ func GetByStatusR(table, role string, status bool) (TableRows, error) {
 	return exchange.Tables, exchange.DecodeErr()
 }
 
-//ActivationR activates or deactivates agent or admin as requested.
-func ActivationR(table, role string, people *TableRows) error {
+//ActivationR activates or deactivates agent or admin as requested.  Each row
+//is picked by its id and role.
+func ActivationR(table string, people *TableRows) error {
 	exchange := Exchange{
 		Table:    table,
 		Put:      []string{"active"},
@@ -191,12 +238,14 @@ func ActivationR(table, role string, people *TableRows) error {
 }
 
 //ChgPwdR sends a request to the dbmgr to change the pawword for the specified email
+//It also clears a forced reset (see ResetPasswordR).
 func ChgPwdR(table, role, email, password string) error {
-	people := TableRows{TableRow{HashedPassword: password, Email: email, Role: role}}
+	people := TableRows{TableRow{HashedPassword: password, Email: email, Role: role,
+		MustReset: false}}
 	exchange := Exchange{
 		Table:    table,
-		Put:      []string{"hashed_password"},
-		SpecList: []string{"id", "role"},
+		Put:      []string{"hashed_password", "must_reset"},
+		SpecList: []string{"email", "role"},
 		Tables:   people,
 		Action:   "put",
 	}
@@ -207,12 +256,30 @@ func ChgPwdR(table, role, email, password string) error {
 	return exchange.runExchange()
 }
 
-//PutLine moves the agent offline and online
+//PutLine moves the agent offline and online.  Going online makes the agent
+//available, use PutPresence for the other states.
 func PutLine(table, role string, id int, online bool) error {
-	people := TableRows{TableRow{Online: online, ID: id, Role: role}}
+	if online {
+		return PutPresence(table, role, id, Available, ReasonChange)
+	}
+	return PutPresence(table, role, id, Offline, ReasonChange)
+}
+
+//PutPresence sets the presence state of the agent and keeps online in step.
+//The change is published on PresenceSubject with reason as the cause.
+func PutPresence(table, role string, id int, presence, reason string) error {
+	if !ValidPresence(presence) {
+		return fmt.Errorf("invalid presence state %q", presence)
+	}
+	old, err := GetXR(table, id)
+	if err != nil {
+		return err
+	}
+	people := TableRows{TableRow{Online: presence != Offline, Presence: presence,
+		ID: id, Role: role}}
 	exchange := Exchange{
 		Table:    table,
-		Put:      []string{"online"},
+		Put:      []string{"online", "presence", "presence_since", "heartbeat"},
 		SpecList: []string{"id", "role"},
 		Tables:   people,
 		Action:   "put",
@@ -221,6 +288,115 @@ func PutLine(table, role string, id int, online bool) error {
 		c := p.Specify(exchange.Put, exchange.SpecList)
 		exchange.Spec = append(exchange.Spec, c)
 	}
+	err = exchange.runExchange()
+	if err != nil {
+		return err
+	}
+	return PublishPresence(&PresenceEvent{
+		AgentID: id,
+		Name:    old.Name,
+		Old:     old.Presence,
+		New:     presence,
+		Reason:  reason,
+		Time:    time.Now().UTC(),
+	})
+}
+
+//HeartbeatR records that the agent console is still open.  Agents that miss
+//heartbeats are moved offline by the dbmgr sweeper.
+func HeartbeatR(table, role string, id int) error {
+	people := TableRows{TableRow{ID: id, Role: role}}
+	exchange := Exchange{
+		Table:    table,
+		Put:      []string{"heartbeat"},
+		SpecList: []string{"id", "role"},
+		Tables:   people,
+		Action:   "put",
+	}
+	for _, p := range people {
+		c := p.Specify(exchange.Put, exchange.SpecList)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//ValidPresence reports whether presence is one of the PresenceStates.
+func ValidPresence(presence string) bool {
+	for _, p := range PresenceStates {
+		if p == presence {
+			return true
+		}
+	}
+	return false
+}
+
+//CapacityR sets the maximum number of concurrent dialogs of each agent in
+//people.  A MaxDialogs of zero falls back to the role default.
+func CapacityR(table string, people *TableRows) error {
+	exchange := Exchange{
+		Table:    table,
+		Put:      []string{"max_dialogs"},
+		SpecList: []string{"id", "role"},
+		Tables:   *people,
+		Action:   "put",
+	}
+	for _, p := range *people {
+		c := p.Specify(exchange.Put, exchange.SpecList)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//GetRoleCapacityR gets the default maximum number of concurrent dialogs for
+//the role from the role_defaults table.
+func GetRoleCapacityR(role string) (int, error) {
+	people := TableRows{TableRow{Role: role}}
+	exchange := Exchange{
+		Table:    "role_defaults",
+		Put:      []string{},
+		SpecList: []string{"role"},
+		Get:      []string{"role", "max_dialogs"},
+		Tables:   people,
+		Action:   "get",
+	}
+	err := exchange.runGetExchange(people, exchange.SpecList)
+	if err != nil {
+		return 0, err
+	}
+	return exchange.Tables[0].MaxDialogs, nil
+}
+
+//RoleCapacityR sets the default maximum number of concurrent dialogs for the role.
+func RoleCapacityR(role string, max int) error {
+	people := TableRows{TableRow{Role: role, MaxDialogs: max}}
+	exchange := Exchange{
+		Table:    "role_defaults",
+		Put:      []string{"max_dialogs"},
+		SpecList: []string{"role"},
+		Tables:   people,
+		Action:   "put",
+	}
+	for _, p := range people {
+		c := p.Specify(exchange.Put, exchange.SpecList)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//AddRoleCapacityR adds the default maximum number of concurrent dialogs of a
+//role that has none yet, see RoleCapacityR for one that has.
+func AddRoleCapacityR(role string, max int) error {
+	people := TableRows{TableRow{Role: role, MaxDialogs: max}}
+	exchange := Exchange{
+		Table:  "role_defaults",
+		Put:    []string{"role", "max_dialogs"},
+		Tables: people,
+		Action: "insert",
+	}
+	for _, p := range people {
+		c := p.BuildInsert(exchange.Put)
+		exchange.Spec = append(exchange.Spec, c)
+	}
 	return exchange.runExchange()
 }
 
@@ -254,9 +430,10 @@ func AuthenticateEUR(table, email string) (*TableRow, error) {
 		Table:    table,
 		Put:      []string{},
 		SpecList: []string{"email"},
-		Get:      []string{iD, Name, Email, HashedPassword, Created, Active},
-		Tables:   people,
-		Action:   "get",
+		Get: []string{iD, Name, Email, HashedPassword, Created, Active, MustReset,
+			Verified},
+		Tables: people,
+		Action: "get",
 	}
 	err := exchange.runGetExchange(people, exchange.SpecList)
 	if err != nil {
@@ -277,7 +454,7 @@ func GetEUR(table string, id int) (*TableRow, error) {
 		Put:      []string{},
 		SpecList: []string{"id"},
 		Get: []string{iD, Name, Email, HashedPassword, Created,
-			Active, Online},
+			Active, Online, MustReset, Verified},
 		Tables: people,
 		Action: "get",
 	}
@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/nats-io/nats.go"
 	"github.com/saied74/toychat/pkg/centerr"
 )
 
@@ -28,8 +27,40 @@ const (
 	Started        = "started"
 	Ended          = "ended"
 	Open           = "open"
+	Presence       = "presence"
+	MaxDialogs     = "max_dialogs"
+	PresenceSince  = "presence_since"
+	Heartbeat      = "heartbeat"
+	Code           = "code"
+	Label          = "label"
+	Wrapup         = "wrapup"
+	DispositionID  = "disposition_id"
+	TagID          = "tag_id"
+	Value          = "value"
+	Kind           = "kind"
+	Rating         = "rating"
+	Comment        = "comment"
+	Sender         = "sender"
+	Deleted        = "deleted"
+	MustReset      = "must_reset"
+	Verified       = "verified"
+	TOTPSecret     = "totp_secret"
+	TOTPEnabled    = "totp_enabled"
+	TOTPStep       = "totp_step"
 )
 
+//Presence states of an agent.  Only an available agent is routed new dialogs.
+//Online is kept in step with presence, it is false only when offline.
+const (
+	Available = "available"
+	Busy      = "busy"
+	Away      = "away"
+	Offline   = "offline"
+)
+
+//PresenceStates lists the valid agent presence states in display order.
+var PresenceStates = []string{Available, Busy, Away, Offline}
+
 //BuildInsert uses the "put" slice pattern to build an empty interface
 //slice to be used with the INSERT statement
 func (p *TableRow) BuildInsert(put []string) []interface{} {
@@ -58,12 +89,52 @@ func (p *TableRow) BuildInsert(put []string) []interface{} {
 			continue
 		case "ended":
 			continue
+		case PresenceSince:
+			continue
+		case Heartbeat:
+			continue
 		case Role:
 			c = append(c, p.Role)
 		case Active:
 			c = append(c, p.Active)
 		case Online:
 			c = append(c, p.Online)
+		case Presence:
+			c = append(c, p.Presence)
+		case MaxDialogs:
+			c = append(c, p.MaxDialogs)
+		case Code:
+			c = append(c, p.Code)
+		case Label:
+			c = append(c, p.Label)
+		case Wrapup:
+			c = append(c, p.Wrapup)
+		case DispositionID:
+			c = append(c, p.DispositionID)
+		case TagID:
+			c = append(c, p.TagID)
+		case Value:
+			c = append(c, p.Value)
+		case Kind:
+			c = append(c, p.Kind)
+		case Rating:
+			c = append(c, p.Rating)
+		case Comment:
+			c = append(c, p.Comment)
+		case Sender:
+			c = append(c, p.Sender)
+		case Deleted:
+			c = append(c, p.Deleted)
+		case MustReset:
+			c = append(c, p.MustReset)
+		case Verified:
+			c = append(c, p.Verified)
+		case TOTPSecret:
+			c = append(c, p.TOTPSecret)
+		case TOTPEnabled:
+			c = append(c, p.TOTPEnabled)
+		case TOTPStep:
+			c = append(c, p.TOTPStep)
 		case "message":
 			c = append(c, p.Msg)
 		}
@@ -104,6 +175,44 @@ func (p *TableRow) GetSpec(spec []string) []interface{} {
 			g = append(g, p.Active)
 		case Online:
 			g = append(g, p.Online)
+		case Presence:
+			g = append(g, p.Presence)
+		case MaxDialogs:
+			g = append(g, p.MaxDialogs)
+		case PresenceSince:
+			g = append(g, p.PresenceSince)
+		case Code:
+			g = append(g, p.Code)
+		case Label:
+			g = append(g, p.Label)
+		case Wrapup:
+			g = append(g, p.Wrapup)
+		case DispositionID:
+			g = append(g, p.DispositionID)
+		case TagID:
+			g = append(g, p.TagID)
+		case Value:
+			g = append(g, p.Value)
+		case Kind:
+			g = append(g, p.Kind)
+		case Rating:
+			g = append(g, p.Rating)
+		case Comment:
+			g = append(g, p.Comment)
+		case Sender:
+			g = append(g, p.Sender)
+		case Deleted:
+			g = append(g, p.Deleted)
+		case MustReset:
+			g = append(g, p.MustReset)
+		case Verified:
+			g = append(g, p.Verified)
+		case TOTPSecret:
+			g = append(g, p.TOTPSecret)
+		case TOTPEnabled:
+			g = append(g, p.TOTPEnabled)
+		case TOTPStep:
+			g = append(g, p.TOTPStep)
 		case "message":
 			g = append(g, p.Msg)
 		}
@@ -145,6 +254,44 @@ func (p *TableRow) GetItems(get []string) []interface{} {
 			g = append(g, &p.Active)
 		case Online:
 			g = append(g, &p.Online)
+		case Presence:
+			g = append(g, &p.Presence)
+		case MaxDialogs:
+			g = append(g, &p.MaxDialogs)
+		case PresenceSince:
+			g = append(g, &p.PresenceSince)
+		case Code:
+			g = append(g, &p.Code)
+		case Label:
+			g = append(g, &p.Label)
+		case Wrapup:
+			g = append(g, &p.Wrapup)
+		case DispositionID:
+			g = append(g, &p.DispositionID)
+		case TagID:
+			g = append(g, &p.TagID)
+		case Value:
+			g = append(g, &p.Value)
+		case Kind:
+			g = append(g, &p.Kind)
+		case Rating:
+			g = append(g, &p.Rating)
+		case Comment:
+			g = append(g, &p.Comment)
+		case Sender:
+			g = append(g, &p.Sender)
+		case Deleted:
+			g = append(g, &p.Deleted)
+		case MustReset:
+			g = append(g, &p.MustReset)
+		case Verified:
+			g = append(g, &p.Verified)
+		case TOTPSecret:
+			g = append(g, &p.TOTPSecret)
+		case TOTPEnabled:
+			g = append(g, &p.TOTPEnabled)
+		case TOTPStep:
+			g = append(g, &p.TOTPStep)
 		case "message":
 			g = append(g, &p.Msg)
 		}
@@ -241,6 +388,120 @@ func (p *TableRow) GetBack(get []string, g []interface{}) error {
 				return fmt.Errorf("Online (bool) type assertion failed")
 			}
 			p.Online = *xOnline
+		case Presence:
+			xPresence, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Presence (string) type assertion failed")
+			}
+			p.Presence = *xPresence
+		case MaxDialogs:
+			xMax, ok := g[i].(*int)
+			if !ok {
+				return fmt.Errorf("MaxDialogs (int) type assertion failed")
+			}
+			p.MaxDialogs = *xMax
+		case PresenceSince:
+			xSince, ok := g[i].(*time.Time)
+			if !ok {
+				return fmt.Errorf("PresenceSince (time.Time) type assertion failed")
+			}
+			p.PresenceSince = *xSince
+		case Code:
+			xCode, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Code (string) type assertion failed")
+			}
+			p.Code = *xCode
+		case Label:
+			xLabel, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Label (string) type assertion failed")
+			}
+			p.Label = *xLabel
+		case Wrapup:
+			xWrapup, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Wrapup (string) type assertion failed")
+			}
+			p.Wrapup = *xWrapup
+		case DispositionID:
+			xDispositionID, ok := g[i].(*int)
+			if !ok {
+				return fmt.Errorf("DispositionID (int) type assertion failed")
+			}
+			p.DispositionID = *xDispositionID
+		case TagID:
+			xTagID, ok := g[i].(*int)
+			if !ok {
+				return fmt.Errorf("TagID (int) type assertion failed")
+			}
+			p.TagID = *xTagID
+		case Value:
+			xValue, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Value (string) type assertion failed")
+			}
+			p.Value = *xValue
+		case Kind:
+			xKind, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Kind (string) type assertion failed")
+			}
+			p.Kind = *xKind
+		case Rating:
+			xRating, ok := g[i].(*int)
+			if !ok {
+				return fmt.Errorf("Rating (int) type assertion failed")
+			}
+			p.Rating = *xRating
+		case Comment:
+			xComment, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Comment (string) type assertion failed")
+			}
+			p.Comment = *xComment
+		case Sender:
+			xSender, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("Sender (string) type assertion failed")
+			}
+			p.Sender = *xSender
+		case Deleted:
+			xDeleted, ok := g[i].(*bool)
+			if !ok {
+				return fmt.Errorf("Deleted (bool) type assertion failed")
+			}
+			p.Deleted = *xDeleted
+		case MustReset:
+			xMustReset, ok := g[i].(*bool)
+			if !ok {
+				return fmt.Errorf("MustReset (bool) type assertion failed")
+			}
+			p.MustReset = *xMustReset
+		case Verified:
+			xVerified, ok := g[i].(*bool)
+			if !ok {
+				return fmt.Errorf("Verified (bool) type assertion failed")
+			}
+			p.Verified = *xVerified
+		case TOTPSecret:
+			xTOTPSecret, ok := g[i].(*string)
+			if !ok {
+				return fmt.Errorf("TOTPSecret (string) type assertion failed")
+			}
+			p.TOTPSecret = *xTOTPSecret
+		case TOTPEnabled:
+			xTOTPEnabled, ok := g[i].(*bool)
+			if !ok {
+				return fmt.Errorf("TOTPEnabled (bool) type assertion failed")
+			}
+			p.TOTPEnabled = *xTOTPEnabled
+		case TOTPStep:
+			xTOTPStep, ok := g[i].(*int)
+			if !ok {
+				return fmt.Errorf("TOTPStep (int) type assertion failed")
+			}
+			p.TOTPStep = *xTOTPStep
 		case "message":
 			xMsg, ok := g[i].(*string)
 			if !ok {
@@ -281,6 +542,42 @@ func (p *TableRow) Specify(put, spec []string) []interface{} {
 			sp = append(sp, p.Active)
 		case Online:
 			sp = append(sp, p.Online)
+		case Presence:
+			sp = append(sp, p.Presence)
+		case MaxDialogs:
+			sp = append(sp, p.MaxDialogs)
+		case Code:
+			sp = append(sp, p.Code)
+		case Label:
+			sp = append(sp, p.Label)
+		case Wrapup:
+			sp = append(sp, p.Wrapup)
+		case DispositionID:
+			sp = append(sp, p.DispositionID)
+		case TagID:
+			sp = append(sp, p.TagID)
+		case Value:
+			sp = append(sp, p.Value)
+		case Kind:
+			sp = append(sp, p.Kind)
+		case Rating:
+			sp = append(sp, p.Rating)
+		case Comment:
+			sp = append(sp, p.Comment)
+		case Sender:
+			sp = append(sp, p.Sender)
+		case Deleted:
+			sp = append(sp, p.Deleted)
+		case MustReset:
+			sp = append(sp, p.MustReset)
+		case Verified:
+			sp = append(sp, p.Verified)
+		case TOTPSecret:
+			sp = append(sp, p.TOTPSecret)
+		case TOTPEnabled:
+			sp = append(sp, p.TOTPEnabled)
+		case TOTPStep:
+			sp = append(sp, p.TOTPStep)
 		case "message":
 			sp = append(sp, p.Msg)
 		}
@@ -309,6 +606,42 @@ func (p *TableRow) Specify(put, spec []string) []interface{} {
 			sp = append(sp, p.Active)
 		case Online:
 			sp = append(sp, p.Online)
+		case Presence:
+			sp = append(sp, p.Presence)
+		case MaxDialogs:
+			sp = append(sp, p.MaxDialogs)
+		case Code:
+			sp = append(sp, p.Code)
+		case Label:
+			sp = append(sp, p.Label)
+		case Wrapup:
+			sp = append(sp, p.Wrapup)
+		case DispositionID:
+			sp = append(sp, p.DispositionID)
+		case TagID:
+			sp = append(sp, p.TagID)
+		case Value:
+			sp = append(sp, p.Value)
+		case Kind:
+			sp = append(sp, p.Kind)
+		case Rating:
+			sp = append(sp, p.Rating)
+		case Comment:
+			sp = append(sp, p.Comment)
+		case Sender:
+			sp = append(sp, p.Sender)
+		case Deleted:
+			sp = append(sp, p.Deleted)
+		case MustReset:
+			sp = append(sp, p.MustReset)
+		case Verified:
+			sp = append(sp, p.Verified)
+		case TOTPSecret:
+			sp = append(sp, p.TOTPSecret)
+		case TOTPEnabled:
+			sp = append(sp, p.TOTPEnabled)
+		case TOTPStep:
+			sp = append(sp, p.TOTPStep)
 		case "message":
 			sp = append(sp, p.Msg)
 		}
@@ -325,8 +658,28 @@ func (e *Exchange) runExchange() error {
 	if err != nil {
 		return err
 	}
-	answer := ChatConnection(sendData, "forDB")
-	e.FromGob(answer)
+	sendData, err = seal(sendData, time.Now())
+	if err != nil {
+		return err
+	}
+	answer, err := request(DBSubject, sendData)
+	if err != nil {
+		return fmt.Errorf("dbmgr %s request: %w", e.Action, err)
+	}
+	return e.fromAnswer(answer)
+}
+
+//fromAnswer decodes the answer of the dbmgr into the exchange and returns the
+//error it carries.  An answer that does not decode is an error of its own and
+//not ErrNoRecord, which the callers take as a missing row.
+func (e *Exchange) fromAnswer(answer []byte) error {
+	//gob does not send empty fields, so the exchange is cleared to keep an
+	//empty answer from leaving the request's rows in place.
+	*e = Exchange{}
+	err := e.FromGob(answer)
+	if err != nil {
+		return err
+	}
 	return e.DecodeErr()
 }
 
@@ -386,6 +739,8 @@ func (e *Exchange) EncodeErr(err error) {
 		e.ErrType = InvalidCreds
 	case errors.Is(err, ErrDuplicateEmail):
 		e.ErrType = DuplicateMail
+	case errors.Is(err, ErrDuplicate):
+		e.ErrType = DuplicateRow
 	default:
 		e.ErrType = ErrZero
 	}
@@ -408,28 +763,27 @@ func (e *Exchange) DecodeErr() error {
 		return ErrInvalidCredentials
 	case DuplicateMail:
 		return ErrDuplicateEmail
+	case DuplicateRow:
+		return ErrDuplicate
 	}
 	return fmt.Errorf("error decoder failed %d", int(e.ErrType))
 }
 
+//DBSubject is the nats subject of the dbmgr requests, see subject.db of
+//pkg/config.
+var DBSubject = "forDB"
+
 //ChatConnection sends string data to the far end, waits for the response and returns.
 //for chat and mat, the data is string.  For dbmgr, the data is a struct.
 //which is gob encoded before it is sent.  Gob encoder is in the broker pkg.
 // TODO: find a way to build a nats connecton pool like the MySQL connection
 //pool to speed up transactions.
 func ChatConnection(sendMsg []byte, target string) []byte {
-	var err error
-
-	nc1, err := nats.Connect(nats.DefaultURL)
-	if err != nil {
-		centerr.ErrorLog.Printf("in chatConnection connecting error %v", err)
-	}
-	defer nc1.Close()
-	msg, err := nc1.Request(target, sendMsg, 2*time.Second)
+	answer, err := request(target, sendMsg)
 	if err != nil {
 		centerr.ErrorLog.Printf("in chatConnection %s request did not complete %v",
 			target, err)
 		return []byte{}
 	}
-	return msg.Data
+	return answer
 }
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+)
+
+//answerWith makes request answer every request with the exchange, or fail
+//with err.  The returned function puts the nats request back.
+func answerWith(t *testing.T, answer *Exchange, err error) func() {
+	saved := request
+	var data []byte
+	if answer != nil {
+		var e error
+		data, e = answer.ToGob()
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	request = func(subject string, _ []byte) ([]byte, error) {
+		if subject != DBSubject {
+			t.Errorf("request on %q", subject)
+		}
+		return data, err
+	}
+	return func() { request = saved }
+}
+
+func TestRunExchange(t *testing.T) {
+	down := errors.New("nats: no servers available for connection")
+	found := &Exchange{Tables: TableRows{{ID: 7, Name: "Found"}}}
+	noRecord := &Exchange{}
+	noRecord.EncodeErr(ErrNoRecord)
+	tests := []struct {
+		name     string
+		answer   *Exchange
+		err      error
+		noRecord bool
+		rows     int
+	}{
+		{"transport", nil, down, false, 0},
+		{"no answer", nil, nil, false, 0},
+		{"no record", noRecord, nil, true, 0},
+		{"found", found, nil, false, 1},
+	}
+	for _, tt := range tests {
+		restore := answerWith(t, tt.answer, tt.err)
+		e := Exchange{Table: "users", Action: "get",
+			Tables: TableRows{{ID: 1}, {ID: 2}}}
+		err := e.runExchange()
+		restore()
+		if errors.Is(err, ErrNoRecord) != tt.noRecord {
+			t.Errorf("%s: got %v, ErrNoRecord %v", tt.name, err, tt.noRecord)
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+		if (err == nil) != (tt.answer == found) {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+		if tt.answer != nil && len(e.Tables) != tt.rows {
+			t.Errorf("%s: %d rows, want %d", tt.name, len(e.Tables), tt.rows)
+		}
+	}
+}
+
+//a dbmgr that does not answer is not a missing setting, the default is only
+//for ErrNoRecord.
+func TestGetSettingDown(t *testing.T) {
+	restore := answerWith(t, nil, errors.New("nats: timeout"))
+	defer restore()
+	_, err := GetSettingR(SettingSurveyKind)
+	if err == nil || errors.Is(err, ErrNoRecord) {
+		t.Errorf("got %v", err)
+	}
+}
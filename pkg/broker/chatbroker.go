@@ -1,11 +1,11 @@
 package broker
 
 import (
-	"github.com/saied74/toychat/pkg/centerr"
+	"fmt"
 )
 
-//GetDialog returns true if the message is a new dialog and fales if it is not.
-//If the dialog is not new, the UserMsg is populated from the dialog table.
+//GetDialog returns the open dialog of the user from the dialog table.  If the
+//user has no open dialog, the error is ErrNoRecord.
 func GetDialog(table string, id int) (*TableRow, error) {
 	msg := TableRow{ID: id}
 	msgs := TableRows{msg}
@@ -22,11 +22,13 @@ func GetDialog(table string, id int) (*TableRow, error) {
 	if err != nil {
 		return &TableRow{}, err
 	}
-	userMsg := exchange.Tables[0] //.Pick()
-	// if err != nil {
-	// 	return &Dialog{}, err
-	// }
-	return &userMsg, exchange.DecodeErr()
+	//closed dialogs stay in the table, only the open one is ongoing.
+	for _, userMsg := range exchange.Tables {
+		if userMsg.IsOpen() {
+			return &userMsg, exchange.DecodeErr()
+		}
+	}
+	return &TableRow{}, ErrNoRecord
 }
 
 //MakeDialog creates a new entry in the dialog table and returns the dialog_id
@@ -82,13 +84,31 @@ func SelectAgent() (agentID int, err error) {
 	return userMsg.AgentID, err
 }
 
-//EnterMsg adds the next messsage into the message table
-func EnterMsg(table string, dialogID int, message string) error {
-	msg := TableRow{DialogID: dialogID, Msg: message}
+//RequeueR takes the open dialogs away from the agent so they are picked up
+//by the next available agent, and resets the agent's dialog count.
+func RequeueR(agentID int) error {
+	exchange := Exchange{
+		Table:  "dialogs",
+		Tables: TableRows{TableRow{AgentID: agentID}},
+		Action: "requeue",
+	}
+	return exchange.runExchange()
+}
+
+//Senders of a message.
+const (
+	SenderUser  = "user"
+	SenderAgent = "agent"
+)
+
+//EnterMsg adds the next messsage into the message table.  sender is
+//SenderUser or SenderAgent.
+func EnterMsg(table string, dialogID int, sender, message string) error {
+	msg := TableRow{DialogID: dialogID, Sender: sender, Msg: message}
 	msgs := TableRows{msg}
 	exchange := Exchange{
 		Table:  table,
-		Put:    []string{"dialog_id", "created", "message"},
+		Put:    []string{"dialog_id", "created", "sender", "message"},
 		Tables: msgs,
 		Action: "insert",
 	}
@@ -101,8 +121,64 @@ func EnterMsg(table string, dialogID int, message string) error {
 
 }
 
-//MessageAgent sends a message to the agent and gets the reply
+//ChatSubject is the nats subject of the chat service, see subject.chat of
+//pkg/config.
+var ChatSubject = "forChat"
+
+//MessageAgent sends a message to the agent and gets the reply, empty when the
+//agent has none.  The chat service answers for the agents.
 func MessageAgent(agentID, userID int, message string) (string, error) {
-	centerr.InfoLog.Printf("and the message is: %s", message)
-	return "", nil
+	reply, err := request(ChatSubject, []byte(message))
+	if err != nil {
+		return "", fmt.Errorf("message to agent %d: %w", agentID, err)
+	}
+	return string(reply), nil
+}
+
+//ReplyR sends the message of the user to the agent and stores the reply, if
+//there is one, as a SenderAgent message of the dialog.
+func ReplyR(dialogID, agentID, userID int, message string) (string, error) {
+	reply, err := MessageAgent(agentID, userID, message)
+	if err != nil || reply == "" {
+		return "", err
+	}
+	return reply, EnterMsg("messages", dialogID, SenderAgent, reply)
+}
+
+//UnansweredR returns the messages the user sent in the dialog after the last
+//reply of the agent, in the order they were sent, with Msg set.  The dialog
+//has to be the user's.
+func UnansweredR(dialogID, userID int) (TableRows, error) {
+	exchange := Exchange{
+		Table:  "messages",
+		Tables: TableRows{{DialogID: dialogID, ID: userID}},
+		Action: "unanswered",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
+
+//ForwardR sends the messages of the user the agent has not answered yet to the
+//agent, in order, and stores each reply as a SenderAgent message of the
+//dialog.  The messages sent while the dialog was queued go to the agent with
+//the first one after it is assigned.  It returns the replies.
+func ForwardR(dialogID, agentID, userID int) ([]string, error) {
+	msgs, err := UnansweredR(dialogID, userID)
+	if err != nil {
+		return nil, err
+	}
+	replies := []string{}
+	for _, msg := range msgs {
+		reply, err := ReplyR(dialogID, agentID, userID, msg.Msg)
+		if err != nil {
+			return replies, err
+		}
+		if reply != "" {
+			replies = append(replies, reply)
+		}
+	}
+	return replies, nil
 }
@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+//chatStub stands in for the dbmgr, with the messages of one dialog of one
+//user, and for the chat service, which answers in capitals.
+type chatStub struct {
+	t        *testing.T
+	dialogID int
+	userID   int
+	msgs     TableRows
+	sent     []string
+	down     bool
+}
+
+func (s *chatStub) request(subject string, data []byte) ([]byte, error) {
+	if subject == ChatSubject {
+		if s.down {
+			return nil, errors.New("nats: timeout")
+		}
+		s.sent = append(s.sent, string(data))
+		return []byte(strings.ToUpper(string(data))), nil
+	}
+	_, payload, err := NewVerifier(nil, time.Minute).Open(data, time.Now())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	e := &Exchange{}
+	err = e.FromGob(payload)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	switch e.Action {
+	case "unanswered":
+		d := e.Tables[0]
+		unanswered := TableRows{}
+		if d.DialogID == s.dialogID && d.ID == s.userID {
+			for _, m := range s.msgs {
+				if m.Sender == SenderAgent {
+					unanswered = TableRows{}
+				} else {
+					unanswered = append(unanswered, m)
+				}
+			}
+		}
+		e.Tables = unanswered
+		e.EncodeErr(nil)
+	case "insert":
+		for _, m := range e.Tables {
+			if m.DialogID != s.dialogID {
+				s.t.Errorf("message of dialog %d", m.DialogID)
+			}
+			s.msgs = append(s.msgs, m)
+		}
+		e.EncodeErr(nil)
+	default:
+		s.t.Fatalf("unexpected %s on %s", e.Action, e.Table)
+	}
+	return e.ToGob()
+}
+
+func (s *chatStub) senders() string {
+	senders := []string{}
+	for _, m := range s.msgs {
+		senders = append(senders, m.Sender+":"+m.Msg)
+	}
+	return strings.Join(senders, ",")
+}
+
+//the reply of the agent is stored as the agent's, which is what the first
+//response and abandonment of the reports count.
+func TestReply(t *testing.T) {
+	s := &chatStub{t: t, dialogID: 5}
+	saved := request
+	request = s.request
+	defer func() { request = saved }()
+
+	err := EnterMsg("messages", 5, SenderUser, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ReplyR(5, 3, 9, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "HELLO" || len(s.sent) != 1 || s.sent[0] != "hello" {
+		t.Errorf("sent %q, reply %q", s.sent, reply)
+	}
+	if got := s.senders(); got != "user:hello,agent:HELLO" {
+		t.Errorf("stored %q", got)
+	}
+
+	//nothing is stored for the agent when the chat service does not answer.
+	s.down = true
+	_, err = ReplyR(5, 3, 9, "bye")
+	if err == nil || errors.Is(err, ErrNoRecord) {
+		t.Errorf("chat down: got %v", err)
+	}
+	if len(s.msgs) != 2 {
+		t.Errorf("stored %q", s.senders())
+	}
+}
+
+//the messages of a queued dialog go to the agent, in order, when it is
+//assigned, and the agent's replies are stored as the agent's.
+func TestForwardQueued(t *testing.T) {
+	s := &chatStub{t: t, dialogID: 5, userID: 9, msgs: TableRows{
+		{DialogID: 5, Sender: SenderUser, Msg: "hello"},
+		{DialogID: 5, Sender: SenderUser, Msg: "anyone there"},
+	}}
+	saved := request
+	request = s.request
+	defer func() { request = saved }()
+
+	replies, err := ForwardR(5, 3, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s.sent, ","); got != "hello,anyone there" {
+		t.Errorf("sent %q", got)
+	}
+	if got := strings.Join(replies, ","); got != "HELLO,ANYONE THERE" {
+		t.Errorf("replies %q", got)
+	}
+	want := "user:hello,user:anyone there,agent:HELLO,agent:ANYONE THERE"
+	if got := s.senders(); got != want {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+
+	//once answered only the new message goes.
+	s.sent = nil
+	s.msgs = append(s.msgs, TableRow{DialogID: 5, Sender: SenderUser,
+		Msg: "thanks"})
+	replies, err = ForwardR(5, 3, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sent) != 1 || s.sent[0] != "thanks" || len(replies) != 1 {
+		t.Errorf("sent %q, replies %q", s.sent, replies)
+	}
+
+	//nothing is stored for the agent when the chat service does not answer,
+	//the message stays unanswered for the next time.
+	s.down = true
+	s.msgs = append(s.msgs, TableRow{DialogID: 5, Sender: SenderUser,
+		Msg: "bye"})
+	_, err = ForwardR(5, 3, 9)
+	if err == nil || errors.Is(err, ErrNoRecord) {
+		t.Errorf("chat down: got %v", err)
+	}
+	if last := s.msgs[len(s.msgs)-1]; last.Sender != SenderUser {
+		t.Errorf("stored %q for the agent", last.Msg)
+	}
+}
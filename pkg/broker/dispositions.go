@@ -0,0 +1,189 @@
+//this file contains the broker methods for disposition codes, tags, wrap up
+//notes and the settings table.
+
+package broker
+
+import (
+	"errors"
+	"strconv"
+)
+
+//Names of the rows in the settings table.
+const (
+	//SettingRequireDisposition is "true" when agents must pick a disposition
+	//code when closing a dialog.
+	SettingRequireDisposition = "require_disposition"
+)
+
+//GetSettingR gets the value of the named setting from the settings table.
+func GetSettingR(name string) (string, error) {
+	people := TableRows{TableRow{Name: name}}
+	exchange := Exchange{
+		Table:    "settings",
+		Put:      []string{},
+		SpecList: []string{"name"},
+		Get:      []string{"name", "value"},
+		Tables:   people,
+		Action:   "get",
+	}
+	err := exchange.runGetExchange(people, exchange.SpecList)
+	if err != nil {
+		return "", err
+	}
+	return exchange.Tables[0].Value, nil
+}
+
+//GetSettingBoolR is GetSettingR for true/false settings.  A missing setting is false.
+func GetSettingBoolR(name string) (bool, error) {
+	value, err := GetSettingR(name)
+	if err != nil {
+		if errors.Is(err, ErrNoRecord) {
+			return false, nil
+		}
+		return false, err
+	}
+	b, _ := strconv.ParseBool(value)
+	return b, nil
+}
+
+//PutSettingR updates the value of the named setting.
+func PutSettingR(name, value string) error {
+	people := TableRows{TableRow{Name: name, Value: value}}
+	exchange := Exchange{
+		Table:    "settings",
+		Put:      []string{"value"},
+		SpecList: []string{"name"},
+		Tables:   people,
+		Action:   "put",
+	}
+	for _, p := range people {
+		c := p.Specify(exchange.Put, exchange.SpecList)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//GetDispositionsR gets the disposition codes, all of them or only the active ones.
+func GetDispositionsR(activeOnly bool) (TableRows, error) {
+	return getCodes("dispositions", []string{"id", "code", "label", "active"},
+		activeOnly)
+}
+
+//GetTagsR gets the dialog tags, all of them or only the active ones.
+func GetTagsR(activeOnly bool) (TableRows, error) {
+	return getCodes("tags", []string{"id", "name", "active"}, activeOnly)
+}
+
+func getCodes(table string, get []string, activeOnly bool) (TableRows, error) {
+	people := TableRows{TableRow{Active: true}}
+	exchange := Exchange{
+		Table:    table,
+		Put:      []string{},
+		SpecList: []string{},
+		Get:      get,
+		Tables:   people,
+		Action:   "get",
+	}
+	if activeOnly {
+		exchange.SpecList = []string{"active"}
+	}
+	err := exchange.runGetExchange(people, exchange.SpecList)
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
+
+//InsertDispositionR adds a disposition code.
+func InsertDispositionR(code, label string) error {
+	return insertCode("dispositions", []string{"code", "label", "active"},
+		TableRow{Code: code, Label: label, Active: true})
+}
+
+//InsertTagR adds a dialog tag.
+func InsertTagR(name string) error {
+	return insertCode("tags", []string{"name", "active"},
+		TableRow{Name: name, Active: true})
+}
+
+func insertCode(table string, put []string, row TableRow) error {
+	people := TableRows{row}
+	exchange := Exchange{
+		Table:  table,
+		Put:    put,
+		Tables: people,
+		Action: "insert",
+	}
+	for _, p := range people {
+		c := p.BuildInsert(exchange.Put)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//CodeActivationR activates or deactivates the dispositions or tags in people.
+//Codes are never deleted since closed dialogs refer to them.
+func CodeActivationR(table string, people *TableRows) error {
+	exchange := Exchange{
+		Table:    table,
+		Put:      []string{"active"},
+		SpecList: []string{"id"},
+		Tables:   *people,
+		Action:   "put",
+	}
+	for _, p := range *people {
+		c := p.Specify(exchange.Put, exchange.SpecList)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//OpenDialogsR gets the dialogs of the agent that have not been closed.
+func OpenDialogsR(agentID int) (TableRows, error) {
+	msgs := TableRows{TableRow{AgentID: agentID}}
+	exchange := Exchange{
+		Table:    "dialogs",
+		Put:      []string{},
+		SpecList: []string{"agent_id"},
+		Get:      []string{"dialog_id", "user_id", "agent_id", "started", "ended"},
+		Tables:   msgs,
+		Action:   "get",
+	}
+	err := exchange.runGetExchange(msgs, exchange.SpecList)
+	if err != nil {
+		return nil, err
+	}
+	open := TableRows{}
+	for _, d := range exchange.Tables {
+		if d.IsOpen() {
+			open = append(open, d)
+		}
+	}
+	if len(open) == 0 {
+		return nil, ErrNoRecord
+	}
+	return open, nil
+}
+
+//IsOpen reports whether the dialog row has not been closed.  Open dialogs
+//still carry the default ended time which is before started.
+func (p *TableRow) IsOpen() bool {
+	return p.Ended.Before(p.Created)
+}
+
+//CloseDialogR closes the agent's dialog with the disposition (zero for none),
+//the wrap up notes and the tags.
+func CloseDialogR(dialogID, agentID, dispositionID int, wrapup string,
+	tags []int) error {
+	msgs := TableRows{TableRow{DialogID: dialogID, AgentID: agentID,
+		DispositionID: dispositionID, Wrapup: wrapup}}
+	for _, t := range tags {
+		msgs = append(msgs, TableRow{TagID: t})
+	}
+	exchange := Exchange{
+		Table:  "dialogs",
+		Tables: msgs,
+		Action: "close",
+	}
+	return exchange.runExchange()
+}
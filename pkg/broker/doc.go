@@ -72,8 +72,9 @@ and backend follow the following pattern:
 
 runExchange is helper function that handles boilerplate code to Register
 gob encorders, gob encode, exchange message and reply over nats with dbmger
-gob decoded and decode error (more on this later).  runGetExchange first builds
-the Spec field and then runs runExchange.
+gob decoded and decode error (more on this later).  The gob of the exchange
+is sent in an Envelope signed as SetCaller set, see sign.go.  runGetExchange
+first builds the Spec field and then runs runExchange.
 
 // TODO: This stuff can be further simplified.  Dobule slice may not be necessary.
 
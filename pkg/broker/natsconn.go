@@ -0,0 +1,167 @@
+//this file contains how the services connect to the nats server: the address,
+//TLS and the credentials.  Each service loads them with pkg/config, which
+//hands them to SetNATS, and then connects with Connect.  See
+//natsconf/server.conf for the accounts and subject permissions of the services
+//on the server side.
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/saied74/toychat/pkg/secret"
+)
+
+//NATSConfig is how a service connects to the nats server.  At most one of the
+//credentials (token, user and password, credentials file or nkey seed) is
+//given.  The secrets are read from files so they are not on the command line.
+type NATSConfig struct {
+	URL          string //nats://host:port or tls://host:port
+	Name         string //name of the service in the server's monitoring
+	TokenFile    string //file holding the authentication token
+	User         string //user of the user and password authentication
+	PasswordFile string //file holding the password of User
+	CredsFile    string //JWT user credentials file (decentralized auth)
+	NKeyFile     string //nkey seed file
+	CAFile       string //CA the server certificate is checked with
+	CertFile     string //client certificate, for servers that verify clients
+	KeyFile      string //key of the client certificate
+}
+
+var (
+	natsMu   sync.Mutex
+	natsConf = NATSConfig{URL: nats.DefaultURL}
+	natsOpts []nats.Option
+)
+
+//SetNATS checks the configuration and makes it the one Connect uses.
+func SetNATS(c NATSConfig) error {
+	opts, err := c.Options()
+	if err != nil {
+		return err
+	}
+	natsMu.Lock()
+	defer natsMu.Unlock()
+	natsConf = c
+	natsOpts = opts
+	return nil
+}
+
+//Options are the nats connect options of the configuration.
+func (c *NATSConfig) Options() ([]nats.Option, error) {
+	opts := []nats.Option{}
+	if c.Name != "" {
+		opts = append(opts, nats.Name(c.Name))
+	}
+	creds := 0
+	for _, f := range []string{c.TokenFile, c.User, c.CredsFile, c.NKeyFile} {
+		if f != "" {
+			creds++
+		}
+	}
+	if creds > 1 {
+		return nil, errors.New("nats: give only one of token, user, " +
+			"credentials file and nkey seed")
+	}
+	switch {
+	case c.TokenFile != "":
+		token, err := secret.Read(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Token(token))
+	case c.User != "":
+		if c.PasswordFile == "" {
+			return nil, errors.New("nats: the user needs a password file")
+		}
+		pw, err := secret.Read(c.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.UserInfo(c.User, pw))
+	case c.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(c.CredsFile))
+	case c.NKeyFile != "":
+		opt, err := nats.NkeyOptionFromSeed(c.NKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("nats nkey seed: %v", err)
+		}
+		opts = append(opts, opt)
+	}
+	if c.PasswordFile != "" && c.User == "" {
+		return nil, errors.New("nats: a password file needs a user")
+	}
+	if c.CAFile != "" {
+		opts = append(opts, nats.RootCAs(c.CAFile))
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("nats: the client certificate needs its key")
+	}
+	if c.CertFile != "" {
+		opts = append(opts, nats.ClientCert(c.CertFile, c.KeyFile))
+	}
+	if strings.HasPrefix(c.URL, "tls://") {
+		opts = append(opts, nats.Secure())
+	}
+	return opts, nil
+}
+
+//Connect connects to the nats server as SetNATS configured.
+func Connect() (*nats.Conn, error) {
+	natsMu.Lock()
+	url, opts := natsConf.URL, natsOpts
+	natsMu.Unlock()
+	return nats.Connect(url, opts...)
+}
+
+//Inbox is a new reply subject of the service, _INBOX_<name>.<unique>, so the
+//server can let each service read only the replies to its own requests.
+//Without a name it is the usual _INBOX.<unique>.
+func Inbox() string {
+	natsMu.Lock()
+	name := natsConf.Name
+	natsMu.Unlock()
+	inbox := nats.NewInbox()
+	if name == "" {
+		return inbox
+	}
+	return "_INBOX_" + name + "." + strings.TrimPrefix(inbox, nats.InboxPrefix)
+}
+
+//Request sends the request and waits for the answer as nc.Request does, but
+//on an Inbox of the service.
+func Request(nc *nats.Conn, subject string, data []byte,
+	timeout time.Duration) (*nats.Msg, error) {
+	inbox := Inbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	err = nc.PublishRequest(subject, inbox, data)
+	if err != nil {
+		return nil, err
+	}
+	return sub.NextMsg(timeout)
+}
+
+//request sends data on subject and returns the answer, with an error when it
+//cannot connect or nothing answers in time.  It is a variable so the tests can
+//answer in place of the nats server.
+var request = func(subject string, data []byte) ([]byte, error) {
+	nc1, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer nc1.Close()
+	msg, err := Request(nc1, subject, data, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
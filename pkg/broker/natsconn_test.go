@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNATSOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natsconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	err = ioutil.WriteFile(secret, []byte("s3cret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	err = ioutil.WriteFile(empty, []byte("\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		c    NATSConfig
+		opts int
+		ok   bool
+	}{
+		{"none", NATSConfig{URL: "nats://localhost:4222"}, 0, true},
+		{"token", NATSConfig{Name: "web", TokenFile: secret}, 2, true},
+		{"user", NATSConfig{User: "dbmgr", PasswordFile: secret}, 1, true},
+		{"tls", NATSConfig{URL: "tls://localhost:4222", CertFile: "c",
+			KeyFile: "k"}, 2, true},
+		{"no password", NATSConfig{User: "dbmgr"}, 0, false},
+		{"no user", NATSConfig{PasswordFile: secret}, 0, false},
+		{"empty token", NATSConfig{TokenFile: empty}, 0, false},
+		{"missing token", NATSConfig{TokenFile: filepath.Join(dir, "none")}, 0,
+			false},
+		{"two", NATSConfig{TokenFile: secret, CredsFile: "creds"}, 0, false},
+		{"cert without key", NATSConfig{CertFile: "c"}, 0, false},
+	}
+	for _, tt := range tests {
+		opts, err := tt.c.Options()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if len(opts) != tt.opts {
+			t.Errorf("%s: got %d options, want %d", tt.name, len(opts), tt.opts)
+		}
+	}
+}
+
+func TestInbox(t *testing.T) {
+	defer SetNATS(NATSConfig{URL: "nats://localhost:4222"})
+	err := SetNATS(NATSConfig{URL: "nats://localhost:4222", Name: "frontend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := Inbox(), Inbox()
+	if !strings.HasPrefix(a, "_INBOX_frontend.") || a == b {
+		t.Errorf("inboxes %q and %q", a, b)
+	}
+	SetNATS(NATSConfig{URL: "nats://localhost:4222"})
+	if !strings.HasPrefix(Inbox(), "_INBOX.") {
+		t.Errorf("inbox without a name %q", Inbox())
+	}
+}
@@ -0,0 +1,58 @@
+//this file contains the broker methods of the role and permission model of
+//the back end.  Roles and what they are allowed to do are kept in the roles
+//and role_permissions tables so a new role is added with data, not code.
+
+package broker
+
+//Permissions a route or an operation of the back end can require.
+const (
+	PermManageAdmins    = "manage_admins"    //add, activate and edit admins
+	PermManageAgents    = "manage_agents"    //add, activate and edit agents
+	PermManageUsers     = "manage_users"     //search and edit end users
+	PermManageSettings  = "manage_settings"  //dispositions, tags and surveys
+	PermManageSecurity  = "manage_security"  //two-factor login policy
+	PermViewTranscripts = "view_transcripts" //search and read dialogs
+	PermViewReports     = "view_reports"     //reports and agent status
+	PermViewAudit       = "view_audit"       //the audit log
+	PermExport          = "export"           //export transcripts
+	PermChat            = "chat"             //take dialogs as an agent
+)
+
+//AllPermissions lists the permissions in display order.
+var AllPermissions = []string{PermManageAdmins, PermManageAgents,
+	PermManageUsers, PermManageSettings, PermManageSecurity, PermViewTranscripts,
+	PermViewReports, PermViewAudit, PermExport, PermChat}
+
+//RoleGrant is a role with the console (super, admin or agent) its accounts
+//log in to and the permissions it has.
+type RoleGrant struct {
+	Name        string
+	Label       string
+	Console     string
+	Permissions map[string]bool
+}
+
+//RolesR returns all the roles with their permissions, keyed by the role name.
+func RolesR() (map[string]*RoleGrant, error) {
+	exchange := Exchange{
+		Table:  "roles",
+		Action: "roles",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	roles := map[string]*RoleGrant{}
+	for _, row := range exchange.Tables {
+		role, ok := roles[row.Role]
+		if !ok {
+			role = &RoleGrant{Name: row.Role, Label: row.Label, Console: row.Kind,
+				Permissions: map[string]bool{}}
+			roles[row.Role] = role
+		}
+		if row.Value != "" {
+			role.Permissions[row.Value] = true
+		}
+	}
+	return roles, nil
+}
@@ -0,0 +1,107 @@
+//this file contains the presence events published when an agent's presence
+//changes.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/saied74/toychat/pkg/centerr"
+)
+
+//PresenceSubject is the nats subject presence events are published on, see
+//subject.presence of pkg/config.
+var PresenceSubject = "presence.agent"
+
+//Reasons for a presence event.
+const (
+	ReasonLogin   = "login"   //agent logged in, Old and New are the same
+	ReasonLogout  = "logout"  //agent logged out
+	ReasonChange  = "change"  //agent changed state from the console
+	ReasonExpired = "expired" //session expired or the heartbeat was lost
+	ReasonDeleted = "deleted" //the agent's account was deleted
+)
+
+//PresenceEvent is published on PresenceSubject whenever an agent logs in or
+//the presence state changes.
+type PresenceEvent struct {
+	AgentID int
+	Name    string
+	Old     string //presence before the event
+	New     string //presence after the event
+	Reason  string
+	Time    time.Time
+}
+
+//ToGob encodes the PresenceEvent to be shipped over nats
+func (p *PresenceEvent) ToGob() ([]byte, error) {
+	b := &bytes.Buffer{}
+	enc := gob.NewEncoder(b)
+	err := enc.Encode(*p)
+	if err != nil {
+		return []byte{}, fmt.Errorf("failed gob Encode %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+//FromGob decodes the PresenceEvent shipped over nats
+func (p *PresenceEvent) FromGob(g []byte) error {
+	b := bytes.NewBuffer(g)
+	dec := gob.NewDecoder(b)
+	err := dec.Decode(p)
+	if err != nil {
+		return fmt.Errorf("failed presence gob decode %v", err)
+	}
+	return nil
+}
+
+//PublishPresence publishes the event on PresenceSubject.  Nobody replies to
+//presence events so this does not wait for an answer.
+func PublishPresence(p *PresenceEvent) error {
+	nc1, err := Connect()
+	if err != nil {
+		return fmt.Errorf("in PublishPresence connecting error %v", err)
+	}
+	defer nc1.Close()
+	return PublishPresenceConn(nc1, p)
+}
+
+//PublishPresenceConn is PublishPresence for callers that hold a connection.
+func PublishPresenceConn(conn *nats.Conn, p *PresenceEvent) error {
+	data, err := p.ToGob()
+	if err != nil {
+		return err
+	}
+	err = conn.Publish(PresenceSubject, data)
+	if err != nil {
+		return err
+	}
+	return conn.Flush()
+}
+
+//SubscribePresence calls handle for every presence event until the returned
+//function is called.
+func SubscribePresence(handle func(*PresenceEvent)) (func(), error) {
+	nc1, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	_, err = nc1.Subscribe(PresenceSubject, func(msg *nats.Msg) {
+		p := &PresenceEvent{}
+		err := p.FromGob(msg.Data)
+		if err != nil {
+			centerr.ErrorLog.Printf("presence event dropped %v", err)
+			return
+		}
+		handle(p)
+	})
+	if err != nil {
+		nc1.Close()
+		return nil, err
+	}
+	return nc1.Close, nil
+}
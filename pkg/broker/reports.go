@@ -0,0 +1,43 @@
+//this file contains the broker methods for the operational reports.  The
+//aggregation is done by the dbmgr, see the reports file there.
+
+package broker
+
+import (
+	"time"
+)
+
+//PeriodHour groups the volume report by hour, see PeriodDay for the others.
+const PeriodHour = "hour"
+
+//VolumeReportR aggregates the dialogs started between from and to by period
+//(PeriodHour, PeriodDay, PeriodWeek or PeriodMonth).  Each row has the Period,
+//the number of dialogs in Count, the average handle time of the closed
+//dialogs in Average, the average first response in Response (both in
+//seconds) and the abandonment rate in Score (percent of the closed dialogs
+//that never got an agent message, the replies ReplyR stores).
+func VolumeReportR(period string, from, to time.Time) (TableRows, error) {
+	return runReport("volumeReport", TableRow{Period: period, Created: from,
+		Ended: to})
+}
+
+//AgentReportR aggregates the dialogs started between from and to by agent.
+//Each row has the agent in AgentID and Name, the number of dialogs in Count,
+//Average and Response as in VolumeReportR and the utilisation in Score (the
+//percent of the agent's capacity that was taken by dialogs over the range).
+func AgentReportR(from, to time.Time) (TableRows, error) {
+	return runReport("agentReport", TableRow{Created: from, Ended: to})
+}
+
+func runReport(action string, filter TableRow) (TableRows, error) {
+	exchange := Exchange{
+		Table:  "dialogs",
+		Tables: TableRows{filter},
+		Action: action,
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
@@ -0,0 +1,66 @@
+//this file contains the broker methods for the self-service password reset.
+//The link mailed to the user carries a random token, only its hash is kept in
+//the resets table (see dbscripts/resets.txt) so a copy of the database cannot
+//be used to reset passwords.
+
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+//ResetTTL is how long a password reset link can be used.
+const ResetTTL = time.Hour
+
+//NewToken returns a random url safe token and its hash for the database.
+func NewToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+//HashToken returns the hash of a token as it is kept in the database.
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+//CreateResetR records a password reset token (its hash) for the account with
+//the id in table (users or admins), good until expires.  The earlier tokens of
+//the account can no longer be used.
+func CreateResetR(table string, accountID int, hash string, expires time.Time) error {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: accountID, Token: hash, Ended: expires.UTC()}},
+		Action: "createReset",
+	}
+	return exchange.runExchange()
+}
+
+//UseResetR sets the (hashed) password of the account the token hash was
+//issued for, if the token is neither used nor expired, and uses up the token.
+//The reset also clears a forced password change.  The account is returned
+//with the ID, Name and Email, ErrNoRecord if the token is not good.
+func UseResetR(table, hash, password string) (*TableRow, error) {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{Token: hash, HashedPassword: password}},
+		Action: "useReset",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	if len(exchange.Tables) == 0 {
+		return nil, ErrNoRecord
+	}
+	return &exchange.Tables[0], nil
+}
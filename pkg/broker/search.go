@@ -0,0 +1,24 @@
+//this file contains the broker method for the message search.  See the search
+//package for the rules of a search.
+
+package broker
+
+//SearchR finds up to filter.Count messages with all the words of filter.Msg,
+//the newest first.  The other filters are used when they are set: AgentID,
+//Name (email or name of the user), Created and Ended (the range of the
+//message, Ended not included) and State (open or closed).  Each row has the
+//MessageID, Created, Sender and Msg of the message, the DialogID and State of
+//its dialog, the user in ID, Name and Email and the agent in AgentID and
+//AgentName.
+func SearchR(filter TableRow) (TableRows, error) {
+	exchange := Exchange{
+		Table:  "messages",
+		Tables: TableRows{filter},
+		Action: "search",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
@@ -0,0 +1,104 @@
+//this file contains the broker methods of the session index of both web apps.
+//A login gets a random session id that is kept in the session and, hashed, in
+//the session_index table (see dbscripts/sessions.txt) with the account, the
+//client and when it was last seen.  A session whose row is gone is logged out
+//at its next request, that is how sessions are revoked.
+
+package broker
+
+import (
+	"time"
+)
+
+//SessionSeenEvery is how often the last seen time of a session is updated.
+const SessionSeenEvery = time.Minute
+
+//StartSessionR indexes a new session of the account with the id in table
+//(users or admins) and returns its session id, to be kept in the session.
+func StartSessionR(table string, accountID int, ip, userAgent string) (string,
+	error) {
+	sid, hash, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	exchange := Exchange{
+		Table: table,
+		Tables: TableRows{{ID: accountID, Token: hash, IP: ip,
+			UserAgent: userAgent}},
+		Action: "startSession",
+	}
+	return sid, exchange.runExchange()
+}
+
+//SeenSessionR checks that the session is still there for the account and
+//notes that it was seen.  It returns ErrNoRecord for a revoked session.
+func SeenSessionR(table, sid string, accountID int) error {
+	if sid == "" {
+		return ErrNoRecord
+	}
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: accountID, Token: HashToken(sid)}},
+		Action: "seenSession",
+	}
+	return exchange.runExchange()
+}
+
+//EndSessionR removes the session from the index, at logout.
+func EndSessionR(table, sid string) error {
+	if sid == "" {
+		return nil
+	}
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{Token: HashToken(sid)}},
+		Action: "endSession",
+	}
+	return exchange.runExchange()
+}
+
+//SessionsR returns the sessions of the account, the last seen first.  The one
+//with the session id sid is marked Current.  ID is the id of the session row.
+func SessionsR(table string, accountID int, sid string) (TableRows, error) {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: accountID}},
+		Action: "sessions",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	current := HashToken(sid)
+	for i := range exchange.Tables {
+		exchange.Tables[i].Current = exchange.Tables[i].Token == current
+		exchange.Tables[i].Token = ""
+	}
+	return exchange.Tables, nil
+}
+
+//RevokeSessionR revokes the session with the row id sessionID if it is one of
+//the account's.
+func RevokeSessionR(table string, accountID, sessionID int) error {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: accountID}, {ID: sessionID}},
+		Action: "revokeSession",
+	}
+	return exchange.runExchange()
+}
+
+//RevokeSessionsR revokes all the sessions of the account but the one with the
+//session id keep, all of them when keep is empty.
+func RevokeSessionsR(table string, accountID int, keep string) error {
+	hash := ""
+	if keep != "" {
+		hash = HashToken(keep)
+	}
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: accountID, Token: hash}},
+		Action: "revokeSessions",
+	}
+	return exchange.runExchange()
+}
@@ -0,0 +1,159 @@
+//this file contains the signed envelope the exchanges travel to the dbmgr in.
+//The envelope names the caller (the service sending it) and carries the time,
+//a random nonce and an HMAC-SHA256 of all of it and the gob encoded exchange
+//under the caller's key.  The dbmgr checks the HMAC with its copy of the key,
+//refuses envelopes outside its time window and envelopes it has already seen,
+//and then applies the policy of the caller.
+
+package broker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/saied74/toychat/pkg/secret"
+)
+
+//Callers of the dbmgr.
+const (
+	CallerFrontend = "frontend"
+	CallerBackend  = "backend"
+)
+
+//Errors returned by Verifier.Open.
+var (
+	ErrBadSignature = errors.New("broker: bad signature")
+	ErrStale        = errors.New("broker: request outside the time window")
+	ErrReplay       = errors.New("broker: request replayed")
+)
+
+//Envelope is what is sent to the dbmgr, Payload is the gob of the exchange.
+type Envelope struct {
+	Caller  string
+	Time    int64 //unix nanoseconds when it was sealed
+	Nonce   []byte
+	Payload []byte
+	MAC     []byte //empty when the caller has no key
+}
+
+var (
+	callerMu  sync.Mutex
+	callerID  string
+	callerKey []byte
+)
+
+//SetCaller sets who this process is to the dbmgr and the key its requests are
+//signed with.  Without a key the requests are not signed, which only a dbmgr
+//run without keys accepts.
+func SetCaller(name string, key []byte) {
+	callerMu.Lock()
+	defer callerMu.Unlock()
+	callerID = name
+	callerKey = key
+}
+
+//SetCallerFile is SetCaller with the key read from the file, no key for an
+//empty file name.
+func SetCallerFile(name, keyFile string) error {
+	var key []byte
+	if keyFile != "" {
+		var err error
+		key, err = secret.ReadKey(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	SetCaller(name, key)
+	return nil
+}
+
+//seal puts the payload in an envelope signed as SetCaller set and gob encodes it.
+func seal(payload []byte, now time.Time) ([]byte, error) {
+	callerMu.Lock()
+	name, key := callerID, callerKey
+	callerMu.Unlock()
+	env := Envelope{Caller: name, Time: now.UnixNano(), Nonce: make([]byte, 12),
+		Payload: payload}
+	_, err := rand.Read(env.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 0 {
+		env.MAC = env.mac(key)
+	}
+	b := &bytes.Buffer{}
+	err = gob.NewEncoder(b).Encode(env)
+	if err != nil {
+		return nil, fmt.Errorf("failed envelope gob encode %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+func (env *Envelope) mac(key []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(env.Caller))
+	m.Write([]byte{0})
+	binary.Write(m, binary.BigEndian, env.Time)
+	m.Write(env.Nonce)
+	m.Write(env.Payload)
+	return m.Sum(nil)
+}
+
+//Verifier opens the envelopes on the dbmgr side.
+type Verifier struct {
+	Keys   map[string][]byte //key of each caller, none checks nothing
+	Window time.Duration     //how far the time of an envelope may be off
+	mu     sync.Mutex
+	seen   map[string]time.Time //MACs in the window and when they expire
+	purged time.Time
+}
+
+//NewVerifier returns a Verifier with the keys of the callers.
+func NewVerifier(keys map[string][]byte, window time.Duration) *Verifier {
+	return &Verifier{Keys: keys, Window: window, seen: map[string]time.Time{}}
+}
+
+//Open decodes the envelope and returns the caller and the payload.  With keys
+//the caller has to have one, the MAC has to be right, the time in the window
+//and the envelope not seen before.  Without keys the caller is taken as it is.
+func (v *Verifier) Open(data []byte, now time.Time) (string, []byte, error) {
+	env := Envelope{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&env)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed envelope gob decode %v", err)
+	}
+	if len(v.Keys) == 0 {
+		return env.Caller, env.Payload, nil
+	}
+	key, ok := v.Keys[env.Caller]
+	if !ok || !hmac.Equal(env.MAC, env.mac(key)) {
+		return env.Caller, nil, ErrBadSignature
+	}
+	sent := time.Unix(0, env.Time)
+	if sent.Before(now.Add(-v.Window)) || sent.After(now.Add(v.Window)) {
+		return env.Caller, nil, ErrStale
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.purged) > v.Window {
+		for mac, expires := range v.seen {
+			if now.After(expires) {
+				delete(v.seen, mac)
+			}
+		}
+		v.purged = now
+	}
+	if _, ok := v.seen[string(env.MAC)]; ok {
+		return env.Caller, nil, ErrReplay
+	}
+	v.seen[string(env.MAC)] = sent.Add(v.Window)
+	return env.Caller, env.Payload, nil
+}
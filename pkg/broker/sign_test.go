@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := []byte("0123456789abcdef0123")
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	v := NewVerifier(map[string][]byte{CallerFrontend: key}, 30*time.Second)
+	SetCaller(CallerFrontend, key)
+	defer SetCaller("", nil)
+
+	data, err := seal([]byte("exchange"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller, payload, err := v.Open(data, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caller != CallerFrontend || string(payload) != "exchange" {
+		t.Errorf("opened %q %q", caller, payload)
+	}
+	_, _, err = v.Open(data, now.Add(2*time.Second))
+	if !errors.Is(err, ErrReplay) {
+		t.Errorf("replay: got %v", err)
+	}
+
+	data, _ = seal([]byte("exchange"), now)
+	_, _, err = v.Open(data, now.Add(time.Minute))
+	if !errors.Is(err, ErrStale) {
+		t.Errorf("stale: got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(env *Envelope)
+	}{
+		{"payload", func(env *Envelope) { env.Payload = []byte("changed") }},
+		{"caller", func(env *Envelope) { env.Caller = CallerBackend }},
+		{"time", func(env *Envelope) { env.Time++ }},
+		{"unsigned", func(env *Envelope) { env.MAC = nil }},
+	}
+	for _, tt := range tests {
+		data, _ = seal([]byte("exchange"), now)
+		env := Envelope{}
+		gob.NewDecoder(bytes.NewReader(data)).Decode(&env)
+		tt.change(&env)
+		b := &bytes.Buffer{}
+		gob.NewEncoder(b).Encode(env)
+		_, _, err = v.Open(b.Bytes(), now)
+		if !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestOpenUnsigned(t *testing.T) {
+	SetCaller(CallerBackend, nil)
+	defer SetCaller("", nil)
+	data, err := seal([]byte("exchange"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller, payload, err := NewVerifier(nil, time.Second).Open(data,
+		time.Now().Add(time.Hour))
+	if err != nil || caller != CallerBackend || string(payload) != "exchange" {
+		t.Errorf("got %q %q %v", caller, payload, err)
+	}
+}
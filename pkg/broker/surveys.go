@@ -0,0 +1,90 @@
+//this file contains the broker methods for the post chat survey.
+
+package broker
+
+import (
+	"time"
+)
+
+//Survey kinds.  CSAT is rated 1 to 5, NPS is rated 0 to 10.
+const (
+	CSAT = "csat"
+	NPS  = "nps"
+)
+
+//Survey settings in the settings table.
+const (
+	SettingSurveyEnabled  = "survey_enabled"  //"true" to ask for a survey
+	SettingSurveyKind     = "survey_kind"     //CSAT or NPS
+	SettingSurveyQuestion = "survey_question" //question shown to the user
+)
+
+//Periods the survey aggregates can be grouped by.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+//RatingRange returns the lowest and highest rating of the survey kind.
+func RatingRange(kind string) (int, int) {
+	if kind == NPS {
+		return 0, 10
+	}
+	return 1, 5
+}
+
+//PendingSurveyR gets the user's most recently closed dialog that has not been
+//surveyed yet.  ErrNoRecord if there is none.
+func PendingSurveyR(userID int) (*TableRow, error) {
+	exchange := Exchange{
+		Table:  "surveys",
+		Tables: TableRows{TableRow{ID: userID}},
+		Action: "pendingSurvey",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return &TableRow{}, err
+	}
+	if len(exchange.Tables) == 0 {
+		return &TableRow{}, ErrNoRecord
+	}
+	return &exchange.Tables[0], nil
+}
+
+//InsertSurveyR stores the survey answer against the dialog and its agent.
+func InsertSurveyR(dialogID, agentID, userID int, kind string, rating int,
+	comment string) error {
+	msgs := TableRows{TableRow{DialogID: dialogID, AgentID: agentID, ID: userID,
+		Kind: kind, Rating: rating, Comment: comment}}
+	exchange := Exchange{
+		Table: "surveys",
+		Put: []string{"dialog_id", "agent_id", "user_id", "kind", "rating",
+			"comment", "created"},
+		Tables: msgs,
+		Action: "insert",
+	}
+	for _, m := range msgs {
+		c := m.BuildInsert(exchange.Put)
+		exchange.Spec = append(exchange.Spec, c)
+	}
+	return exchange.runExchange()
+}
+
+//SurveyStatsR aggregates the surveys of the kind per agent and period between
+//from and to.  Each row has the agent in AgentID and Name, the period, the
+//number of answers in Count, the average rating and the Score (percent
+//satisfied for CSAT, net promoter score for NPS).
+func SurveyStatsR(kind, period string, from, to time.Time) (TableRows, error) {
+	exchange := Exchange{
+		Table: "surveys",
+		Tables: TableRows{TableRow{Kind: kind, Period: period, Created: from,
+			Ended: to}},
+		Action: "surveyStats",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
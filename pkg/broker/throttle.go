@@ -0,0 +1,65 @@
+//this file contains the broker methods for the login throttling of both web
+//apps, see pkg/throttle for the policy.  Accounts are keyed by the table and
+//the email so the same address is counted separately in the two apps.
+
+package broker
+
+import (
+	"time"
+
+	"github.com/saied74/toychat/pkg/throttle"
+)
+
+//LoginCheckR returns until when the account (table and email) or the client
+//address is locked, the zero time if neither is.
+func LoginCheckR(table, email, ip string) (time.Time, error) {
+	exchange := Exchange{
+		Table: "lockouts",
+		Tables: TableRows{{Email: throttle.AccountKey(table, email),
+			IP: ip}},
+		Action: "loginCheck",
+	}
+	err := exchange.runExchange()
+	if err != nil || len(exchange.Tables) == 0 {
+		return time.Time{}, err
+	}
+	return exchange.Tables[0].Ended, nil
+}
+
+//LoginFailedR counts a failed login of the account and the address.  If that
+//locks one of them its kind (throttle.Account or throttle.IP) is returned with
+//the end of the lock.
+func LoginFailedR(table, email, ip string) (string, time.Time, error) {
+	exchange := Exchange{
+		Table: "lockouts",
+		Tables: TableRows{{Email: throttle.AccountKey(table, email),
+			IP: ip}},
+		Action: "loginFailed",
+	}
+	err := exchange.runExchange()
+	if err != nil || len(exchange.Tables) == 0 {
+		return "", time.Time{}, err
+	}
+	return exchange.Tables[0].Detail, exchange.Tables[0].Ended, nil
+}
+
+//LoginSucceededR forgets the failures of the account and, once its lock is
+//over, the count of its locks.
+func LoginSucceededR(table, email string) error {
+	exchange := Exchange{
+		Table:  "lockouts",
+		Tables: TableRows{{Email: throttle.AccountKey(table, email)}},
+		Action: "loginSucceeded",
+	}
+	return exchange.runExchange()
+}
+
+//UnlockR lifts the lock of the account and forgets its failures and locks.
+func UnlockR(table, email string) error {
+	exchange := Exchange{
+		Table:  "lockouts",
+		Tables: TableRows{{Email: throttle.AccountKey(table, email)}},
+		Action: "unlock",
+	}
+	return exchange.runExchange()
+}
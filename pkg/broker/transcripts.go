@@ -0,0 +1,43 @@
+//this file contains the broker methods for the transcript exports.  See the
+//transcript package for the formats and BrokerSource.
+
+package broker
+
+import (
+	"time"
+)
+
+//TranscriptsR returns up to limit dialogs with a dialog id greater than after.
+//When dialogID is not zero only that dialog is returned, otherwise the
+//dialogs started from from up to (not including) to.  Each row has the
+//DialogID, the user in ID, Name and Email, the agent in AgentID and AgentName
+//and the dialog's started and ended in Created and Ended.
+func TranscriptsR(dialogID int, from, to time.Time, after, limit int) (
+	TableRows, error) {
+	exchange := Exchange{
+		Table: "dialogs",
+		Tables: TableRows{{DialogID: dialogID, Created: from, Ended: to,
+			ID: after, Count: limit}},
+		Action: "transcripts",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
+
+//TranscriptMessagesR returns the messages of a dialog in the order they were
+//sent with Created, Sender and Msg set.
+func TranscriptMessagesR(dialogID int) (TableRows, error) {
+	exchange := Exchange{
+		Table:  "messages",
+		Tables: TableRows{{DialogID: dialogID}},
+		Action: "transcriptMessages",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
@@ -0,0 +1,88 @@
+//this file contains the broker methods for the two-factor (TOTP) login of the
+//admins and agents.  The secret and the last used time step live on the
+//admins row, the recovery codes (their hashes) in the recovery_codes table,
+//see dbscripts/twofactor.txt.
+
+package broker
+
+//SettingRequire2FA is the name of the setting that is "true" when every
+//account of the role has to use two-factor login.
+func SettingRequire2FA(role string) string {
+	return "require_2fa_" + role
+}
+
+//Require2FAR reports whether the role has to use two-factor login.
+func Require2FAR(role string) (bool, error) {
+	return GetSettingBoolR(SettingRequire2FA(role))
+}
+
+//EnableTOTPR turns on two-factor login for the account with the secret the
+//user proved to have (step is the time step of that code) and replaces the
+//recovery codes with the hashes.
+func EnableTOTPR(table string, id int, secret string, step int,
+	hashes []string) error {
+	rows := TableRows{{ID: id, TOTPSecret: secret, TOTPStep: step}}
+	for _, h := range hashes {
+		rows = append(rows, TableRow{Token: h})
+	}
+	exchange := Exchange{
+		Table:  table,
+		Tables: rows,
+		Action: "enableTOTP",
+	}
+	return exchange.runExchange()
+}
+
+//ResetTOTPR turns off two-factor login for the account and forgets the
+//secret and the recovery codes, the account enrolls again from scratch.
+func ResetTOTPR(table string, id int) error {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: id}},
+		Action: "resetTOTP",
+	}
+	return exchange.runExchange()
+}
+
+//UseTOTPStepR records step as the last used time step of the account if it is
+//after the recorded one, ErrNoRecord if it is not (the code was used before).
+func UseTOTPStepR(table string, id, step int) error {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: id, TOTPStep: step}},
+		Action: "totpStep",
+	}
+	return exchange.runExchange()
+}
+
+//UseRecoveryR uses up the recovery code with the hash, ErrNoRecord if the
+//account has no such unused code.  The number of codes left is returned.
+func UseRecoveryR(table string, id int, hash string) (int, error) {
+	exchange := Exchange{
+		Table:  table,
+		Tables: TableRows{{ID: id, Token: hash}},
+		Action: "useRecovery",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return 0, err
+	}
+	if len(exchange.Tables) == 0 {
+		return 0, nil
+	}
+	return exchange.Tables[0].Count, nil
+}
+
+//NewRecoveryR replaces the recovery codes of the account with the hashes.
+func NewRecoveryR(table string, id int, hashes []string) error {
+	rows := TableRows{{ID: id}}
+	for _, h := range hashes {
+		rows = append(rows, TableRow{Token: h})
+	}
+	exchange := Exchange{
+		Table:  table,
+		Tables: rows,
+		Action: "newRecovery",
+	}
+	return exchange.runExchange()
+}
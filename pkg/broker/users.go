@@ -0,0 +1,90 @@
+//this file contains the broker methods for managing the end users from the
+//backend: search, their dialogs, deactivation and password reset.
+
+package broker
+
+//MaxUsers is the most users FindUsersR returns.
+const MaxUsers = 100
+
+//FindUsersR returns up to MaxUsers end users whose name or email starts with
+//text (all of them when text is empty), by name.  Each row has the ID, Name,
+//Email, Created, Active, MustReset and Verified of the user.
+func FindUsersR(text string) (TableRows, error) {
+	exchange := Exchange{
+		Table:  "users",
+		Tables: TableRows{{Name: text, Count: MaxUsers}},
+		Action: "findUsers",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
+
+//UserDialogsR returns the dialogs of an end user, the newest first.  Each row
+//has the DialogID, Created (started), Ended, AgentID, AgentName, State (open
+//or closed) and the number of messages in Count.
+func UserDialogsR(userID int) (TableRows, error) {
+	exchange := Exchange{
+		Table:  "dialogs",
+		Tables: TableRows{{ID: userID}},
+		Action: "userDialogs",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.Tables, nil
+}
+
+//UserActiveR activates or deactivates an end user.  Deactivating also ends
+//the user's open dialogs and frees their agents, the number of dialogs ended
+//is returned.  A deactivated user can no longer log in or chat.
+func UserActiveR(userID int, active bool) (int, error) {
+	exchange := Exchange{
+		Table:  "users",
+		Tables: TableRows{{ID: userID, Active: active}},
+		Action: "userActive",
+	}
+	err := exchange.runExchange()
+	if err != nil {
+		return 0, err
+	}
+	if len(exchange.Tables) == 0 {
+		return 0, nil
+	}
+	return exchange.Tables[0].Count, nil
+}
+
+//ResetUserPasswordR sets the (hashed) password of an end user and forces the
+//user to change it at the next login.
+func ResetUserPasswordR(userID int, password string) error {
+	return putUser([]string{HashedPassword, MustReset},
+		TableRow{ID: userID, HashedPassword: password, MustReset: true})
+}
+
+//ChgUserPwdR changes the (hashed) password of an end user and clears a forced
+//reset.
+func ChgUserPwdR(userID int, password string) error {
+	return putUser([]string{HashedPassword, MustReset},
+		TableRow{ID: userID, HashedPassword: password, MustReset: false})
+}
+
+//VerifyUserR marks the email address of an end user as confirmed.
+func VerifyUserR(userID int) error {
+	return putUser([]string{Verified}, TableRow{ID: userID, Verified: true})
+}
+
+func putUser(put []string, person TableRow) error {
+	exchange := Exchange{
+		Table:    "users",
+		Put:      put,
+		SpecList: []string{iD},
+		Tables:   TableRows{person},
+		Action:   "put",
+	}
+	exchange.Spec = append(exchange.Spec, person.Specify(exchange.Put,
+		exchange.SpecList))
+	return exchange.runExchange()
+}
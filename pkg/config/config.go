@@ -0,0 +1,434 @@
+//Package config loads the configuration the toychat services share: the
+//database, the nats server, the nats subjects, the TLS files of the web
+//servers, the sessions, the mail server, the key of the email verification
+//links, the keys the dbmgr requests are signed with and the message key
+//file.  Each value has a default, which the -config file and then the
+//environment override.  The secrets are not in the configuration itself, it
+//only names the files they are read from, so they are neither on the command
+//line nor in the printed configuration.
+//
+//The file has a "key = value" line per setting and # comments.  Settings
+//under a [service] line only apply to that service, so one file can serve
+//all of them:
+//
+//	db.dsn = toy@tcp(db:3306)/toychat
+//	db.passwordfile = /run/secrets/db
+//	nats.url = tls://nats:4222
+//	nats.ca = certs/nats-ca.crt
+//
+//	[frontend]
+//	nats.user = frontend
+//	nats.passwordfile = /run/secrets/nats-frontend
+//
+//The environment variable of a key is TOYCHAT_ and the key in upper case with
+//the dots made underscores, TOYCHAT_NATS_URL for nats.url.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/nats-io/nats.go"
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/secret"
+)
+
+//EnvFile is the environment variable of the configuration file, the default
+//of -config.
+const EnvFile = "TOYCHAT_CONFIG"
+
+//Subjects are the nats subjects of the services.
+type Subjects struct {
+	DB       string //requests to the dbmgr
+	Chat     string //requests to chat
+	Mat      string //requests to mat
+	Presence string //agent presence events
+}
+
+//Config is the configuration of one service.
+type Config struct {
+	Service          string
+	DSN              string //MySQL data source name without the password
+	DBPasswordFile   string //file holding the database password
+	NATS             broker.NATSConfig
+	Subjects         Subjects
+	TLSCert          string //certificate of the web server
+	TLSKey           string //key of TLSCert
+	SessionLifetime  time.Duration
+	SessionCookie    string //name of the session cookie
+	VaultKeyFile     string //master keys of the messages, see pkg/vault
+	SMTPServer       string //host:port, the mails go to SMTPMailFile when empty
+	SMTPUser         string
+	SMTPPasswordFile string        //file holding the password of SMTPUser
+	SMTPFrom         string        //sender of the mails
+	SMTPMailFile     string        //file of the mails without a server, stdout when empty
+	VerifyKeyFile    string        //file holding the key of the email verification links
+	RequestKeyFile   string        //key the web app signs its dbmgr requests with
+	CallerKeys       string        //directory of the <caller>.key files of the dbmgr
+	CallerWindow     time.Duration //how far off a signed request may be
+
+	dbPassword   string
+	smtpPassword string
+	verifyKey    []byte
+	source       map[string]string //where each value came from
+}
+
+//groups of the settings each service uses, a service not in here uses all.
+var groups = map[string][]string{
+	"frontend": {"db", "nats", "subject", "tls", "session", "smtp", "verify",
+		"request"},
+	"backend": {"db", "nats", "subject", "tls", "session", "smtp", "request"},
+	"dbmgr":   {"db", "nats", "subject", "session", "vault", "callers"},
+	"chat":    {"nats", "subject"},
+	"mat":     {"nats", "subject"},
+	"su":      {"db"},
+}
+
+//cookies are the default session cookie names, the two web apps have to use
+//different ones.
+var cookies = map[string]string{"frontend": "sessionOne", "backend": "sessionTwo"}
+
+//Defaults is the configuration of the service before the file and the
+//environment.
+func Defaults(service string) *Config {
+	certs := filepath.Join(os.Getenv("GOPATH"), "src/toychat/certs")
+	c := &Config{
+		Service: service,
+		DSN:     "toy@/toychat?parseTime=true",
+		NATS:    broker.NATSConfig{URL: nats.DefaultURL, Name: service},
+		Subjects: Subjects{DB: "forDB", Chat: "forChat", Mat: "forMat",
+			Presence: "presence.agent"},
+		TLSCert:         filepath.Join(certs, "https-server.crt"),
+		TLSKey:          filepath.Join(certs, "https-server.key"),
+		SessionLifetime: 72 * time.Hour,
+		SessionCookie:   cookies[service],
+		SMTPFrom:        "toychat@localhost",
+		CallerWindow:    30 * time.Second,
+		source:          map[string]string{},
+	}
+	if c.SessionCookie == "" {
+		c.SessionCookie = "session"
+	}
+	return c
+}
+
+//field is one setting, its key and how it is read and written as text.
+type field struct {
+	key    string
+	get    func() string
+	set    func(string) error
+	isFile bool //the value is a file that has to be there
+}
+
+func str(key string, p *string, isFile bool) field {
+	return field{key: key, get: func() string { return *p },
+		set: func(v string) error { *p = v; return nil }, isFile: isFile}
+}
+
+func duration(key string, p *time.Duration) field {
+	return field{key: key, get: func() string { return p.String() },
+		set: func(v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			*p = d
+			return nil
+		}}
+}
+
+func (c *Config) fields() []field {
+	n := &c.NATS
+	return []field{
+		str("db.dsn", &c.DSN, false),
+		str("db.passwordfile", &c.DBPasswordFile, true),
+		str("nats.url", &n.URL, false),
+		str("nats.tokenfile", &n.TokenFile, true),
+		str("nats.user", &n.User, false),
+		str("nats.passwordfile", &n.PasswordFile, true),
+		str("nats.creds", &n.CredsFile, true),
+		str("nats.nkey", &n.NKeyFile, true),
+		str("nats.ca", &n.CAFile, true),
+		str("nats.cert", &n.CertFile, true),
+		str("nats.key", &n.KeyFile, true),
+		str("subject.db", &c.Subjects.DB, false),
+		str("subject.chat", &c.Subjects.Chat, false),
+		str("subject.mat", &c.Subjects.Mat, false),
+		str("subject.presence", &c.Subjects.Presence, false),
+		str("tls.cert", &c.TLSCert, true),
+		str("tls.key", &c.TLSKey, true),
+		duration("session.lifetime", &c.SessionLifetime),
+		str("session.cookie", &c.SessionCookie, false),
+		str("vault.keyfile", &c.VaultKeyFile, true),
+		str("smtp.server", &c.SMTPServer, false),
+		str("smtp.user", &c.SMTPUser, false),
+		str("smtp.passwordfile", &c.SMTPPasswordFile, true),
+		str("smtp.from", &c.SMTPFrom, false),
+		str("smtp.mailfile", &c.SMTPMailFile, false),
+		str("verify.keyfile", &c.VerifyKeyFile, true),
+		str("request.keyfile", &c.RequestKeyFile, true),
+		str("callers.keys", &c.CallerKeys, true),
+		duration("callers.window", &c.CallerWindow),
+	}
+}
+
+//uses tells if the service uses the setting.
+func (c *Config) uses(key string) bool {
+	g, ok := groups[c.Service]
+	if !ok {
+		return true
+	}
+	group := strings.SplitN(key, ".", 2)[0]
+	for _, name := range g {
+		if name == group {
+			return true
+		}
+	}
+	return false
+}
+
+//EnvName is the environment variable of the key.
+func EnvName(key string) string {
+	return "TOYCHAT_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+//FileFlag registers -config on the flag set.
+func FileFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv(EnvFile),
+		"configuration file, $"+EnvFile+" when not given")
+}
+
+//Flags registers -config and -printconfig on the flag set.
+func Flags(fs *flag.FlagSet) (file *string, print *bool) {
+	file = FileFlag(fs)
+	print = fs.Bool("printconfig", false,
+		"print the configuration, without the secrets, and exit")
+	return file, print
+}
+
+//Load loads the configuration of the service from the defaults, the file
+//(none when empty) and the environment, validates it and reads the database
+//and SMTP passwords and the verification key.
+func Load(service, file string) (*Config, error) {
+	return load(service, file, os.LookupEnv)
+}
+
+func load(service, file string, lookup func(string) (string, bool)) (*Config,
+	error) {
+	c := Defaults(service)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		err = c.read(f, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, fd := range c.fields() {
+		v, ok := lookup(EnvName(fd.key))
+		if !ok {
+			continue
+		}
+		err := fd.set(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", EnvName(fd.key), err)
+		}
+		c.source[fd.key] = "env"
+	}
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if c.uses("db") && c.DBPasswordFile != "" {
+		c.dbPassword, err = secret.Read(c.DBPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.uses("smtp") && c.SMTPPasswordFile != "" {
+		c.smtpPassword, err = secret.Read(c.SMTPPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.uses("verify") && c.VerifyKeyFile != "" {
+		c.verifyKey, err = secret.ReadKey(c.VerifyKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("verify.keyfile: %v", err)
+		}
+	}
+	return c, nil
+}
+
+//read reads the settings of the file, name is for the errors.
+func (c *Config) read(r io.Reader, name string) error {
+	fields := map[string]field{}
+	for _, fd := range c.fields() {
+		fields[fd.key] = fd
+	}
+	section := ""
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: not key = value", name, n)
+		}
+		key := strings.TrimSpace(kv[0])
+		fd, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown setting %q", name, n, key)
+		}
+		if section != "" && section != c.Service {
+			continue
+		}
+		err := fd.set(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", name, n, key, err)
+		}
+		c.source[key] = name
+	}
+	return s.Err()
+}
+
+//Validate checks the settings the service uses.
+func (c *Config) Validate() error {
+	errs := []string{}
+	for _, fd := range c.fields() {
+		if !c.uses(fd.key) || !fd.isFile || fd.get() == "" {
+			continue
+		}
+		_, err := os.Stat(fd.get())
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", fd.key, err))
+		}
+	}
+	if c.uses("db") {
+		dsn, err := mysql.ParseDSN(c.DSN)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("db.dsn: %v", err))
+		case dsn.Passwd != "":
+			errs = append(errs, "db.dsn: the password goes in db.passwordfile")
+		}
+	}
+	if c.uses("nats") {
+		_, err := c.NATS.Options()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if c.uses("subject") {
+		for key, s := range map[string]string{"subject.db": c.Subjects.DB,
+			"subject.chat": c.Subjects.Chat, "subject.mat": c.Subjects.Mat,
+			"subject.presence": c.Subjects.Presence} {
+			if s == "" || strings.ContainsAny(s, " \t*>") {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a subject", key, s))
+			}
+		}
+	}
+	if c.uses("tls") && (c.TLSCert == "" || c.TLSKey == "") {
+		errs = append(errs, "tls.cert and tls.key are both needed")
+	}
+	if c.uses("session") {
+		if c.SessionLifetime <= 0 {
+			errs = append(errs, "session.lifetime has to be more than 0")
+		}
+		if c.SessionCookie == "" ||
+			strings.ContainsAny(c.SessionCookie, " \t;,=\"()<>@:/[]?{}\\") {
+			errs = append(errs, fmt.Sprintf("session.cookie: %q is not a cookie name",
+				c.SessionCookie))
+		}
+	}
+	if c.uses("smtp") && c.SMTPServer != "" && c.SMTPFrom == "" {
+		errs = append(errs, "smtp.from is needed with smtp.server")
+	}
+	if c.uses("callers") && c.CallerWindow <= 0 {
+		errs = append(errs, "callers.window has to be more than 0")
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return errors.New("configuration of " + c.Service + ": " +
+		strings.Join(errs, "; "))
+}
+
+//DataSource is the data source name of the database with the password.
+func (c *Config) DataSource() (string, error) {
+	dsn, err := mysql.ParseDSN(c.DSN)
+	if err != nil {
+		return "", err
+	}
+	dsn.Passwd = c.dbPassword
+	dsn.ParseTime = true //the services scan the times into time.Time
+	return dsn.FormatDSN(), nil
+}
+
+//SMTPPassword is the password of the SMTP user read from smtp.passwordfile.
+func (c *Config) SMTPPassword() string {
+	return c.smtpPassword
+}
+
+//VerifyKey is the key of the email verification links read from
+//verify.keyfile, nil without one.
+func (c *Config) VerifyKey() []byte {
+	return c.verifyKey
+}
+
+//Apply makes the nats settings and subjects the ones of the broker.
+func (c *Config) Apply() error {
+	broker.DBSubject = c.Subjects.DB
+	broker.ChatSubject = c.Subjects.Chat
+	broker.PresenceSubject = c.Subjects.Presence
+	return broker.SetNATS(c.NATS)
+}
+
+//Print writes the settings the service uses and where each came from.  The
+//secrets are not in them, a password in the data source name is redacted all
+//the same.
+func (c *Config) Print(w io.Writer) {
+	fmt.Fprintf(w, "# configuration of %s\n", c.Service)
+	for _, fd := range c.fields() {
+		if !c.uses(fd.key) {
+			continue
+		}
+		v := fd.get()
+		if fd.key == "db.dsn" {
+			v = redactDSN(v)
+		}
+		source := c.source[fd.key]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%-18s = %-40s # %s\n", fd.key, v, source)
+	}
+}
+
+func redactDSN(v string) string {
+	dsn, err := mysql.ParseDSN(v)
+	if err != nil || dsn.Passwd == "" {
+		return v
+	}
+	dsn.Passwd = "REDACTED"
+	return dsn.FormatDSN()
+}
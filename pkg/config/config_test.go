@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pw := filepath.Join(dir, "db.pw")
+	err = ioutil.WriteFile(pw, []byte("pass word\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "toychat.conf")
+	err = ioutil.WriteFile(file, []byte(`# shared
+db.dsn = password@tcp(db:3306)/toychat
+db.passwordfile = `+pw+`
+subject.db = db.requests
+
+[backend]
+session.cookie = backendSession
+[frontend]
+session.lifetime = 12h
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"TOYCHAT_NATS_URL": "nats://nats:4222"}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	c, err := load("dbmgr", file, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subjects.DB != "db.requests" || c.NATS.URL != "nats://nats:4222" ||
+		c.NATS.Name != "dbmgr" {
+		t.Errorf("got %+v", c)
+	}
+	dsn, err := c.DataSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the user named password stays the user
+	want := "password:pass word@tcp(db:3306)/toychat?parseTime=true"
+	if dsn != want {
+		t.Errorf("data source %q, want %q", dsn, want)
+	}
+	out := &bytes.Buffer{}
+	c.Print(out)
+	if strings.Contains(out.String(), "pass word") {
+		t.Errorf("the password is printed:\n%s", out)
+	}
+	if strings.Contains(out.String(), "tls.") ||
+		!strings.Contains(out.String(), "# env") {
+		t.Errorf("printed:\n%s", out)
+	}
+
+	env["TOYCHAT_TLS_CERT"] = filepath.Join(dir, "none")
+	env["TOYCHAT_TLS_KEY"] = pw
+	_, err = load("frontend", file, lookup)
+	if err == nil || !strings.Contains(err.Error(), "tls.cert") {
+		t.Fatalf("frontend without a certificate: %v", err)
+	}
+	env["TOYCHAT_TLS_CERT"] = pw
+	env["TOYCHAT_SMTP_PASSWORDFILE"] = pw
+	env["TOYCHAT_VERIFY_KEYFILE"] = pw
+	_, err = load("frontend", file, lookup)
+	if err == nil || !strings.Contains(err.Error(), "verify.keyfile") {
+		t.Fatalf("short verify key: %v", err)
+	}
+	key := filepath.Join(dir, "verify.key")
+	err = ioutil.WriteFile(key, []byte("0123456789abcdef\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env["TOYCHAT_VERIFY_KEYFILE"] = key
+	c, err = load("frontend", file, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SMTPPassword() != "pass word" || string(c.VerifyKey()) != "0123456789abcdef" {
+		t.Errorf("smtp password %q, verify key %q", c.SMTPPassword(), c.VerifyKey())
+	}
+	if c.SessionLifetime != 12*time.Hour || c.SessionCookie != "sessionOne" {
+		t.Errorf("frontend session %v %q", c.SessionLifetime, c.SessionCookie)
+	}
+	c, err = load("backend", file, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SessionLifetime != 72*time.Hour || c.SessionCookie != "backendSession" {
+		t.Errorf("backend session %v %q", c.SessionLifetime, c.SessionCookie)
+	}
+	if c.SMTPFrom != "toychat@localhost" || c.SMTPServer != "" {
+		t.Errorf("backend smtp %q from %q", c.SMTPServer, c.SMTPFrom)
+	}
+
+	env["TOYCHAT_CALLERS_KEYS"] = dir
+	env["TOYCHAT_CALLERS_WINDOW"] = "1m"
+	c, err = load("dbmgr", file, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CallerKeys != dir || c.CallerWindow != time.Minute {
+		t.Errorf("dbmgr callers %q %v", c.CallerKeys, c.CallerWindow)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{"unknown", "db.name = toychat\n", nil, "unknown setting"},
+		{"no value", "db.dsn\n", nil, "not key = value"},
+		{"password in dsn", "", map[string]string{
+			"TOYCHAT_DB_DSN": "toy:secret@/toychat"}, "db.passwordfile"},
+		{"missing file", "db.passwordfile = /no/such/file\n", nil,
+			"db.passwordfile"},
+		{"wildcard", "subject.db = for.>\n", nil, "not a subject"},
+		{"duration", "", map[string]string{"TOYCHAT_SESSION_LIFETIME": "long"},
+			"TOYCHAT_SESSION_LIFETIME"},
+		{"two credentials", "nats.user = dbmgr\nnats.creds = /etc/hosts\n", nil,
+			"only one"},
+		{"no window", "callers.window = 0s\n", nil, "callers.window"},
+		{"missing keys", "callers.keys = /no/such/dir\n", nil, "callers.keys"},
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		file := filepath.Join(dir, "toychat.conf")
+		err = ioutil.WriteFile(file, []byte(tt.file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = load("dbmgr", file, func(key string) (string, bool) {
+			v, ok := tt.env[key]
+			return v, ok
+		})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	got := redactDSN("toy:secret@tcp(db:3306)/toychat")
+	if strings.Contains(got, "secret") || !strings.Contains(got, "REDACTED") {
+		t.Errorf("got %q", got)
+	}
+}
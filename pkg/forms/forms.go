@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -94,6 +95,23 @@ func (f *FormData) MatchPattern(field string, pattern *regexp.Regexp) {
 	}
 }
 
+//IntRange tests that the field is a whole number between min and max inclusive.
+func (f *FormData) IntRange(field string, min, max int) {
+	value := f.GetField(field)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		f.Errors.AddError(field, "this field must be a whole number")
+		return
+	}
+	if n < min || n > max {
+		f.Errors.AddError(field, fmt.Sprintf("this field must be between %d and %d",
+			min, max))
+	}
+}
+
 //Valid tests that all the required fields are provided and there are no errors.
 func (f *FormData) Valid() bool {
 	return len(f.Errors) == 0
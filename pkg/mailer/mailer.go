@@ -0,0 +1,154 @@
+//Package mailer sends the mails of the web apps, e.g. the password reset
+//links.  SMTP sends them for real, File writes them out for local development
+//where there is no mail server.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrHeader is returned for an address or a subject with a line break, which
+//would let the value add its own headers to the mail.
+var ErrHeader = errors.New("mailer: line break in a mail header")
+
+//Mailer sends a plain text mail.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+//New returns an SMTP mailer if addr (host:port) is set, otherwise a File
+//mailer writing to file (standard output when file is empty).
+func New(addr, user, password, from, file string) (Mailer, error) {
+	if addr != "" {
+		return NewSMTP(addr, user, password, from)
+	}
+	return NewFile(file, from)
+}
+
+//SMTP sends the mails through an SMTP server, authenticating with PLAIN auth
+//when a user is given.  net/smtp only sends the password over TLS (or to
+//localhost).
+type SMTP struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+//NewSMTP returns an SMTP mailer for the server at addr (host:port).
+func NewSMTP(addr, user, password, from string) (*SMTP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: smtp address %q: %w", addr, err)
+	}
+	m := &SMTP{Addr: addr, From: from}
+	if user != "" {
+		m.Auth = smtp.PlainAuth("", user, password, host)
+	}
+	return m, nil
+}
+
+//Send sends one mail.
+func (m *SMTP) Send(to, subject, body string) error {
+	msg, err := Message(m.From, to, subject, body, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+}
+
+//File writes the mails one after the other to a writer instead of sending
+//them.
+type File struct {
+	From string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+//NewFile returns a File mailer appending to the file at path, or writing to
+//the standard output if path is empty.
+func NewFile(path, from string) (*File, error) {
+	if path == "" {
+		return NewWriter(os.Stdout, from), nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(f, from), nil
+}
+
+//NewWriter returns a File mailer writing to w.
+func NewWriter(w io.Writer, from string) *File {
+	return &File{From: from, w: w}
+}
+
+//Send writes one mail followed by an empty line.
+func (m *File) Send(to, subject, body string) error {
+	msg, err := Message(m.From, to, subject, body, time.Now())
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.w.Write(append(msg, "\r\n"...))
+	return err
+}
+
+//Message formats a plain text mail with CRLF line endings.
+func Message(from, to, subject, body string, now time.Time) ([]byte, error) {
+	for _, h := range []string{from, to, subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrHeader
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if !strings.HasSuffix(body, "\n") {
+		b.WriteString("\r\n")
+	}
+	return b.Bytes(), nil
+}
+
+//ResetBody is the text of the mail with a password reset link good for ttl.
+func ResetBody(name, link string, ttl time.Duration) string {
+	return fmt.Sprintf(`Hello %s,
+
+somebody, hopefully you, asked to reset the password of your Toy Chat account.
+To choose a new password open the link below within %d minutes.
+
+%s
+
+If it was not you, you do not need to do anything, the password stays the
+same.
+`, name, int(ttl.Minutes()), link)
+}
+
+//VerifyBody is the text of the mail with an email verification link good for
+//ttl.
+func VerifyBody(name, link string, ttl time.Duration) string {
+	return fmt.Sprintf(`Hello %s,
+
+welcome to Toy Chat.  Please confirm your email address by opening the link
+below within %d hours.
+
+%s
+
+If you did not sign up, you do not need to do anything.
+`, name, int(ttl.Hours()), link)
+}
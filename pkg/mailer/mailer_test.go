@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	msg, err := Message("toy@example.com", "bob@example.com", "Reset",
+		"Hello\nthe link", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From: toy@example.com\r\nTo: bob@example.com\r\nSubject: Reset\r\n" +
+		"Date: Fri, 01 May 2020 10:00:00 +0000\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nHello\r\nthe link\r\n"
+	if string(msg) != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+}
+
+func TestMessageHeader(t *testing.T) {
+	tests := []struct{ to, subject string }{
+		{"bob@example.com\r\nBcc: eve@example.com", "Reset"},
+		{"bob@example.com", "Reset\nBcc: eve@example.com"},
+	}
+	for _, tt := range tests {
+		_, err := Message("toy@example.com", tt.to, tt.subject, "", time.Now())
+		if !errors.Is(err, ErrHeader) {
+			t.Errorf("%q %q: got %v, want ErrHeader", tt.to, tt.subject, err)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	var b bytes.Buffer
+	m := NewWriter(&b, "toy@example.com")
+	err := m.Send("bob@example.com", "One", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send("ann@example.com", "Two", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, s := range []string{"To: bob@example.com", "first", "To: ann@example.com",
+		"second"} {
+		if !strings.Contains(got, s) {
+			t.Errorf("%q is missing %q", got, s)
+		}
+	}
+	if strings.Index(got, "first") > strings.Index(got, "second") {
+		t.Errorf("mails are out of order: %q", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	m, err := New("smtp.example.com:587", "toy", "secret", "toy@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*SMTP); !ok {
+		t.Errorf("got %T, want *SMTP", m)
+	}
+	m, err = New("", "", "", "toy@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*File); !ok {
+		t.Errorf("got %T, want *File", m)
+	}
+	_, err = New("smtp.example.com", "", "", "toy@example.com", "")
+	if err == nil {
+		t.Error("no error for an address without a port")
+	}
+}
+
+func TestResetBody(t *testing.T) {
+	body := ResetBody("Bob", "https://localhost:4000/reset?token=abc", time.Hour)
+	for _, s := range []string{"Hello Bob", "https://localhost:4000/reset?token=abc\n",
+		"within 60 minutes"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%q is missing %q", body, s)
+		}
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	body := VerifyBody("Bob", "https://localhost:4000/verify?token=1.2.abc",
+		24*time.Hour)
+	for _, s := range []string{"Hello Bob", "https://localhost:4000/verify?token=1.2.abc\n",
+		"within 24 hours"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("%q is missing %q", body, s)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+//Copyright (c) 2020 Saied Seghatoleslami
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+/*
+search package finds messages by their words.  The dbmgr searches the
+messages table with a MySQL FULLTEXT index (see dbscripts/search.txt) and the
+web apps search through the dbmgr with BrokerSearcher.
+
+The text of a Query is broken into words (letters and digits) and every word
+has to be in the message, so "order 4312" finds the messages that have both
+"order" and "4312".  The results are the newest messages first, filtered by
+agent, user, date range and the state of the dialog.
+*/
+package search
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+//States of the dialog a Query can be limited to, empty for both.
+const (
+	Open   = "open"
+	Closed = "closed"
+)
+
+//MaxHits is the most hits a search returns.
+const MaxHits = 100
+
+//Query is a search.  Text is required, the zero value of the other fields
+//means no filter.  To is not included.
+type Query struct {
+	Text    string
+	AgentID int
+	User    string //email or name of the user
+	From    time.Time
+	To      time.Time
+	State   string //Open or Closed
+}
+
+//Hit is a message found by a search with its dialog.
+type Hit struct {
+	MessageID int
+	DialogID  int
+	UserID    int
+	UserName  string
+	UserEmail string
+	AgentID   int
+	AgentName string
+	Created   time.Time
+	Sender    string
+	Text      string
+	State     string //Open or Closed
+}
+
+//Searcher runs a query and returns up to limit hits, the newest first.
+type Searcher interface {
+	Search(q Query, limit int) ([]Hit, error)
+}
+
+//Terms breaks text into the lower case words that are searched for.
+func Terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := map[string]bool{}
+	terms := []string{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+//Boolean is the MySQL boolean mode search string for text, every term is
+//required.
+func Boolean(text string) string {
+	terms := Terms(text)
+	for i, t := range terms {
+		terms[i] = "+" + t
+	}
+	return strings.Join(terms, " ")
+}
+
+//ValidState is true for the states a Query takes, including none.
+func ValidState(state string) bool {
+	return state == "" || state == Open || state == Closed
+}
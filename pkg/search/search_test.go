@@ -0,0 +1,27 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	got := Terms("Order #4312, ORDER 4312!")
+	if !reflect.DeepEqual(got, []string{"order", "4312"}) {
+		t.Errorf("got %v", got)
+	}
+	if b := Boolean("order 4312"); b != "+order +4312" {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestValidState(t *testing.T) {
+	for _, state := range []string{"", Open, Closed} {
+		if !ValidState(state) {
+			t.Errorf("%q not valid", state)
+		}
+	}
+	if ValidState("pending") {
+		t.Error("pending valid")
+	}
+}
@@ -0,0 +1,25 @@
+package search
+
+import (
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//BrokerSearcher searches with the dbmgr over nats.
+type BrokerSearcher struct{}
+
+//Search implements Searcher with broker.SearchR.
+func (BrokerSearcher) Search(q Query, limit int) ([]Hit, error) {
+	rows, err := broker.SearchR(broker.TableRow{Msg: q.Text, AgentID: q.AgentID,
+		Name: q.User, Created: q.From, Ended: q.To, State: q.State, Count: limit})
+	if err != nil {
+		return nil, err
+	}
+	hits := []Hit{}
+	for _, r := range rows {
+		hits = append(hits, Hit{MessageID: r.MessageID, DialogID: r.DialogID,
+			UserID: r.ID, UserName: r.Name, UserEmail: r.Email, AgentID: r.AgentID,
+			AgentName: r.AgentName, Created: r.Created, Sender: r.Sender,
+			Text: r.Msg, State: r.State})
+	}
+	return hits, nil
+}
@@ -0,0 +1,41 @@
+//Package secret reads the secrets of the services, passwords, tokens and
+//keys, from the files the configuration names, so they are neither on the
+//command line nor in the configuration itself.  A secret file holds the
+//secret on one line, the line end is not part of it.
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+//MinKeySize is the shortest key a key file can hold.
+const MinKeySize = 16
+
+//Read reads the secret of the file.
+func Read(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(b), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return secret, nil
+}
+
+//ReadKey reads a key of at least MinKeySize from the file.  Such as:
+//head -c 32 /dev/urandom | base64 > frontend.key
+func ReadKey(file string) ([]byte, error) {
+	key, err := Read(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("the key in %s is shorter than %d", file,
+			MinKeySize)
+	}
+	return []byte(key), nil
+}
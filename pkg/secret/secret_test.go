@@ -0,0 +1,50 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name     string
+		contents string
+		secret   string
+		key      bool
+		err      string
+	}{
+		{"password", "pass word\r\n", "pass word", false, "shorter than"},
+		{"key", "0123456789abcdef\n", "0123456789abcdef", true, ""},
+		{"empty", "\n", "", false, "is empty"},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(dir, tt.name)
+		err = ioutil.WriteFile(file, []byte(tt.contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := Read(file)
+		if s != tt.secret || (err != nil) != (tt.secret == "") {
+			t.Errorf("%s: read %q, %v", tt.name, s, err)
+		}
+		key, err := ReadKey(file)
+		if tt.key && (err != nil || string(key) != tt.secret) {
+			t.Errorf("%s: key %q, %v", tt.name, key, err)
+		}
+		if !tt.key && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: key error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	_, err = Read(filepath.Join(dir, "none"))
+	if err == nil {
+		t.Error("read a missing file")
+	}
+}
@@ -0,0 +1,124 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/saied74/toychat/pkg/centerr"
+)
+
+//maxReport is the largest report body read, the rest is dropped.
+const maxReport = 64 << 10
+
+//maxField is the most of each field of a violation that is logged.
+const maxField = 256
+
+//Violation is what is logged of a violation report.
+type Violation struct {
+	DocumentURI string
+	Directive   string
+	BlockedURI  string
+	Disposition string //enforce or report
+	Source      string
+	Line        int
+}
+
+//the report-uri format, {"csp-report": {...}}.
+type cspReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI         string `json:"blocked-uri"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+	} `json:"csp-report"`
+}
+
+//the Reporting API format, [{"type": "csp-violation", "body": {...}}].
+type apiReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		BlockedURL         string `json:"blockedURL"`
+		Disposition        string `json:"disposition"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+	} `json:"body"`
+}
+
+//ParseReport reads the violations of a report body in either format.
+func ParseReport(r io.Reader) ([]Violation, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxReport))
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+	if !bytes.HasPrefix(body, []byte("[")) {
+		var one cspReport
+		err = json.Unmarshal(body, &one)
+		if err != nil {
+			return nil, err
+		}
+		rp := one.Report
+		directive := rp.EffectiveDirective
+		if directive == "" {
+			directive = rp.ViolatedDirective
+		}
+		return []Violation{{DocumentURI: rp.DocumentURI, Directive: directive,
+			BlockedURI: rp.BlockedURI, Disposition: rp.Disposition,
+			Source: rp.SourceFile, Line: rp.LineNumber}}, nil
+	}
+	var many []apiReport
+	err = json.Unmarshal(body, &many)
+	if err != nil {
+		return nil, err
+	}
+	violations := []Violation{}
+	for _, rp := range many {
+		if rp.Type != "csp-violation" {
+			continue
+		}
+		b := rp.Body
+		violations = append(violations, Violation{DocumentURI: b.DocumentURL,
+			Directive: b.EffectiveDirective, BlockedURI: b.BlockedURL,
+			Disposition: b.Disposition, Source: b.SourceFile, Line: b.LineNumber})
+	}
+	return violations, nil
+}
+
+//ReportHandler takes the violation reports the browsers post to ReportURI and
+//logs them.  It is not behind the login, the reports come from any page.
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	violations, err := ParseReport(r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	//the fields are the client's, quoted so they cannot forge log lines.
+	for _, v := range violations {
+		centerr.ErrorLog.Printf("csp %q violation on %q: %q blocked %q (%q:%d)",
+			clip(v.Disposition), clip(v.DocumentURI), clip(v.Directive),
+			clip(v.BlockedURI), clip(v.Source), v.Line)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//clip cuts s to maxField bytes.
+func clip(s string) string {
+	if len(s) > maxField {
+		return s[:maxField] + "..."
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+//Package secure sets the security headers of the web apps: a
+//Content-Security-Policy with a new nonce for every response, which the
+//templates put on their script and style tags, Strict-Transport-Security,
+//X-Frame-Options, X-Content-Type-Options, Referrer-Policy and
+//Permissions-Policy.  In report only mode the policy is sent as
+//Content-Security-Policy-Report-Only, so a change of it can be tried out on
+//the live pages, and the violations the browsers post to the report address
+//are logged by ReportHandler.
+package secure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ReportPath is where the web apps take the violation reports.
+const ReportPath = "/csp-report"
+
+type contextKey string
+
+const contextKeyNonce = contextKey("cspNonce")
+
+//Config is the headers of one web app.  Empty fields leave the header out,
+//except for the policy which is always sent.
+type Config struct {
+	ReportOnly        bool          //send the policy without enforcing it
+	ReportURI         string        //where the browsers post the violations
+	HSTS              time.Duration //max-age of Strict-Transport-Security
+	FrameOptions      string        //X-Frame-Options
+	ReferrerPolicy    string        //Referrer-Policy
+	PermissionsPolicy string        //Permissions-Policy
+	ScriptSrc         []string      //sources of scripts besides the nonce
+	StyleSrc          []string      //sources of style sheets besides the nonce
+	ImgSrc            []string      //sources of images besides 'self'
+	ConnectSrc        []string      //sources of XHR and websockets besides 'self'
+}
+
+//Default is the configuration of the web apps.  It allows no script hosts, the
+//CDN libraries the templates load are let in by their nonce alone and pinned
+//by their integrity hash, so nothing else on the CDNs can run.
+var Default = Config{
+	ReportURI:         ReportPath,
+	HSTS:              365 * 24 * time.Hour,
+	FrameOptions:      "DENY",
+	ReferrerPolicy:    "strict-origin-when-cross-origin",
+	PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+	StyleSrc:          []string{"https://stackpath.bootstrapcdn.com"},
+	ImgSrc:            []string{"data:"},
+}
+
+//Policy is the Content-Security-Policy with the nonce.
+func (c *Config) Policy(nonce string) string {
+	n := "'nonce-" + nonce + "'"
+	p := []string{
+		"default-src 'self'",
+		sources("script-src", append([]string{"'self'", n}, c.ScriptSrc...)),
+		sources("style-src", append([]string{"'self'", n}, c.StyleSrc...)),
+		sources("img-src", append([]string{"'self'"}, c.ImgSrc...)),
+		sources("connect-src", append([]string{"'self'"}, c.ConnectSrc...)),
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}
+	if c.ReportURI != "" {
+		p = append(p, "report-uri "+c.ReportURI)
+	}
+	return strings.Join(p, "; ")
+}
+
+func sources(directive string, src []string) string {
+	return directive + " " + strings.Join(src, " ")
+}
+
+//Headers is the middleware that sets the headers and puts the nonce of the
+//policy in the request context for the templates, see Nonce.
+func (c *Config) Headers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := newNonce()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+			return
+		}
+		h := w.Header()
+		if c.ReportOnly {
+			h.Set("Content-Security-Policy-Report-Only", c.Policy(nonce))
+		} else {
+			h.Set("Content-Security-Policy", c.Policy(nonce))
+		}
+		if c.HSTS > 0 {
+			h.Set("Strict-Transport-Security", "max-age="+
+				strconv.FormatInt(int64(c.HSTS/time.Second), 10)+"; includeSubDomains")
+		}
+		if c.FrameOptions != "" {
+			h.Set("X-Frame-Options", c.FrameOptions)
+		}
+		if c.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", c.ReferrerPolicy)
+		}
+		if c.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", c.PermissionsPolicy)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		ctx := context.WithValue(r.Context(), contextKeyNonce, nonce)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//DocumentPolicy is the policy of a self contained document the apps serve,
+//such as a transcript page, which has its style inline and no scripts.
+const DocumentPolicy = "default-src 'none'; style-src 'unsafe-inline'; " +
+	"frame-ancestors 'none'"
+
+//Document replaces the policy of the response with DocumentPolicy.  It has to
+//be called before the headers are written.
+func Document(w http.ResponseWriter) {
+	for _, key := range []string{"Content-Security-Policy",
+		"Content-Security-Policy-Report-Only"} {
+		if w.Header().Get(key) != "" {
+			w.Header().Set(key, DocumentPolicy)
+		}
+	}
+}
+
+//Nonce is the nonce of the policy of the response to the request, empty
+//outside of Headers.
+func Nonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(contextKeyNonce).(string)
+	return nonce
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
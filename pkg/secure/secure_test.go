@@ -0,0 +1,142 @@
+package secure
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/saied74/toychat/pkg/centerr"
+)
+
+func TestHeaders(t *testing.T) {
+	var nonce string
+	h := Default.Headers(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		nonce = Nonce(r)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/home", nil))
+	if nonce == "" {
+		t.Fatal("no nonce in the request context")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	//no hosts, only the scripts with the nonce run.
+	if !strings.Contains(csp, "script-src 'self' 'nonce-"+nonce+"';") ||
+		!strings.Contains(csp, "report-uri "+ReportPath) {
+		t.Errorf("policy %q", csp)
+	}
+	want := map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"Referrer-Policy":           Default.ReferrerPolicy,
+		"Permissions-Policy":        Default.PermissionsPolicy,
+	}
+	for key, value := range want {
+		if got := w.Header().Get(key); got != value {
+			t.Errorf("%s: got %q, want %q", key, got, value)
+		}
+	}
+
+	//every response has its own nonce.
+	first := nonce
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/home", nil))
+	if nonce == first {
+		t.Error("the nonce was used twice")
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	c := Default
+	c.ReportOnly = true
+	c.HSTS = 0
+	c.FrameOptions = ""
+	h := c.Headers(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		Document(w)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Content-Security-Policy") != "" {
+		t.Error("policy enforced in report only mode")
+	}
+	if got := w.Header().Get("Content-Security-Policy-Report-Only"); got != DocumentPolicy {
+		t.Errorf("report only policy %q, want the document policy", got)
+	}
+	for _, key := range []string{"Strict-Transport-Security", "X-Frame-Options"} {
+		if w.Header().Get(key) != "" {
+			t.Errorf("%s set without configuration", key)
+		}
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []Violation
+		err  bool
+	}{
+		{"report-uri", `{"csp-report": {"document-uri": "https://x/home",
+			"violated-directive": "script-src-elem", "blocked-uri": "inline",
+			"disposition": "report", "source-file": "https://x/home",
+			"line-number": 12}}`,
+			[]Violation{{"https://x/home", "script-src-elem", "inline", "report",
+				"https://x/home", 12}}, false},
+		{"reporting api", `[{"type": "csp-violation", "body": {
+			"documentURL": "https://x/chat", "effectiveDirective": "img-src",
+			"blockedURL": "https://evil/x.png", "disposition": "enforce"}},
+			{"type": "deprecation", "body": {}}]`,
+			[]Violation{{"https://x/chat", "img-src", "https://evil/x.png",
+				"enforce", "", 0}}, false},
+		{"garbage", `not json`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseReport(strings.NewReader(tt.body))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	ReportHandler(w, httptest.NewRequest("GET", ReportPath, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ReportHandler(w, httptest.NewRequest("POST", ReportPath,
+		strings.NewReader(`{"csp-report": {"blocked-uri": "inline"}}`)))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("POST: got %d", w.Code)
+	}
+
+	//a forged log line stays in its quotes and a long field is cut.
+	out := &bytes.Buffer{}
+	saved := centerr.ErrorLog.Writer()
+	centerr.ErrorLog.SetOutput(out)
+	defer centerr.ErrorLog.SetOutput(saved)
+	w = httptest.NewRecorder()
+	ReportHandler(w, httptest.NewRequest("POST", ReportPath,
+		strings.NewReader(`{"csp-report": {"blocked-uri": "inline\nINFO forged",
+		"document-uri": "https://x/`+strings.Repeat("a", 1000)+`"}}`)))
+	logged := out.String()
+	if strings.Count(logged, "\n") != 1 ||
+		!strings.Contains(logged, `"inline\nINFO forged"`) ||
+		strings.Contains(logged, strings.Repeat("a", maxField)) {
+		t.Errorf("logged %q", logged)
+	}
+}
@@ -0,0 +1,73 @@
+//Package throttle is the policy of the login throttling: failed logins are
+//counted in a sliding window, separately for the account and for the client
+//address, and too many of them lock the key for a while.  Every lock of the
+//same key is twice as long as the one before (up to a limit) until a login
+//succeeds.  The counting itself is done by the dbmgr in the database so all
+//the web servers share it.
+package throttle
+
+import (
+	"strings"
+	"time"
+)
+
+//Kinds of keys.
+const (
+	Account = "account" //the table and the email tried
+	IP      = "ip"      //the client address
+)
+
+//Policy is when and for how long keys are locked.
+type Policy struct {
+	Window        time.Duration //failures older than this are not counted
+	MaxFailures   int           //failures of an account in the window that lock it
+	MaxIPFailures int           //failures from an address in the window that lock it
+	BaseLock      time.Duration //length of the first lock
+	MaxLock       time.Duration //longest lock
+}
+
+//Default is the policy of the dbmgr.  An address gets more tries than an
+//account as several users can share it.
+var Default = Policy{
+	Window:        15 * time.Minute,
+	MaxFailures:   5,
+	MaxIPFailures: 20,
+	BaseLock:      time.Minute,
+	MaxLock:       time.Hour,
+}
+
+//Max is the number of failures in the window that lock a key of the kind.
+func (p Policy) Max(kind string) int {
+	if kind == IP {
+		return p.MaxIPFailures
+	}
+	return p.MaxFailures
+}
+
+//LockFor is the length of a lock after locks earlier ones, BaseLock doubled
+//for each up to MaxLock.
+func (p Policy) LockFor(locks int) time.Duration {
+	d := p.BaseLock
+	for i := 0; i < locks; i++ {
+		d *= 2
+		if d >= p.MaxLock {
+			return p.MaxLock
+		}
+	}
+	return d
+}
+
+//Fail returns whether failures (in the window, this one included) lock a key
+//of the kind and until when, given how many locks it had before.
+func (p Policy) Fail(kind string, failures, locks int, now time.Time) (bool,
+	time.Time) {
+	if failures < p.Max(kind) {
+		return false, time.Time{}
+	}
+	return true, now.Add(p.LockFor(locks))
+}
+
+//AccountKey is the key of an account, the email is not case sensitive.
+func AccountKey(table, email string) string {
+	return table + ":" + strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,57 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockFor(t *testing.T) {
+	tests := []struct {
+		locks int
+		want  time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{3, 8 * time.Minute},
+		{5, 32 * time.Minute},
+		{6, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		got := Default.LockFor(tt.locks)
+		if got != tt.want {
+			t.Errorf("%d locks: got %v, want %v", tt.locks, got, tt.want)
+		}
+	}
+}
+
+func TestFail(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		kind     string
+		failures int
+		locks    int
+		locked   bool
+		until    time.Time
+	}{
+		{Account, 4, 0, false, time.Time{}},
+		{Account, 5, 0, true, now.Add(time.Minute)},
+		{Account, 5, 2, true, now.Add(4 * time.Minute)},
+		{IP, 5, 0, false, time.Time{}},
+		{IP, 19, 0, false, time.Time{}},
+		{IP, 20, 1, true, now.Add(2 * time.Minute)},
+	}
+	for _, tt := range tests {
+		locked, until := Default.Fail(tt.kind, tt.failures, tt.locks, now)
+		if locked != tt.locked || !until.Equal(tt.until) {
+			t.Errorf("%s %d failures %d locks: got %v %v, want %v %v", tt.kind,
+				tt.failures, tt.locks, locked, until, tt.locked, tt.until)
+		}
+	}
+}
+
+func TestAccountKey(t *testing.T) {
+	if got := AccountKey("users", " Bob@Example.com "); got != "users:bob@example.com" {
+		t.Errorf("got %q", got)
+	}
+}
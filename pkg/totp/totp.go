@@ -0,0 +1,138 @@
+//Package totp implements the RFC 6238 time based one time passwords of the
+//authenticator apps (HMAC-SHA1, 30 second steps, 6 digits) and the recovery
+//codes used when the phone is lost.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Step is the time step of the codes, Digits their length and Skew how many
+//steps before or after the current one are accepted for clock drift.
+const (
+	Step   = 30 * time.Second
+	Digits = 6
+	Skew   = 1
+)
+
+//RecoveryCodes is how many recovery codes are issued at a time.
+const RecoveryCodes = 10
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//NewSecret returns a random 160 bit secret, base32 encoded as the apps want it.
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+//URI is the otpauth provisioning URI of the secret, shown as a QR code for
+//the apps to scan.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Step/time.Second)))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+//Code returns the code of the secret for the time step counter.
+func Code(secret string, counter int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("totp: bad secret: %w", err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, n%mod), nil
+}
+
+//Counter is the time step counter of t.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Step/time.Second)
+}
+
+//Validate checks the code against the steps around now and returns the step
+//counter it matched.  Only counters after last are accepted so a code cannot
+//be used twice, the caller keeps the returned counter as the next last.
+func Validate(secret, code string, now time.Time, last int64) (int64, bool) {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+	c := Counter(now)
+	for i := c - Skew; i <= c+Skew; i++ {
+		if i <= last {
+			continue
+		}
+		want, err := Code(secret, i)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+//NewRecoveryCodes returns RecoveryCodes random codes (xxxxx-xxxxx) to show
+//once and their hashes to keep.
+func NewRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodes; i++ {
+		b := make([]byte, 7)
+		_, err = rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(b32.EncodeToString(b))[:10]
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecovery(code))
+	}
+	return codes, hashes, nil
+}
+
+//HashRecovery returns the hash of a recovery code as it is kept in the
+//database, ignoring case, spaces and dashes.  The codes are random so a fast
+//hash is enough.
+func HashRecovery(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+//IsRecovery reports whether the input looks like a recovery code rather than
+//a one time password.
+func IsRecovery(code string) bool {
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return len(code) == 10
+}
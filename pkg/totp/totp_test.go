@@ -0,0 +1,111 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+//rfcSecret is the SHA1 key of the RFC 6238 test vectors.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).
+	EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	//RFC 6238 appendix B, the last 6 of the 8 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Counter(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+	_, err := Code("not base32!", 1)
+	if err == nil {
+		t.Error("no error for a bad secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	c := Counter(now)
+	code, _ := Code(rfcSecret, c)
+	prev, _ := Code(rfcSecret, c-1)
+	old, _ := Code(rfcSecret, c-2)
+	tests := []struct {
+		name string
+		code string
+		last int64
+		ok   bool
+	}{
+		{"current", code, 0, true},
+		{"spaces", code[:3] + " " + code[3:], 0, true},
+		{"previous step", prev, 0, true},
+		{"too old", old, 0, false},
+		{"replay", code, c, false},
+		{"short", code[:5], 0, false},
+		{"wrong", "000000", 0, code == "000000"},
+	}
+	for _, tt := range tests {
+		got, ok := Validate(rfcSecret, tt.code, now, tt.last)
+		if ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && got <= tt.last {
+			t.Errorf("%s: counter %d not after %d", tt.name, got, tt.last)
+		}
+	}
+}
+
+func TestSecretURI(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret %q is not 32 characters", secret)
+	}
+	uri := URI("Toy Chat", "bob@example.com", secret)
+	for _, s := range []string{"otpauth://totp/Toy%20Chat:bob@example.com?",
+		"secret=" + secret, "issuer=Toy+Chat", "digits=6", "period=30"} {
+		if !strings.Contains(uri, s) {
+			t.Errorf("%q is missing %q", uri, s)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodes || len(hashes) != RecoveryCodes {
+		t.Fatalf("got %d codes and %d hashes", len(codes), len(hashes))
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if !IsRecovery(code) || IsRecovery("123456") {
+			t.Errorf("IsRecovery wrong for %q", code)
+		}
+		if HashRecovery(strings.ToUpper(strings.Replace(code, "-", "", 1))) != hashes[i] {
+			t.Errorf("hash of %q does not ignore case and dashes", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q issued twice", code)
+		}
+		seen[code] = true
+	}
+}
@@ -0,0 +1,38 @@
+package transcript
+
+import (
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+//BrokerSource gets the transcripts from the dbmgr over nats.
+type BrokerSource struct{}
+
+//Dialogs implements Source with broker.TranscriptsR.
+func (BrokerSource) Dialogs(f Filter, after, limit int) ([]Transcript, error) {
+	rows, err := broker.TranscriptsR(f.DialogID, f.From, f.To, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	page := []Transcript{}
+	for _, r := range rows {
+		page = append(page, Transcript{DialogID: r.DialogID, UserID: r.ID,
+			UserName: r.Name, UserEmail: r.Email, AgentID: r.AgentID,
+			AgentName: r.AgentName, Started: r.Created, Ended: r.Ended,
+			Open: r.Ended.Before(r.Created)})
+	}
+	return page, nil
+}
+
+//Messages implements Source with broker.TranscriptMessagesR.
+func (BrokerSource) Messages(dialogID int) ([]Message, error) {
+	rows, err := broker.TranscriptMessagesR(dialogID)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []Message{}
+	for _, r := range rows {
+		msgs = append(msgs, Message{Created: r.Created, Sender: r.Sender,
+			Text: r.Msg})
+	}
+	return msgs, nil
+}
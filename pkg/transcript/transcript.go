@@ -0,0 +1,134 @@
+//Copyright (c) 2020 Saied Seghatoleslami
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+/*
+transcript package exports dialogs with their participants and messages as
+JSON, CSV or a self contained HTML file.  It is used by the backend for the
+admins and by the dbmgr export subcommand.
+
+Exports are streamed.  Export asks the Source for one page of dialogs at a
+time, gets the messages of each dialog and hands it to the Writer which
+writes it out straight away, so only one page is held in memory no matter
+how large the export is.  The backend uses BrokerSource which goes over nats
+to the dbmgr, the dbmgr subcommand reads the database directly.
+*/
+package transcript
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+//PageSize is the number of dialogs asked from the Source at a time.
+const PageSize = 50
+
+//Formats supported by NewWriter.
+const (
+	JSON = "json"
+	CSV  = "csv"
+	HTML = "html"
+)
+
+//Message is one message of a transcript.
+type Message struct {
+	Created time.Time `json:"created"`
+	Sender  string    `json:"sender"`
+	Text    string    `json:"text"`
+}
+
+//Transcript is a dialog with its participants and messages.
+type Transcript struct {
+	DialogID  int       `json:"dialog_id"`
+	UserID    int       `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	UserEmail string    `json:"user_email"`
+	AgentID   int       `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+	Open      bool      `json:"open"`
+	Messages  []Message `json:"messages"`
+}
+
+//Filter selects the dialogs to export, either one dialog by DialogID or the
+//dialogs started from From up to (not including) To.
+type Filter struct {
+	DialogID int
+	From     time.Time
+	To       time.Time
+}
+
+//Source provides the dialogs and messages of an export.
+type Source interface {
+	//Dialogs returns up to limit dialogs matching f with a dialog id greater
+	//than after, in dialog id order and without their messages.
+	Dialogs(f Filter, after, limit int) ([]Transcript, error)
+	//Messages returns the messages of the dialog in the order they were sent.
+	Messages(dialogID int) ([]Message, error)
+}
+
+//Writer writes the transcripts of an export in one of the formats.
+type Writer interface {
+	Begin() error
+	Write(t *Transcript) error
+	End() error
+}
+
+//NewWriter returns the Writer for the format (JSON, CSV or HTML).
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case JSON:
+		return &jsonWriter{w: w}, nil
+	case CSV:
+		return newCSVWriter(w), nil
+	case HTML:
+		return &htmlWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+//ContentType is the http content type of the format.
+func ContentType(format string) string {
+	switch format {
+	case JSON:
+		return "application/json"
+	case CSV:
+		return "text/csv"
+	}
+	return "text/html; charset=utf-8"
+}
+
+//Export streams the dialogs matching f from src to w and returns the number
+//of dialogs exported.
+func Export(src Source, f Filter, w Writer) (int, error) {
+	count := 0
+	err := w.Begin()
+	if err != nil {
+		return count, err
+	}
+	after := 0
+	for {
+		page, err := src.Dialogs(f, after, PageSize)
+		if err != nil {
+			return count, err
+		}
+		for i := range page {
+			page[i].Messages, err = src.Messages(page[i].DialogID)
+			if err != nil {
+				return count, err
+			}
+			err = w.Write(&page[i])
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(page) < PageSize {
+			break
+		}
+		after = page[len(page)-1].DialogID
+	}
+	return count, w.End()
+}
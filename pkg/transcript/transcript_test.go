@@ -0,0 +1,122 @@
+package transcript
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC)
+
+//testSource has n dialogs numbered from 1, dialog i has i%3 messages.
+type testSource struct {
+	n     int
+	pages int
+}
+
+func (s *testSource) Dialogs(f Filter, after, limit int) ([]Transcript, error) {
+	s.pages++
+	page := []Transcript{}
+	for i := after + 1; i <= s.n && len(page) < limit; i++ {
+		if f.DialogID != 0 && f.DialogID != i {
+			continue
+		}
+		page = append(page, Transcript{DialogID: i, UserID: 7,
+			UserName: "<b>user</b>", UserEmail: "user@example.com", AgentID: 3,
+			AgentName: "agent", Started: testStart, Ended: testStart.Add(time.Hour)})
+	}
+	return page, nil
+}
+
+func (s *testSource) Messages(dialogID int) ([]Message, error) {
+	msgs := []Message{}
+	for i := 0; i < dialogID%3; i++ {
+		msgs = append(msgs, Message{Created: testStart, Sender: "user",
+			Text: "hello, <script>"})
+	}
+	return msgs, nil
+}
+
+func TestExportJSON(t *testing.T) {
+	src := &testSource{n: 2*PageSize + 3}
+	b := &bytes.Buffer{}
+	w, _ := NewWriter(JSON, b)
+	n, err := Export(src, Filter{}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != src.n || src.pages != 3 {
+		t.Errorf("expected %d dialogs in 3 pages, got %d in %d", src.n, n, src.pages)
+	}
+	got := []Transcript{}
+	err = json.Unmarshal(b.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != src.n || got[4].DialogID != 5 || len(got[4].Messages) != 2 {
+		t.Errorf("bad json export %v", got[:5])
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	b := &bytes.Buffer{}
+	w, _ := NewWriter(JSON, b)
+	_, err := Export(&testSource{}, Filter{}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []Transcript{}
+	err = json.Unmarshal(b.Bytes(), &got)
+	if err != nil || len(got) != 0 {
+		t.Errorf("expected an empty array, got %q %v", b.String(), err)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	b := &bytes.Buffer{}
+	w, _ := NewWriter(CSV, b)
+	_, err := Export(&testSource{n: 3}, Filter{}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//header, one message for 1, two for 2 and an empty row for 3
+	if len(rows) != 5 {
+		t.Fatalf("expected 5 rows, got %d: %v", len(rows), rows)
+	}
+	if rows[4][0] != "3" || rows[4][10] != "" || rows[1][10] != "hello, <script>" {
+		t.Errorf("bad csv rows %v", rows)
+	}
+}
+
+func TestExportHTML(t *testing.T) {
+	b := &bytes.Buffer{}
+	w, _ := NewWriter(HTML, b)
+	_, err := Export(&testSource{n: 5}, Filter{DialogID: 2}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := b.String()
+	if !strings.Contains(page, "Dialog 2") || strings.Contains(page, "Dialog 1") {
+		t.Errorf("expected only dialog 2 in %s", page)
+	}
+	if strings.Contains(page, "<script>") || !strings.Contains(page, "&lt;b&gt;user") {
+		t.Errorf("messages are not escaped in %s", page)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(page), "</html>") {
+		t.Errorf("page is not closed %s", page)
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	_, err := NewWriter("pdf", &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,142 @@
+package transcript
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"strconv"
+	"time"
+)
+
+//jsonWriter writes a JSON array with one object per transcript.
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonWriter) Begin() error {
+	_, err := io.WriteString(j.w, "[\n")
+	return err
+}
+
+func (j *jsonWriter) Write(t *Transcript) error {
+	if j.count > 0 {
+		_, err := io.WriteString(j.w, ",\n")
+		if err != nil {
+			return err
+		}
+	}
+	j.count++
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(b)
+	return err
+}
+
+func (j *jsonWriter) End() error {
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
+
+//csvWriter writes one row per message, repeating the dialog columns.
+//Dialogs without messages get one row with empty message columns.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+var csvHeader = []string{"dialog_id", "started", "ended", "user_id", "user_name",
+	"user_email", "agent_id", "agent_name", "created", "sender", "message"}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) Begin() error {
+	return c.w.Write(csvHeader)
+}
+
+func (c *csvWriter) Write(t *Transcript) error {
+	dialog := []string{strconv.Itoa(t.DialogID), t.Started.Format(time.RFC3339),
+		formatEnded(t), strconv.Itoa(t.UserID), t.UserName, t.UserEmail,
+		strconv.Itoa(t.AgentID), t.AgentName}
+	if len(t.Messages) == 0 {
+		return c.w.Write(append(dialog, "", "", ""))
+	}
+	for _, m := range t.Messages {
+		row := append(append([]string{}, dialog...), m.Created.Format(time.RFC3339),
+			m.Sender, m.Text)
+		err := c.w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) End() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func formatEnded(t *Transcript) string {
+	if t.Open {
+		return ""
+	}
+	return t.Ended.Format(time.RFC3339)
+}
+
+//htmlWriter writes a self contained page, the style is inline and there are
+//no scripts or links so the file can be handed over as it is.
+type htmlWriter struct {
+	w io.Writer
+}
+
+var htmlPage = template.Must(template.New("page").Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Transcripts</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.dialog { border: 1px solid #ccc; padding: 1em; margin-bottom: 2em; }
+.meta { color: #555; }
+.msg { margin: 0.3em 0; }
+.agent { color: #064; }
+.user { color: #036; }
+.time { color: #888; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<h1>Transcripts</h1>
+{{end}}
+{{define "dialog"}}<div class="dialog">
+<h2>Dialog {{.DialogID}}</h2>
+<p class="meta">User {{.UserName}} &lt;{{.UserEmail}}&gt; ({{.UserID}}),
+agent {{.AgentName}} ({{.AgentID}})<br>
+started {{.Started.Format "2006-01-02 15:04:05"}} UTC{{if not .Open}},
+ended {{.Ended.Format "2006-01-02 15:04:05"}} UTC{{else}}, still open{{end}}</p>
+{{range .Messages}}<p class="msg {{.Sender}}"><span class="time">{{.Created.Format "15:04:05"}}</span>
+<b>{{.Sender}}</b>: {{.Text}}</p>
+{{else}}<p>No messages.</p>
+{{end}}</div>
+{{end}}
+{{define "end"}}</body>
+</html>
+{{end}}`))
+
+func (h *htmlWriter) Begin() error {
+	return htmlPage.ExecuteTemplate(h.w, "begin", nil)
+}
+
+func (h *htmlWriter) Write(t *Transcript) error {
+	return htmlPage.ExecuteTemplate(h.w, "dialog", t)
+}
+
+func (h *htmlWriter) End() error {
+	return htmlPage.ExecuteTemplate(h.w, "end", nil)
+}
@@ -0,0 +1,208 @@
+//Package vault encrypts the message bodies the dbmgr stores.  It is envelope
+//encryption: each dialog has its own random data key, the messages of the
+//dialog are sealed with it in AES-GCM and the data key itself is stored
+//wrapped (sealed) by a master key.  The master keys are in a key file outside
+//the database, so a copy of the database alone does not give the messages.
+//
+//The key file has a line per master key, its id and the base64 of 32 random
+//bytes, # lines are comments:
+//
+//	2020-06 q3x0V2Zx0jL7cQm1s0Vd9p6zq0b5JH8yq1c6T2w9Zm4=
+//	2020-01 mZ2l3Wk8Yx9s0Ew2r4t6u8i0o2p4a6s8d0f2g4h6j8k=
+//
+//The first key wraps the new data keys, the others are only there to unwrap
+//the data keys wrapped before a rotation.  Rotating is adding a new first
+//line, re-wrapping the data keys with Rewrap (dbmgr rekey does that) and then
+//dropping the old line.  The messages themselves are not touched.
+//
+//Since the sealed messages cannot be searched, the words of each message are
+//also stored as Terms, keyed hashes of the words under an index key that is
+//wrapped like a data key.  A search hashes its words the same way.
+package vault
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/saied74/toychat/pkg/search"
+)
+
+//KeySize is the size of the master and data keys, AES-256.
+const KeySize = 32
+
+//TermSize is the size of a term hash.
+const TermSize = 16
+
+//ErrUnknownKey is returned for a data key wrapped by a master key that is not
+//in the key file.
+var ErrUnknownKey = errors.New("vault: unknown master key")
+
+//Keyring is the master keys of the key file.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+//Load reads the key file.
+func Load(file string) (*Keyring, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	k, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return k, nil
+}
+
+//Read reads the master keys in the key file format.
+func Read(r io.Reader) (*Keyring, error) {
+	k := &Keyring{keys: map[string][]byte{}}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("line %d: not id and key", n)
+		}
+		key, err := base64.StdEncoding.DecodeString(f[1])
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("line %d: the key is not %d bytes of base64",
+				n, KeySize)
+		}
+		if _, ok := k.keys[f[0]]; ok {
+			return nil, fmt.Errorf("line %d: key %s is there twice", n, f[0])
+		}
+		if k.current == "" {
+			k.current = f[0]
+		}
+		k.keys[f[0]] = key
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		return nil, errors.New("no master key")
+	}
+	return k, nil
+}
+
+//NewKeyLine is a key file line with a new random key.
+func NewKeyLine(id string) (string, error) {
+	key, err := NewKey()
+	if err != nil {
+		return "", err
+	}
+	return id + " " + base64.StdEncoding.EncodeToString(key), nil
+}
+
+//Current is the id of the master key new data keys are wrapped with.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+//NewKey returns a new random data key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//Wrap seals the data key with the current master key.  The context (the
+//owner of the key) has to be the same to unwrap it.
+func (k *Keyring) Wrap(dataKey []byte, context string) (keyID string,
+	wrapped []byte, err error) {
+	wrapped, err = Seal(k.keys[k.current], dataKey, context)
+	return k.current, wrapped, err
+}
+
+//Unwrap opens a data key wrapped by the master key keyID.
+func (k *Keyring) Unwrap(keyID string, wrapped []byte, context string) ([]byte,
+	error) {
+	master, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return Open(master, wrapped, context)
+}
+
+//Rewrap wraps the data key wrapped by keyID with the current master key.
+func (k *Keyring) Rewrap(keyID string, wrapped []byte, context string) (string,
+	[]byte, error) {
+	dataKey, err := k.Unwrap(keyID, wrapped, context)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.Wrap(dataKey, context)
+}
+
+//Seal encrypts the plain text with the key in AES-GCM, the nonce first.  The
+//context is authenticated, Open fails unless it is given the same one.
+func Seal(key, plain []byte, context string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+
+		aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(context)), nil
+}
+
+//Open decrypts what Seal encrypted.
+func Open(key, sealed []byte, context string) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("vault: sealed text too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], []byte(context))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("vault: key of %d bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Terms are the hashes of the words of the text under the index key, the
+//words are those search.Terms finds.
+func Terms(indexKey []byte, text string) [][]byte {
+	words := search.Terms(text)
+	terms := make([][]byte, 0, len(words))
+	for _, w := range words {
+		m := hmac.New(sha256.New, indexKey)
+		m.Write([]byte(w))
+		terms = append(terms, m.Sum(nil)[:TermSize])
+	}
+	return terms
+}
@@ -0,0 +1,118 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	old, err := NewKeyLine("2020-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := Read(strings.NewReader("# master keys\n" + old + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, wrapped, err := k.Wrap(dataKey, "dialog:7")
+	if err != nil || keyID != "2020-01" {
+		t.Fatalf("wrapped with %q: %v", keyID, err)
+	}
+	_, err = k.Unwrap(keyID, wrapped, "dialog:8")
+	if err == nil {
+		t.Error("unwrapped against another context")
+	}
+
+	line, _ := NewKeyLine("2020-06")
+	rotated, err := Read(strings.NewReader(line + "\n" + old + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, wrapped, err = rotated.Rewrap(keyID, wrapped, "dialog:7")
+	if err != nil || keyID != "2020-06" {
+		t.Fatalf("rewrapped with %q: %v", keyID, err)
+	}
+	next, _ := Read(strings.NewReader(line + "\n"))
+	got, err := next.Unwrap(keyID, wrapped, "dialog:7")
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("unwrapped after the rotation: %v", err)
+	}
+	_, err = next.Unwrap("2020-01", wrapped, "dialog:7")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("dropped key: got %v", err)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"empty", "# nothing\n", "no master key"},
+		{"no key", "2020-01\n", "not id and key"},
+		{"short key", "2020-01 c2hvcnQ=\n", "not 32 bytes"},
+		{"twice", "a AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n" +
+			"a AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n", "twice"},
+	}
+	for _, tt := range tests {
+		_, err := Read(strings.NewReader(tt.file))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key, _ := NewKey()
+	sealed, err := Seal(key, []byte("hello there"), "message:dialog:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("hello")) {
+		t.Error("the sealed text has the plain text")
+	}
+	plain, err := Open(key, sealed, "message:dialog:1")
+	if err != nil || string(plain) != "hello there" {
+		t.Errorf("opened %q: %v", plain, err)
+	}
+	_, err = Open(key, sealed, "message:dialog:2")
+	if err == nil {
+		t.Error("opened against another context")
+	}
+	_, err = Open(key, sealed[:4], "message:dialog:1")
+	if err == nil {
+		t.Error("opened a short text")
+	}
+}
+
+func TestTerms(t *testing.T) {
+	key, _ := NewKey()
+	message := Terms(key, "My order has not arrived")
+	query := Terms(key, "ORDER arrived")
+	if len(query) == 0 {
+		t.Fatal("no terms")
+	}
+	for _, q := range query {
+		found := false
+		for _, m := range message {
+			found = found || bytes.Equal(q, m)
+		}
+		if !found {
+			t.Errorf("term %x is not in the message", q)
+		}
+		if len(q) != TermSize {
+			t.Errorf("term of %d bytes", len(q))
+		}
+	}
+	other, _ := NewKey()
+	if bytes.Equal(Terms(other, "order")[0], Terms(key, "order")[0]) {
+		t.Error("the same term under another key")
+	}
+}
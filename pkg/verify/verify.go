@@ -0,0 +1,89 @@
+//Package verify signs and checks the email verification links of the end
+//users.  The token is "id.expires.mac" where mac is an HMAC-SHA256 of the
+//user id, the expiry and the email address under the deployment's key, so
+//nothing needs to be stored and a link stops working when it expires or the
+//address changes.
+package verify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Errors returned by Check and UserID.
+var (
+	ErrInvalid = errors.New("verify: invalid token")
+	ErrExpired = errors.New("verify: token expired")
+)
+
+//Signer makes and checks the tokens of one deployment.
+type Signer struct {
+	Key []byte
+	TTL time.Duration //how long a link can be used
+}
+
+//NewSigner returns a Signer with the key and the time to live of the links.
+func NewSigner(key []byte, ttl time.Duration) *Signer {
+	return &Signer{Key: key, TTL: ttl}
+}
+
+//Sign returns the token for the user's id and email, good until now + TTL.
+func (s *Signer) Sign(userID int, email string, now time.Time) string {
+	expires := now.Add(s.TTL).Unix()
+	head := strconv.Itoa(userID) + "." + strconv.FormatInt(expires, 10)
+	return head + "." + s.mac(head, email)
+}
+
+//Check returns nil if the token was signed for the email with this key and is
+//not expired at now, ErrExpired if it is otherwise good but too old.
+func (s *Signer) Check(token, email string, now time.Time) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return ErrInvalid
+	}
+	_, expires, err := parse(token)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(token[i+1:]), []byte(s.mac(token[:i], email))) {
+		return ErrInvalid
+	}
+	if !now.Before(expires) {
+		return ErrExpired
+	}
+	return nil
+}
+
+//UserID returns the user id of a token, so the user's email can be looked up
+//for Check.  The token is not checked.
+func UserID(token string) (int, error) {
+	id, _, err := parse(token)
+	return id, err
+}
+
+func (s *Signer) mac(head, email string) string {
+	h := hmac.New(sha256.New, s.Key)
+	h.Write([]byte(head + "." + strings.ToLower(email)))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func parse(token string) (int, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, time.Time{}, ErrInvalid
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		return 0, time.Time{}, ErrInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, ErrInvalid
+	}
+	return id, time.Unix(expires, 0), nil
+}
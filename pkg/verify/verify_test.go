@@ -0,0 +1,50 @@
+package verify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignCheck(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	s := NewSigner([]byte("secret"), 24*time.Hour)
+	token := s.Sign(42, "bob@example.com", now)
+	id, err := UserID(token)
+	if err != nil || id != 42 {
+		t.Errorf("UserID got %d %v, want 42", id, err)
+	}
+	tests := []struct {
+		name   string
+		signer *Signer
+		token  string
+		email  string
+		now    time.Time
+		want   error
+	}{
+		{"good", s, token, "bob@example.com", now.Add(time.Hour), nil},
+		{"case", s, token, "Bob@Example.com", now, nil},
+		{"expired", s, token, "bob@example.com", now.Add(24 * time.Hour), ErrExpired},
+		{"other email", s, token, "eve@example.com", now, ErrInvalid},
+		{"other key", NewSigner([]byte("other"), 24*time.Hour), token,
+			"bob@example.com", now, ErrInvalid},
+		{"other user", s, "43" + token[2:], "bob@example.com", now, ErrInvalid},
+		{"longer", s, token[:3] + "9" + token[3:], "bob@example.com", now, ErrInvalid},
+		{"garbage", s, "not a token", "bob@example.com", now, ErrInvalid},
+		{"empty", s, "", "bob@example.com", now, ErrInvalid},
+	}
+	for _, tt := range tests {
+		err := tt.signer.Check(tt.token, tt.email, tt.now)
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUserID(t *testing.T) {
+	for _, token := range []string{"", "x.1.abc", "0.1.abc", "1.x.abc", "1.2"} {
+		_, err := UserID(token)
+		if err != ErrInvalid {
+			t.Errorf("%q: got %v, want ErrInvalid", token, err)
+		}
+	}
+}
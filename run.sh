@@ -45,7 +45,7 @@ then
   killall ui
   rm ui
   go build -o ui .
-  ./ui -pw $2 &
+  ./ui -config $2 &
   cd $GOPATH/src/toychat
   exit 0
 fi
@@ -56,7 +56,7 @@ then
   killall ux
   rm ux
   go build -o ux .
-  ./ux -pw $2 &
+  ./ux -config $2 &
   cd $GOPATH/src/toychat
   exit 0
 fi
@@ -89,7 +89,7 @@ then
   killall dbmgr
   rm dbmgr
   go build -o dbmgr .
-  ./dbmgr -pw $2 &
+  ./dbmgr -config $2 &
   cd $GOPATH/src/toychat
   exit 0
 fi
@@ -133,11 +133,11 @@ cd $GOPATH/src/toychat
 cd $GOPATH/src/toychat/frontend/web
 rm ui
 go build -o ui .
-./ui -pw $2 &
+./ui -config $2 &
 cd $GOPATH/src/toychat/backend/backendweb
 rm ux
 go build -o ux .
-./ux -pw $2 &
+./ux -config $2 &
 cd $GOPATH/src/toychat/mat
 rm matMat
 go build -o matMat .
@@ -149,7 +149,7 @@ go build -o chat .
 cd $GOPATH/src/toychat/dbmgr
 rm dbmgr
 go build -o dbmgr .
-./dbmgr -pw $2 &
+./dbmgr -config $2 &
 # cd $GOPATH/src/toychat/msghub
 # rm hub
 # go build -o hub .
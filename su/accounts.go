@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/saied74/toychat/pkg/broker"
+	"github.com/saied74/toychat/pkg/throttle"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errDuplicateEmail = errors.New("models: duplicate email")
+
+//errNoSuper is returned when the email is not that of a super admin.
+var errNoSuper = errors.New("no such super admin")
+
+//errLastSuper keeps the last active super admin from being locked out.
+var errLastSuper = errors.New("this is the last active super admin")
+
+//account is a row of the admins table as su shows it.
+type account struct {
+	ID          int
+	Name        string
+	Email       string
+	Active      bool
+	Deleted     bool
+	TOTPEnabled bool
+	Created     time.Time
+}
+
+func (m *userModel) insertUser(table, name, email, password,
+	role string) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err //note we are not returning any words so we can check for the error
+	}
+	stmt := `INSERT INTO ` + table +
+		` (name, email, hashed_password, created, role) VALUES(?, ?, ?, UTC_TIMESTAMP(), ?)`
+
+	result, err := m.dB.Exec(stmt, name, email, string(hashedPassword), role)
+	if err != nil {
+		var mySQLError *mysql.MySQLError
+		if errors.As(err, &mySQLError) {
+			if mySQLError.Number == 1062 &&
+				strings.Contains(mySQLError.Message, table+"_uc_email") {
+				return 0, errDuplicateEmail
+			}
+		}
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+//superAdmins returns the super admins, only the active ones unless all.
+func (m *userModel) superAdmins(all bool) ([]*account, error) {
+	stmt := `SELECT id, name, email, active, deleted, totp_enabled, created
+	FROM admins WHERE role = ?`
+	if !all {
+		stmt += " AND active = TRUE AND deleted = FALSE"
+	}
+	rows, err := m.dB.Query(stmt+" ORDER BY id", superadmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	supers := []*account{}
+	for rows.Next() {
+		s := &account{}
+		err = rows.Scan(&s.ID, &s.Name, &s.Email, &s.Active, &s.Deleted,
+			&s.TOTPEnabled, &s.Created)
+		if err != nil {
+			return nil, err
+		}
+		supers = append(supers, s)
+	}
+	return supers, rows.Err()
+}
+
+//lockSuper locks the row of the super admin with the email in the transaction
+//and returns its id and if it is active.
+func lockSuper(tx *sql.Tx, email string) (int, bool, error) {
+	var id int
+	var active bool
+	err := tx.QueryRow(`SELECT id, active FROM admins
+	WHERE email = ? AND role = ? AND deleted = FALSE FOR UPDATE`,
+		email, superadmin).Scan(&id, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, errNoSuper
+	}
+	return id, active, err
+}
+
+//othersActive counts the active super admins other than the one with the id.
+func othersActive(tx *sql.Tx, id int) (int, error) {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM admins WHERE role = ?
+	AND active = TRUE AND deleted = FALSE AND id <> ? FOR UPDATE`,
+		superadmin, id).Scan(&n)
+	return n, err
+}
+
+//setActive activates or deactivates the super admin, but never the last one.
+func (m *userModel) setActive(email string, active bool) (int, error) {
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	id, wasActive, err := lockSuper(tx, email)
+	if err != nil {
+		return 0, err
+	}
+	if wasActive && !active {
+		n, err := othersActive(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, errLastSuper
+		}
+	}
+	_, err = tx.Exec("UPDATE admins SET active = ? WHERE id = ?", active, id)
+	if err == nil && !active {
+		err = endSessions(tx, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+//resetPassword sets the password of the super admin, lifts its login lock,
+//logs it out everywhere and, with no2FA, turns its two-factor login off.
+func (m *userModel) resetPassword(email, password string, no2FA bool) (int,
+	error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	id, _, err := lockSuper(tx, email)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`UPDATE admins SET hashed_password = ?, must_reset = FALSE
+	WHERE id = ?`, string(hashedPassword), id)
+	if err != nil {
+		return 0, err
+	}
+	if no2FA {
+		_, err = tx.Exec(`UPDATE admins SET totp_enabled = FALSE,
+		totp_secret = '', totp_step = 0 WHERE id = ?`, id)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM recovery_codes WHERE account_id = ?", id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = endSessions(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	key := throttle.AccountKey("admins", email)
+	for _, table := range []string{"login_failures", "lockouts"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE kind = ? AND lkey = ?",
+			throttle.Account, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+//endSessions logs the super admin with the id out everywhere by removing its
+//sessions from the session index.
+func endSessions(tx *sql.Tx, id int) error {
+	_, err := tx.Exec(`DELETE FROM session_index
+	WHERE table_name = 'admins' AND account_id = ?`, id)
+	return err
+}
+
+//promote makes the account with the email a super admin and returns its id
+//and its role before.  Accounts of the agent console are not promoted, they
+//may still have dialogs.
+func (m *userModel) promote(email string) (int, string, error) {
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+	var id int
+	var role, console string
+	err = tx.QueryRow(`SELECT a.id, a.role, COALESCE(r.console, '')
+	FROM admins a LEFT JOIN roles r ON r.name = a.role
+	WHERE a.email = ? AND a.deleted = FALSE FOR UPDATE`, email).Scan(&id, &role,
+		&console)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, "", fmt.Errorf("no account with the email %s", email)
+	case err != nil:
+		return 0, "", err
+	case role == superadmin:
+		return 0, "", fmt.Errorf("%s is already a super admin", email)
+	case console != "admin":
+		return 0, "", fmt.Errorf("%s is %s, only admins can be promoted", email,
+			role)
+	}
+	_, err = tx.Exec("UPDATE admins SET role = ? WHERE id = ?", superadmin, id)
+	if err != nil {
+		return 0, "", err
+	}
+	return id, role, tx.Commit()
+}
+
+//demote gives the super admin with the email the role of the admin console,
+//but never the last active one.
+func (m *userModel) demote(email, role string) (int, error) {
+	tx, err := m.dB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var console string
+	err = tx.QueryRow("SELECT console FROM roles WHERE name = ?",
+		role).Scan(&console)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && console != "admin") {
+		return 0, fmt.Errorf("%s is not a role of the admin console", role)
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, active, err := lockSuper(tx, email)
+	if err != nil {
+		return 0, err
+	}
+	if active {
+		n, err := othersActive(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, errLastSuper
+		}
+	}
+	_, err = tx.Exec("UPDATE admins SET role = ? WHERE id = ?", role, id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+//audit records what su did in the audit log, a failure is only reported.
+func (c *cli) audit(event string, targetID int, target, detail string) {
+	_, err := c.m.dB.Exec(`INSERT INTO audit
+	(created, event, actor_role, target_id, target, detail)
+	VALUES (UTC_TIMESTAMP(), ?, ?, ?, ?, ?)`, event, broker.ActorCLI, targetID,
+		target, strings.TrimSpace("su "+detail))
+	if err != nil {
+		fmt.Fprintln(c.errOut, "su: the audit log was not updated:", err)
+	}
+}
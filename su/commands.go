@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/saied74/toychat/pkg/broker"
+)
+
+func cmdCreate(c *cli, args []string) error {
+	fs := c.flags("create")
+	name := fs.String("name", "", "first name followed by last name")
+	email := fs.String("email", "", "email address, the login")
+	pwStdin := fs.Bool("password-stdin", false,
+		"read the password from the first line of stdin")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	p := getProfile()
+	var err error
+	if *name == "" || *email == "" || !*pwStdin {
+		c.printIntro()
+	}
+	if *name == "" {
+		*name, err = c.getInput(p["name"])
+		if err != nil {
+			return err
+		}
+	}
+	if *email == "" {
+		*email, err = c.getInput(p["email"])
+		if err != nil {
+			return err
+		}
+	}
+	password, err := c.getPassword(*pwStdin)
+	if err != nil {
+		return err
+	}
+	suForm := validateAccount(*name, *email, password)
+	if !suForm.Valid() {
+		return c.invalid(suForm)
+	}
+	m, err := c.db()
+	if err != nil {
+		return err
+	}
+	id, err := m.insertUser("admins", *name, *email, password, superadmin)
+	if err != nil {
+		if errors.Is(err, errDuplicateEmail) {
+			fmt.Fprintf(c.errOut, "email : %s is already in use\n", *email)
+			return errUsage
+		}
+		return err
+	}
+	c.audit(broker.AuditAdd, id, *email, "role "+superadmin)
+	c.printGoodConclusion()
+	return nil
+}
+
+func cmdList(c *cli, args []string) error {
+	fs := c.flags("list")
+	all := fs.Bool("all", false, "also list the inactive and deleted")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+	m, err := c.db()
+	if err != nil {
+		return err
+	}
+	supers, err := m.superAdmins(*all)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tEMAIL\tSTATE\t2FA\tCREATED")
+	for _, s := range supers {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Name, s.Email,
+			state(s), onOff(s.TOTPEnabled), s.Created.Format("2006-01-02"))
+	}
+	return tw.Flush()
+}
+
+func cmdDeactivate(c *cli, args []string) error {
+	return c.setActive("deactivate", args, false)
+}
+
+func cmdActivate(c *cli, args []string) error {
+	return c.setActive("activate", args, true)
+}
+
+func (c *cli) setActive(name string, args []string, active bool) error {
+	email, err := c.emailFlag(name, args)
+	if err != nil {
+		return err
+	}
+	m, err := c.db()
+	if err != nil {
+		return err
+	}
+	id, err := m.setActive(email, active)
+	if err != nil {
+		return err
+	}
+	event := broker.AuditDeactivate
+	if active {
+		event = broker.AuditActivate
+	}
+	c.audit(event, id, email, "role "+superadmin)
+	fmt.Fprintf(c.out, "%s is %sd\n", email, name)
+	return nil
+}
+
+func cmdResetPassword(c *cli, args []string) error {
+	fs := c.flags("reset-password")
+	email := fs.String("email", "", "email address of the super admin")
+	pwStdin := fs.Bool("password-stdin", false,
+		"read the password from the first line of stdin")
+	no2FA := fs.Bool("disable-2fa", false,
+		"also turn two-factor login off, e.g. for a lost phone")
+	if fs.Parse(args) != nil || fs.NArg() > 0 || *email == "" {
+		if *email == "" {
+			fmt.Fprintln(c.errOut, "su reset-password: -email is required")
+		}
+		return errUsage
+	}
+	password, err := c.getPassword(*pwStdin)
+	if err != nil {
+		return err
+	}
+	suForm := validatePassword(password)
+	if !suForm.Valid() {
+		return c.invalid(suForm)
+	}
+	m, err := c.db()
+	if err != nil {
+		return err
+	}
+	id, err := m.resetPassword(*email, password, *no2FA)
+	if err != nil {
+		return err
+	}
+	c.audit(broker.AuditReset, id, *email, "")
+	if *no2FA {
+		c.audit(broker.Audit2FAReset, id, *email, "")
+	}
+	fmt.Fprintf(c.out, "the password of %s is reset\n", *email)
+	return nil
+}
+
+func cmdPromote(c *cli, args []string) error {
+	email, err := c.emailFlag("promote", args)
+	if err != nil {
+		return err
+	}
+	m, err := c.db()
+	if err != nil {
+		return err
+	}
+	id, from, err := m.promote(email)
+	if err != nil {
+		return err
+	}
+	c.audit(broker.AuditPromote, id, email, "from "+from)
+	fmt.Fprintf(c.out, "%s is a super admin\n", email)
+	return nil
+}
+
+func cmdDemote(c *cli, args []string) error {
+	fs := c.flags("demote")
+	email := fs.String("email", "", "email address of the super admin")
+	role := fs.String("role", "admin", "the new role")
+	if fs.Parse(args) != nil || fs.NArg() > 0 || *email == "" {
+		if *email == "" {
+			fmt.Fprintln(c.errOut, "su demote: -email is required")
+		}
+		return errUsage
+	}
+	if *role == superadmin {
+		fmt.Fprintln(c.errOut, "su demote: -role has to be another role")
+		return errUsage
+	}
+	m, err := c.db()
+	if err != nil {
+		return err
+	}
+	id, err := m.demote(*email, *role)
+	if err != nil {
+		return err
+	}
+	c.audit(broker.AuditDemote, id, *email, "to "+*role)
+	fmt.Fprintf(c.out, "%s is now %s\n", *email, *role)
+	return nil
+}
+
+//emailFlag parses the arguments of the commands that only take -email.
+func (c *cli) emailFlag(name string, args []string) (string, error) {
+	fs := c.flags(name)
+	email := fs.String("email", "", "email address of the account")
+	if fs.Parse(args) != nil || fs.NArg() > 0 {
+		return "", errUsage
+	}
+	if *email == "" {
+		fmt.Fprintf(c.errOut, "su %s: -email is required\n", name)
+		return "", errUsage
+	}
+	return *email, nil
+}
+
+func state(s *account) string {
+	switch {
+	case s.Deleted:
+		return "deleted"
+	case !s.Active:
+		return "inactive"
+	}
+	return "active"
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/saied74/toychat/pkg/forms"
+)
+
+//errNoInput is returned when stdin ends before a prompt is answered.
+var errNoInput = fmt.Errorf("%w: no more input", errUsage)
+
+type profile struct {
+	firstMsg  string
+	secondMsg string
+}
+
+type profiles map[string]profile
+
+func getProfile() profiles {
+	return profiles{
+		"name": {
+			firstMsg:  "Enter your first name followed by last name: ",
+			secondMsg: "Your name is: ",
+		},
+		"email": {
+			firstMsg:  "Enter your email address: ",
+			secondMsg: "Your email is: ",
+		},
+		"password1": {
+			firstMsg: "Enter your password: ",
+		},
+		"password2": {
+			firstMsg:  "Enter your password for a second time: ",
+			secondMsg: "Your second entry does does not match the first, try again",
+		},
+	}
+}
+
+//readLine reads one line of the input without the line end.
+func (c *cli) readLine() (string, error) {
+	line, err := c.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return "", errNoInput
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+//getInput asks for the input of the profile until it is confirmed.
+func (c *cli) getInput(p profile) (string, error) {
+	for {
+		fmt.Fprintln(c.out, p.firstMsg)
+		input, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(c.out, p.secondMsg, input)
+		fmt.Fprintln(c.out, "Is that correct (Y or N):")
+		test, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		if test == "Y" {
+			return input, nil
+		}
+	}
+}
+
+//getPassword reads the password from stdin when fromStdin is set, otherwise
+//it asks for it twice until both entries match.
+func (c *cli) getPassword(fromStdin bool) (string, error) {
+	if fromStdin {
+		return c.readLine()
+	}
+	p := getProfile()
+	for {
+		fmt.Fprintln(c.out, p["password1"].firstMsg)
+		password1, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(c.out, p["password2"].firstMsg)
+		password2, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		if password1 == password2 {
+			return password1, nil
+		}
+		fmt.Fprintln(c.out, p["password2"].secondMsg)
+	}
+}
+
+//validateAccount checks a new account with the same rules the web apps use.
+func validateAccount(name, email, password string) *forms.FormData {
+	suForm := forms.NewForm(url.Values{
+		"name":     []string{name},
+		"email":    []string{email},
+		"password": []string{password},
+	})
+	suForm.FieldRequired("name", "email", "password")
+	suForm.MaxLength("name", 255)
+	suForm.MaxLength("email", 255)
+	suForm.MatchPattern("email", forms.EmailRX)
+	suForm.MinLength("password", 10)
+	return suForm
+}
+
+//validatePassword checks a new password of an account.
+func validatePassword(password string) *forms.FormData {
+	suForm := forms.NewForm(url.Values{"password": []string{password}})
+	suForm.FieldRequired("password")
+	suForm.MinLength("password", 10)
+	return suForm
+}
+
+//invalid prints the validation errors of the form and returns errUsage.
+func (c *cli) invalid(suForm *forms.FormData) error {
+	for key, value := range suForm.Errors {
+		check := strings.Replace(value, ";", "\n", -1)
+		fmt.Fprintln(c.errOut, key, ":", check)
+	}
+	fmt.Fprintln(c.errOut, "database did not update, run the program again")
+	return errUsage
+}
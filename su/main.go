@@ -1,3 +1,13 @@
+//su is the offline command line tool for the super admin accounts of the back
+//end.  It works on the database directly so it also works when nobody can log
+//in, e.g. to create the first super admin or to reset a lost password.
+//
+//	su [-config file] command [flags]
+//
+//The database and the file with its password are read from the configuration
+//file and the environment, see pkg/config.  Run su help for the commands.
+//The exit code is 0 when the command worked, 1 when it failed and 2 for a bad
+//command line or input that did not validate.
 package main
 
 import (
@@ -6,91 +16,163 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
 	"os"
-	"strings"
 
-	"github.com/go-sql-driver/mysql"
-	"github.com/saied74/toychat/pkg/forms"
-	"golang.org/x/crypto/bcrypt"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/saied74/toychat/pkg/config"
 )
 
 const (
 	superadmin = "superadmin"
 )
 
-type profile struct {
-	firstMsg  string
-	secondMsg string
-	input     string
-}
+//exit codes
+const (
+	exitOK    = 0
+	exitFail  = 1
+	exitUsage = 2
+)
 
-type profiles map[string]profile
+//errUsage is returned (wrapped) for a bad command line and for input that did
+//not validate, the reasons are already printed.
+var errUsage = errors.New("usage")
 
 type userModel struct {
 	dB *sql.DB
 }
 
-var errDuplicateEmail = errors.New("models: duplicate email")
+//cli is one run of su: the input and outputs it uses and the database it
+//connects to once a command needs it.
+type cli struct {
+	in     *bufio.Reader
+	out    io.Writer
+	errOut io.Writer
+	open   func() (*userModel, error)
+	m      *userModel
+}
 
-func main() {
-	var name, email, password1, password2 string
-	printIntro()
-	var p = getProfile()
-
-	// database password flag is required so we don't save it in the program.
-	dsn := flag.String("dsn", "toy:password@/toychat?parseTime=true",
-		"MySQL data source name")
-	pw := flag.String("pw", "password", "database password is always required")
-	flag.Parse()
-	dbAddress := strings.Replace(*dsn, "password", *pw, 1)
-
-	db, err := openDB(dbAddress)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
+//command is a su sub command.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(c *cli, args []string) error
+}
 
-	m := userModel{dB: db}
+var commands = []command{
+	{"create", "[-name name] [-email email] [-password-stdin]",
+		"create a super admin, asks for what the flags do not give", cmdCreate},
+	{"list", "[-all]", "list the super admins, -all with the inactive and deleted",
+		cmdList},
+	{"deactivate", "-email email",
+		"log a super admin out and stop it from logging in", cmdDeactivate},
+	{"activate", "-email email", "let a deactivated super admin log in again",
+		cmdActivate},
+	{"reset-password", "-email email [-password-stdin] [-disable-2fa]",
+		"set a new password of a super admin, lift its login lock and log it out",
+		cmdResetPassword},
+	{"promote", "-email email", "make an admin a super admin", cmdPromote},
+	{"demote", "-email email [-role role]",
+		"make a super admin an admin (or the role)", cmdDemote},
+}
 
-	reader := bufio.NewReader(os.Stdin)
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	name = p["name"].getInput(reader)
-	email = p["email"].getInput(reader)
-	for {
-		password1 = p["password1"].getInput(reader)
-		password2 = p["password2"].getInput(reader)
-		if password1 == password2 {
-			break
+//run runs su with the arguments and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("su", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { usage(stderr) }
+	configFile := config.FileFlag(fs)
+	if fs.Parse(args) != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 || fs.Arg(0) == "help" {
+		usage(stderr)
+		if fs.NArg() == 0 {
+			return exitUsage
 		}
+		return exitOK
 	}
-
-	data := url.Values{
-		"name":     []string{name},
-		"email":    []string{email},
-		"password": []string{password1},
+	c := &cli{
+		in:     bufio.NewReader(stdin),
+		out:    stdout,
+		errOut: stderr,
+		open: func() (*userModel, error) {
+			cfg, err := config.Load("su", *configFile)
+			if err != nil {
+				return nil, err
+			}
+			dsn, err := cfg.DataSource()
+			if err != nil {
+				return nil, err
+			}
+			db, err := openDB(dsn)
+			if err != nil {
+				return nil, err
+			}
+			return &userModel{dB: db}, nil
+		},
 	}
-	suForm := forms.NewForm(data)
-	suForm.FieldRequired("name", "email", "password")
-	suForm.MaxLength("name", 255)
-	suForm.MaxLength("email", 255)
-	suForm.MatchPattern("email", forms.EmailRX)
-	suForm.MinLength("password", 10)
-	if !suForm.Valid() {
-		for key, value := range suForm.Errors {
-			check := strings.Replace(value, ";", "\n", -1)
-			fmt.Println(key, ":", check)
-			fmt.Println("database did not update, run the program again")
-			// os.Exit(0)
+	defer c.close()
+	for _, cmd := range commands {
+		if cmd.name != fs.Arg(0) {
+			continue
 		}
+		err := cmd.run(c, fs.Args()[1:])
+		switch {
+		case err == nil:
+			return exitOK
+		case errors.Is(err, errUsage):
+			if err != errUsage {
+				fmt.Fprintln(stderr, "su:", err)
+			}
+			return exitUsage
+		default:
+			fmt.Fprintln(stderr, "su:", err)
+			return exitFail
+		}
+	}
+	fmt.Fprintf(stderr, "su: unknown command %q\n", fs.Arg(0))
+	usage(stderr)
+	return exitUsage
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: su [-config file] command [flags]")
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s %s\n    \t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+}
+
+//flags returns the flag set of a command.
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("su "+name, flag.ContinueOnError)
+	fs.SetOutput(c.errOut)
+	return fs
+}
+
+//db connects to the database on first use.
+func (c *cli) db() (*userModel, error) {
+	if c.m != nil {
+		return c.m, nil
 	}
-	err = m.insertUser("admins", name, email, password1, superadmin)
+	m, err := c.open()
 	if err != nil {
-		log.Println(err)
-		printBadConclusion()
+		return nil, err
+	}
+	c.m = m
+	return m, nil
+}
+
+func (c *cli) close() {
+	if c.m != nil {
+		c.m.dB.Close()
 	}
-	printGoodConclusion()
 }
 
 // The openDB() function wraps sql.Open() and returns a sql.DB connection pool
@@ -106,91 +188,18 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func getProfile() profiles {
-	return profiles{
-		"name": profile{
-			firstMsg:  "Enter your first name followed by last name: ",
-			secondMsg: "Your name is: ",
-			input:     "",
-		},
-		"email": profile{
-			firstMsg:  "Enter your email address: ",
-			secondMsg: "Your email is: ",
-			input:     "",
-		},
-		"password1": {
-			firstMsg:  "Enter your password: ",
-			secondMsg: "Your password is: ",
-			input:     "",
-		},
-		"password2": {
-			firstMsg:  "Enter your password for a second time: ",
-			secondMsg: "Your second entry does does not match the first: ",
-			input:     "",
-		},
-	}
-}
-
-func (p profile) getInput(reader *bufio.Reader) string {
-	for {
-		fmt.Println(p.firstMsg)
-		input, _ := reader.ReadString('\n')
-		fmt.Println(p.secondMsg, input)
-		fmt.Println("Is that correct (Y or N):")
-		test, _ := reader.ReadString('\n')
-		test = strings.TrimSuffix(test, "\n")
-		if test == "Y" {
-			return strings.TrimSuffix(input, "\n")
-		}
-	}
-}
-
-func (m *userModel) insertUser(table, name, email, password, role string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
-	if err != nil {
-		return err //note we are not returning any words so we can check for the error
-	}
-	stmt := `INSERT INTO ` + table +
-		` (name, email, hashed_password, created, role) VALUES(?, ?, ?, UTC_TIMESTAMP(), ?)`
-
-	_, err = m.dB.Exec(stmt, name, email, string(hashedPassword), role)
-	if err != nil {
-		var mySQLError *mysql.MySQLError
-		if errors.As(err, &mySQLError) {
-			if mySQLError.Number == 1062 &&
-				strings.Contains(mySQLError.Message, "users_uc_email") {
-				return errDuplicateEmail
-			}
-		}
-		return err
-	}
-	return nil
-}
-
-func printIntro() {
-	fmt.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
-	fmt.Println("+ This program is desgined to create the super admin for the +")
-	fmt.Println("+ toychat application.  It must be run when the admin table  +")
-	fmt.Println("+ does not have any superadmin roles in it.  If there is a   +")
-	fmt.Println("+ superadmin role currently in the table, remove it using    +")
-	fmt.Println("+ MySQL tools and then run this progream.                    +")
-	fmt.Println("+ For now, I am just permitting one superadmin role and this +")
-	fmt.Println("+ set up program.  I will change it in the future.           +")
-	fmt.Println("+ You should run this program on a secure machine and in a   +")
-	fmt.Println("+ and in a secure environment.                               +")
-	fmt.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
-}
-
-func printGoodConclusion() {
-	fmt.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
-	fmt.Println("+++++++++++++++++++++ CONGRATULATIONS ++++++++++++++++++++++++")
-	fmt.Println("+ You have successfully updated the superadmin profile.      +")
-	fmt.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
+func (c *cli) printIntro() {
+	fmt.Fprintln(c.out, "++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
+	fmt.Fprintln(c.out, "+ This program creates a super admin of the toychat          +")
+	fmt.Fprintln(c.out, "+ application.  There can be more than one, see su list.     +")
+	fmt.Fprintln(c.out, "+ You should run this program on a secure machine and in a   +")
+	fmt.Fprintln(c.out, "+ and in a secure environment.                               +")
+	fmt.Fprintln(c.out, "++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
 }
 
-func printBadConclusion() {
-	fmt.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
-	fmt.Println("++++++++++++++++++++++++++ SORRY +++++++++++++++++++++++++++++")
-	fmt.Println("+ Inspect and clean the database admins table and try again  +")
-	fmt.Println("++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
+func (c *cli) printGoodConclusion() {
+	fmt.Fprintln(c.out, "++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
+	fmt.Fprintln(c.out, "+++++++++++++++++++++ CONGRATULATIONS ++++++++++++++++++++++++")
+	fmt.Fprintln(c.out, "+ You have successfully updated the superadmin profile.      +")
+	fmt.Fprintln(c.out, "++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++")
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/saied74/toychat/pkg/config"
+)
+
+func TestRunUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no command", []string{}, exitUsage},
+		{"help", []string{"help"}, exitOK},
+		{"unknown command", []string{"remove"}, exitUsage},
+		{"bad global flag", []string{"-nope", "list"}, exitUsage},
+		{"bad command flag", []string{"list", "-nope"}, exitUsage},
+		{"extra argument", []string{"list", "extra"}, exitUsage},
+		{"email missing", []string{"deactivate"}, exitUsage},
+		{"reset email missing", []string{"reset-password"}, exitUsage},
+		{"demote to superadmin", []string{"demote", "-email", "a@b.com", "-role",
+			superadmin}, exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			code := run(tt.args, strings.NewReader(""), &out, &errOut)
+			if code != tt.code {
+				t.Errorf("exit code %d, want %d (%s)", code, tt.code, errOut.String())
+			}
+		})
+	}
+}
+
+//input that does not validate must stop su before it gets to the database,
+//the dsn is unreachable so a database access would exit with exitFail.
+func TestRunCreateInvalid(t *testing.T) {
+	key := config.EnvName("db.dsn")
+	defer os.Setenv(key, os.Getenv(key))
+	os.Setenv(key, "nobody@tcp(127.0.0.1:1)/none")
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		field string
+	}{
+		{"bad email", []string{"create", "-name", "Jo Doe", "-email", "jo",
+			"-password-stdin"}, "longenoughpassword\n", "email"},
+		{"short password", []string{"create", "-name", "Jo Doe", "-email",
+			"jo@example.com", "-password-stdin"}, "short\n", "password"},
+		{"blank name", []string{"create", "-name", " ", "-email",
+			"jo@example.com", "-password-stdin"}, "longenoughpassword\n", "name"},
+		{"interactive", []string{"create"},
+			"Jo\nN\nJo Doe\nY\njo\nY\nsecret-one\nsecret-two\nsecret\nsecret\n",
+			"email"},
+		{"short reset", []string{"reset-password", "-email", "jo@example.com",
+			"-password-stdin"}, "short\n", "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			code := run(tt.args, strings.NewReader(tt.stdin), &out, &errOut)
+			if code != exitUsage {
+				t.Fatalf("exit code %d, want %d (%s)", code, exitUsage,
+					errOut.String())
+			}
+			if !strings.Contains(errOut.String(), tt.field+" :") {
+				t.Errorf("no %s error in %q", tt.field, errOut.String())
+			}
+			if !strings.Contains(errOut.String(), "database did not update") {
+				t.Errorf("missing the not updated note in %q", errOut.String())
+			}
+		})
+	}
+}
+
+func TestRunNoInput(t *testing.T) {
+	var out, errOut bytes.Buffer
+	code := run([]string{"create", "-name", "Jo Doe"}, strings.NewReader(""),
+		&out, &errOut)
+	if code != exitUsage {
+		t.Errorf("exit code %d, want %d", code, exitUsage)
+	}
+	if !strings.Contains(errOut.String(), "no more input") {
+		t.Errorf("got %q, want no more input", errOut.String())
+	}
+}